@@ -0,0 +1,253 @@
+// Alert notifications (log, MQTT, webhook) and monitoring of the recorded
+// data stream.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mqttrack/fnmatch"
+	"mqttrack/timefmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateStale     = "stale"     // Topic silent longer than the expected interval
+	StateRecovered = "recovered" // Stale topic received again
+	StateFiring    = "firing"    // Rule condition met
+	StateResolved  = "resolved"  // Rule condition no longer met
+)
+
+const (
+	ActionLog     = "log"
+	ActionMQTT    = "mqtt"    // Publish to the alert topic
+	ActionWebhook = "webhook" // HTTP POST to the webhook url
+	ActionCommand = "command" // Execute the command of the rule
+)
+
+// Maximum run time of alert commands.
+const CommandTimeout = 30 * time.Second
+
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Topic   string    `json:"topic"`
+	State   string    `json:"state"`
+	Message string    `json:"message"`
+	Value   *float64  `json:"value,omitempty"`
+}
+
+// Expected maximum interval of topics matching the fnmatch pattern.
+type StaleRule struct {
+	Pattern     string           `json:"pattern"`
+	MaxInterval timefmt.Duration `json:"max_interval"`
+}
+
+type Settings struct {
+	Topic   string      `json:"topic"`           // MQTT topic for alert messages, empty: not published
+	Webhook string      `json:"webhook"`         // URL for HTTP POST of the alert messages, empty: disabled
+	Stale   []StaleRule `json:"stale,omitempty"` // Stale topic watchdog, first matching pattern wins
+	Rules   []Rule      `json:"rules,omitempty"` // Threshold and rate-of-change rules, all matching rules apply
+}
+
+func (me *Settings) Validate() error {
+	if strings.ContainsAny(me.Topic, "+#") {
+		return fmt.Errorf("invalid alert topic: '%s'", me.Topic)
+	}
+	if me.Webhook != "" {
+		if u, err := url.Parse(me.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid alert webhook url: '%s'", me.Webhook)
+		}
+	}
+	for _, rule := range me.Stale {
+		if rule.Pattern == "" {
+			return fmt.Errorf("stale rule: missing pattern")
+		} else if rule.MaxInterval <= 0 {
+			return fmt.Errorf("stale rule for '%s': invalid max_interval", rule.Pattern)
+		}
+	}
+	for _, rule := range me.Rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Publishes messages, e.g. a connected mqttnode.Node.
+type Publisher interface {
+	Publish(topic string, data []byte, qos byte, retain bool) error
+}
+
+type Notifier struct {
+	mu        sync.Mutex
+	settings  Settings
+	publisher Publisher
+	client    *http.Client
+}
+
+func NewNotifier(settings Settings) *Notifier {
+	return &Notifier{
+		settings: settings,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (me *Notifier) Reconfigure(settings Settings) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.settings = settings
+}
+
+func (me *Notifier) SetPublisher(publisher Publisher) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.publisher = publisher
+}
+
+// Logs the alert, publishes it to the alert topic, and posts it to the
+// webhook (asynchronously).
+func (me *Notifier) Notify(alert Alert) {
+	me.Dispatch(alert, nil, nil)
+}
+
+// Sends the alert to the given actions, all configured ones except the
+// command if empty. Webhook and command run asynchronously.
+func (me *Notifier) Dispatch(alert Alert, actions []string, command []string) {
+	me.mu.Lock()
+	settings, publisher := me.settings, me.publisher
+	me.mu.Unlock()
+	enabled := func(action string) bool {
+		if len(actions) == 0 {
+			return action != ActionCommand
+		}
+		return slices.Contains(actions, action)
+	}
+	if enabled(ActionLog) {
+		log.Printf("Alert %s: %s", alert.State, alert.Message)
+	}
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	if enabled(ActionCommand) && len(command) > 0 {
+		go me.execute(command, alert, data)
+	}
+	if enabled(ActionMQTT) && settings.Topic != "" && publisher != nil {
+		// QoS 0: Dispatched in the main loop, which must not wait for acknowledges.
+		if err := publisher.Publish(settings.Topic, data, 0, false); err != nil {
+			log.Print("Alert publish failed: ", err.Error())
+		}
+	}
+	if enabled(ActionWebhook) && settings.Webhook != "" {
+		go func() {
+			resp, err := me.client.Post(settings.Webhook, "application/json", bytes.NewReader(data))
+			if err != nil {
+				log.Print("Alert webhook failed: ", err.Error())
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Print("Alert webhook failed: ", resp.Status)
+			}
+		}()
+	}
+}
+
+// Runs an alert command, the alert is passed as environment variables
+// (ALERT_RULE, ALERT_TOPIC, ALERT_STATE, ALERT_VALUE, ALERT_MESSAGE), and
+// as JSON on stdin.
+func (me *Notifier) execute(command []string, alert Alert, data []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	value := ""
+	if alert.Value != nil {
+		value = strconv.FormatFloat(*alert.Value, 'g', -1, 64)
+	}
+	cmd.Env = append(os.Environ(),
+		"ALERT_RULE="+alert.Rule,
+		"ALERT_TOPIC="+alert.Topic,
+		"ALERT_STATE="+alert.State,
+		"ALERT_VALUE="+value,
+		"ALERT_MESSAGE="+alert.Message,
+	)
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Alert command %s failed: %s %s", command[0], err.Error(), strings.TrimSpace(string(out)))
+	}
+}
+
+//------------------------------------------------------------------------
+
+// Detects topics that went silent, and their recovery.
+type Watchdog struct {
+	rules []StaleRule
+	stale map[string]time.Time // Stale topics and their last-seen time
+}
+
+func NewWatchdog(rules []StaleRule) *Watchdog {
+	return &Watchdog{rules: rules, stale: make(map[string]time.Time)}
+}
+
+func (me *Watchdog) Enabled() bool {
+	return len(me.rules) > 0
+}
+
+// Changes the rules, the state of stale topics is kept.
+func (me *Watchdog) Reconfigure(rules []StaleRule) {
+	me.rules = rules
+}
+
+func (me *Watchdog) rule(topic string) *StaleRule {
+	for i := range me.rules {
+		if fnmatch.Match(me.rules[i].Pattern, topic, fnmatch.FNM_NOESCAPE) {
+			return &me.rules[i]
+		}
+	}
+	return nil
+}
+
+// Compares the last-seen times of the topics with the rules, returns the
+// alerts for topics that went stale or recovered since the last check.
+func (me *Watchdog) Check(now time.Time, lastSeen map[string]time.Time) []Alert {
+	alerts := []Alert{}
+	for topic, seen := range lastSeen {
+		rule := me.rule(topic)
+		since, stale := me.stale[topic]
+		if rule == nil {
+			delete(me.stale, topic)
+			continue
+		} else if silent := now.Sub(seen); silent > rule.MaxInterval.D() && !stale {
+			me.stale[topic] = seen
+			alerts = append(alerts, Alert{
+				Time:    now,
+				Rule:    rule.Pattern,
+				Topic:   topic,
+				State:   StateStale,
+				Message: fmt.Sprintf("%s silent for %s (max %s)", topic, silent.Round(time.Second), rule.MaxInterval.D()),
+			})
+		} else if stale && seen.After(since) {
+			delete(me.stale, topic)
+			alerts = append(alerts, Alert{
+				Time:    now,
+				Rule:    rule.Pattern,
+				Topic:   topic,
+				State:   StateRecovered,
+				Message: fmt.Sprintf("%s recovered after %s", topic, seen.Sub(since).Round(time.Second)),
+			})
+		}
+	}
+	slices.SortFunc(alerts, func(a Alert, b Alert) int { return strings.Compare(a.Topic, b.Topic) })
+	return alerts
+}
@@ -0,0 +1,194 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mqttrack/timefmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type TestPublisher struct {
+	messages []string
+}
+
+func (me *TestPublisher) Publish(topic string, data []byte, qos byte, retain bool) error {
+	if qos != 0 {
+		return errors.New("unexpected qos")
+	}
+	me.messages = append(me.messages, topic+" "+string(data))
+	return nil
+}
+
+func TestSettings(t *testing.T) {
+	var settings Settings
+	text := `{"topic":"alerts","stale":[{"pattern":"a/*","max_interval":"1d12h"},{"pattern":"b","max_interval":90}]}`
+	if err := json.Unmarshal([]byte(text), &settings); err != nil {
+		t.Fatalf("Unexpected settings parse error: %v", err)
+	} else if settings.Stale[0].MaxInterval.D() != 36*time.Hour || settings.Stale[1].MaxInterval.D() != 90*time.Second {
+		t.Errorf("Unexpected durations: %+v", settings.Stale)
+	} else if err := settings.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+	for _, text := range []string{
+		`{"topic":"alerts/#"}`,
+		`{"webhook":"localhost:8080"}`,
+		`{"stale":[{"pattern":"a"}]}`,
+	} {
+		settings := Settings{}
+		json.Unmarshal([]byte(text), &settings)
+		if settings.Validate() == nil {
+			t.Errorf("Expected validation error for %s", text)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"stale":[{"pattern":"a","max_interval":"1x"}]}`), &settings); err == nil {
+		t.Errorf("Expected invalid duration error")
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	t0 := time.Date(2025, 6, 18, 12, 0, 0, 0, time.UTC)
+	wd := NewWatchdog([]StaleRule{{Pattern: "home/*/temp", MaxInterval: timefmt.Duration(time.Minute)}})
+	seen := map[string]time.Time{"home/a/temp": t0, "home/b/temp": t0, "other": t0}
+
+	if alerts := wd.Check(t0.Add(30*time.Second), seen); len(alerts) != 0 {
+		t.Errorf("Unexpected alerts: %v", alerts)
+	}
+	seen["home/b/temp"] = t0.Add(50 * time.Second)
+	alerts := wd.Check(t0.Add(70*time.Second), seen)
+	if len(alerts) != 1 || alerts[0].Topic != "home/a/temp" || alerts[0].State != StateStale {
+		t.Errorf("Expected stale alert for home/a/temp, got %v", alerts)
+	}
+	if alerts := wd.Check(t0.Add(80*time.Second), seen); len(alerts) != 0 {
+		t.Errorf("Expected stale alert only once, got %v", alerts)
+	}
+	seen["home/a/temp"] = t0.Add(90 * time.Second)
+	alerts = wd.Check(t0.Add(120*time.Second), seen)
+	if len(alerts) != 2 || alerts[0].Topic != "home/a/temp" || alerts[0].State != StateRecovered || alerts[1].Topic != "home/b/temp" || alerts[1].State != StateStale {
+		t.Errorf("Expected recovered home/a/temp and stale home/b/temp, got %v", alerts)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	posted := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &alert)
+		posted <- alert
+	}))
+	defer server.Close()
+
+	pub := &TestPublisher{}
+	notifier := NewNotifier(Settings{Topic: "mqttrack/alerts", Webhook: server.URL})
+	notifier.SetPublisher(pub)
+	notifier.Notify(Alert{Time: time.Now(), Rule: "a/*", Topic: "a/b", State: StateStale, Message: "a/b silent"})
+
+	if len(pub.messages) != 1 || pub.messages[0][:len("mqttrack/alerts {")] != "mqttrack/alerts {" {
+		t.Errorf("Unexpected published alerts: %v", pub.messages)
+	}
+	select {
+	case alert := <-posted:
+		if alert.Topic != "a/b" || alert.State != StateStale {
+			t.Errorf("Unexpected webhook alert: %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Webhook not called")
+	}
+}
+
+type TestClock struct {
+	now time.Time
+}
+
+func (me *TestClock) Now() time.Time {
+	return me.now
+}
+
+func TestRules(t *testing.T) {
+	clock := &TestClock{now: time.Date(2025, 6, 18, 12, 0, 0, 0, time.UTC)}
+	threshold, rise := 30.0, 500.0
+	settings := Settings{Rules: []Rule{
+		{Name: "hot", Pattern: "home/*/temperature", Field: "t", Above: &threshold, For: timefmt.Duration(5 * time.Minute), ClearFor: timefmt.Duration(time.Minute)},
+		{Pattern: "plug?/power", Rise: &rise, Within: timefmt.Duration(10 * time.Second)},
+	}}
+	if err := settings.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	engine := NewEngine(settings.Rules, clock, nil)
+	step := func(d time.Duration) {
+		clock.now = clock.now.Add(d)
+	}
+	expect := func(alerts []Alert, state string) {
+		t.Helper()
+		if state == "" && len(alerts) != 0 {
+			t.Errorf("Expected no alerts, got %v", alerts)
+		} else if state != "" && (len(alerts) != 1 || alerts[0].State != state) {
+			t.Errorf("Expected %s alert, got %v", state, alerts)
+		}
+	}
+
+	// Threshold with hold times
+	expect(engine.Process("home/kitchen/temperature", []byte(`{"t":31}`)), "")
+	step(4 * time.Minute)
+	expect(engine.Tick(), "")
+	expect(engine.Process("home/kitchen/temperature", []byte(`{"t":29}`)), "")
+	expect(engine.Process("home/kitchen/temperature", []byte(`{"t":32}`)), "")
+	step(5 * time.Minute)
+	alerts := engine.Tick()
+	expect(alerts, StateFiring)
+	if len(alerts) == 1 && (alerts[0].Rule != "hot" || alerts[0].Topic != "home/kitchen/temperature" || *alerts[0].Value != 32) {
+		t.Errorf("Unexpected alert: %+v", alerts[0])
+	}
+	expect(engine.Process("home/kitchen/temperature", []byte(`{"t":25}`)), "")
+	step(30 * time.Second)
+	expect(engine.Tick(), "")
+	step(30 * time.Second)
+	expect(engine.Tick(), StateResolved)
+	expect(engine.Process("home/kitchen/temperature", []byte(`not a number`)), "")
+
+	// Rate of change
+	expect(engine.Process("plug1/power", []byte("100")), "")
+	step(5 * time.Second)
+	expect(engine.Process("plug2/power", []byte("900")), "")
+	expect(engine.Process("plug1/power", []byte("550")), "")
+	step(4 * time.Second)
+	expect(engine.Process("plug1/power", []byte("600")), StateFiring)
+	step(6 * time.Second)
+	expect(engine.Tick(), StateResolved)
+
+	for _, rule := range []Rule{
+		{Pattern: "a"},
+		{Pattern: "a", Rise: &rise},
+		{Pattern: "a", Above: &threshold, Actions: []string{"mail"}},
+		{Pattern: "a", Above: &threshold, Actions: []string{ActionCommand}},
+	} {
+		if rule.Validate() == nil {
+			t.Errorf("Expected validation error for %+v", rule)
+		}
+	}
+}
+
+func TestCommandAction(t *testing.T) {
+	out := path.Join(t.TempDir(), "alert.txt")
+	notifier := NewNotifier(Settings{})
+	value := 42.0
+	notifier.Dispatch(Alert{Rule: "r", Topic: "a/b", State: StateFiring, Value: &value}, []string{ActionCommand},
+		[]string{"sh", "-c", `echo "$ALERT_RULE $ALERT_TOPIC $ALERT_STATE $ALERT_VALUE" > ` + out + `.tmp && mv ` + out + `.tmp ` + out})
+	for i := 0; i < 100 && !isfile(out); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if text, err := os.ReadFile(out); err != nil || string(text) != "r a/b firing 42\n" {
+		t.Errorf("Unexpected command output: %q, %v", string(text), err)
+	}
+}
+
+func isfile(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && st.Mode().IsRegular()
+}
@@ -0,0 +1,244 @@
+package alert
+
+import (
+	"bytes"
+	"fmt"
+	"mqttrack/codec"
+	"mqttrack/fnmatch"
+	"mqttrack/timefmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Threshold and rate-of-change rule, e.g. `home/**/temperature` above 30
+// for 5m, or `plug?/power` rise 500 within 10s. The alert fires if any of the
+// set conditions is met.
+type Rule struct {
+	Name     string           `json:"name,omitempty"`      // Default: pattern
+	Pattern  string           `json:"pattern"`             // fnmatch topic pattern
+	Field    string           `json:"field,omitempty"`     // JSON payload field (dot path), default: payload is the number
+	Above    *float64         `json:"above,omitempty"`     // Value greater than
+	Below    *float64         `json:"below,omitempty"`     // Value less than
+	Rise     *float64         `json:"rise,omitempty"`      // Increase by at least this amount `within`
+	Fall     *float64         `json:"fall,omitempty"`      // Decrease by at least this amount `within`
+	Within   timefmt.Duration `json:"within,omitempty"`    // Time window of rise/fall
+	For      timefmt.Duration `json:"for,omitempty"`       // Condition hold time before firing
+	ClearFor timefmt.Duration `json:"clear_for,omitempty"` // Hold time before resolving
+	Actions  []string         `json:"actions,omitempty"`   // log|mqtt|webhook|command, default all configured except command
+	Command  []string         `json:"command,omitempty"`   // Program and arguments of the command action
+}
+
+func (me *Rule) Validate() error {
+	if me.Pattern == "" {
+		return fmt.Errorf("alert rule: missing pattern")
+	} else if me.Above == nil && me.Below == nil && me.Rise == nil && me.Fall == nil {
+		return fmt.Errorf("alert rule '%s': no condition (above, below, rise, fall)", me.name())
+	} else if (me.Rise != nil || me.Fall != nil) && me.Within <= 0 {
+		return fmt.Errorf("alert rule '%s': rise/fall requires 'within'", me.name())
+	} else if me.For < 0 || me.ClearFor < 0 {
+		return fmt.Errorf("alert rule '%s': negative hold time", me.name())
+	}
+	for _, action := range me.Actions {
+		switch action {
+		case ActionLog, ActionMQTT, ActionWebhook:
+		case ActionCommand:
+			if len(me.Command) == 0 {
+				return fmt.Errorf("alert rule '%s': missing command", me.name())
+			}
+		default:
+			return fmt.Errorf("alert rule '%s': invalid action '%s'", me.name(), action)
+		}
+	}
+	return nil
+}
+
+func (me *Rule) name() string {
+	if me.Name != "" {
+		return me.Name
+	}
+	return me.Pattern
+}
+
+func (me *Rule) value(data []byte) (float64, error) {
+	text := string(bytes.TrimSpace(data))
+	if me.Field != "" {
+		var err error
+		if text, err = codec.JSONField(data, me.Field); err != nil {
+			return 0, err
+		}
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+func (me *Rule) describe() string {
+	conditions := []string{}
+	if me.Above != nil {
+		conditions = append(conditions, fmt.Sprintf("above %g", *me.Above))
+	}
+	if me.Below != nil {
+		conditions = append(conditions, fmt.Sprintf("below %g", *me.Below))
+	}
+	if me.Rise != nil {
+		conditions = append(conditions, fmt.Sprintf("rise by %g within %s", *me.Rise, me.Within.D()))
+	}
+	if me.Fall != nil {
+		conditions = append(conditions, fmt.Sprintf("fall by %g within %s", *me.Fall, me.Within.D()))
+	}
+	return strings.Join(conditions, " or ")
+}
+
+//------------------------------------------------------------------------
+
+// Time source of the rule engine, replaceable in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+type sample struct {
+	time  time.Time
+	value float64
+}
+
+// State of a rule for one topic.
+type ruleState struct {
+	samples []sample  // Last value, or values within the rise/fall window
+	since   time.Time // Condition differs from firing since, zero if not
+	firing  bool
+}
+
+// Evaluates the rules for the incoming messages (Process) and the hold
+// times (Tick), and dispatches the alerts to the notifier.
+type Engine struct {
+	clock    Clock
+	notifier *Notifier
+	rules    []Rule
+	states   []map[string]*ruleState // Per rule, topic
+}
+
+func NewEngine(rules []Rule, clock Clock, notifier *Notifier) *Engine {
+	me := &Engine{clock: clock, notifier: notifier, rules: rules}
+	for range rules {
+		me.states = append(me.states, make(map[string]*ruleState))
+	}
+	return me
+}
+
+// Feeds a received message, returns the alerts raised by it.
+func (me *Engine) Process(topic string, data []byte) []Alert {
+	now := me.clock.Now()
+	alerts := []Alert{}
+	for i := range me.rules {
+		rule := &me.rules[i]
+		if !fnmatch.Match(rule.Pattern, topic, fnmatch.FNM_NOESCAPE) {
+			continue
+		}
+		value, err := rule.value(data)
+		if err != nil {
+			continue
+		}
+		st, ok := me.states[i][topic]
+		if !ok {
+			st = &ruleState{}
+			me.states[i][topic] = st
+		}
+		if rule.Rise != nil || rule.Fall != nil {
+			st.samples = append(st.samples, sample{time: now, value: value})
+		} else {
+			st.samples = []sample{{time: now, value: value}}
+		}
+		if alert := me.evaluate(rule, topic, st, now); alert != nil {
+			alerts = append(alerts, *alert)
+		}
+	}
+	return alerts
+}
+
+// Re-evaluates all states, e.g. for hold times elapsed without new messages.
+func (me *Engine) Tick() []Alert {
+	now := me.clock.Now()
+	alerts := []Alert{}
+	for i := range me.rules {
+		topics := make([]string, 0, len(me.states[i]))
+		for topic := range me.states[i] {
+			topics = append(topics, topic)
+		}
+		slices.Sort(topics)
+		for _, topic := range topics {
+			if alert := me.evaluate(&me.rules[i], topic, me.states[i][topic], now); alert != nil {
+				alerts = append(alerts, *alert)
+			}
+		}
+	}
+	return alerts
+}
+
+func (me *Engine) condition(rule *Rule, st *ruleState, now time.Time) bool {
+	if rule.Rise != nil || rule.Fall != nil {
+		st.samples = slices.DeleteFunc(st.samples, func(s sample) bool { return now.Sub(s.time) > rule.Within.D() })
+	}
+	if len(st.samples) == 0 {
+		return false
+	}
+	value := st.samples[len(st.samples)-1].value
+	if rule.Above != nil && value > *rule.Above {
+		return true
+	} else if rule.Below != nil && value < *rule.Below {
+		return true
+	}
+	lo, hi := value, value
+	for _, s := range st.samples {
+		lo, hi = min(lo, s.value), max(hi, s.value)
+	}
+	if rule.Rise != nil && value-lo >= *rule.Rise {
+		return true
+	} else if rule.Fall != nil && hi-value >= *rule.Fall {
+		return true
+	}
+	return false
+}
+
+// Applies the hold times, returns the alert if the firing state changed.
+func (me *Engine) evaluate(rule *Rule, topic string, st *ruleState, now time.Time) *Alert {
+	met := me.condition(rule, st, now)
+	if met == st.firing {
+		st.since = time.Time{}
+		return nil
+	} else if st.since.IsZero() {
+		st.since = now
+	}
+	hold := rule.For.D()
+	if st.firing {
+		hold = rule.ClearFor.D()
+	}
+	if now.Sub(st.since) < hold {
+		return nil
+	}
+	st.firing, st.since = met, time.Time{}
+	alert := Alert{Time: now, Rule: rule.name(), Topic: topic}
+	if len(st.samples) > 0 {
+		value := st.samples[len(st.samples)-1].value
+		alert.Value = &value
+	}
+	if met {
+		alert.State = StateFiring
+		alert.Message = fmt.Sprintf("%s: %s %s", rule.name(), topic, rule.describe())
+	} else {
+		alert.State = StateResolved
+		alert.Message = fmt.Sprintf("%s: %s resolved", rule.name(), topic)
+	}
+	if alert.Value != nil {
+		alert.Message += fmt.Sprintf(" (value %g)", *alert.Value)
+	}
+	if me.notifier != nil {
+		me.notifier.Dispatch(alert, rule.Actions, rule.Command)
+	}
+	return &alert
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mqttrack/alert"
+	"mqttrack/mqttnode"
+	"mqttrack/recorder"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+const REDACTED string = "********"
+
+// Running service state, configuration changes are applied in the main loop.
+type App struct {
+	mu         sync.Mutex // Settings access from the HTTP API
+	updating   sync.Mutex // Serialized config updates
+	configFile string
+	settings   AppSettings
+	recorder   *recorder.Recorder
+	node       *mqttnode.Node
+	notifier   *alert.Notifier
+	watchdog   *alert.Watchdog
+	engine     *alert.Engine
+	reconfig   chan configChange
+}
+
+type configChange struct {
+	settings AppSettings
+	result   chan error
+}
+
+type ConfigSummary struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+func (me *AppSettings) Validate() error {
+	if err := me.MQTT.Validate(); err != nil {
+		return err
+	}
+	if st, err := os.Stat(me.Recorder.RootDirectory); err != nil || !st.IsDir() {
+		return fmt.Errorf("data root directory does not exist or is not a directory: %s", me.Recorder.RootDirectory)
+	}
+	if err := me.Alerts.Validate(); err != nil {
+		return err
+	}
+	if err := me.HTTP.Validate(); err != nil {
+		return err
+	}
+	return me.Recorder.Validate()
+}
+
+// Copy with passwords and tokens replaced.
+func (me AppSettings) Redacted() AppSettings {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = REDACTED
+		}
+	}
+	redact(&me.MQTT.AuthPassword)
+	redact(&me.HTTP.AuthPassword)
+	redact(&me.HTTP.Token)
+	return me
+}
+
+// Restores secrets that were sent back redacted.
+func (me *AppSettings) unredact(current *AppSettings) {
+	restore := func(s *string, c string) {
+		if *s == REDACTED {
+			*s = c
+		}
+	}
+	restore(&me.MQTT.AuthPassword, current.MQTT.AuthPassword)
+	restore(&me.HTTP.AuthPassword, current.HTTP.AuthPassword)
+	restore(&me.HTTP.Token, current.HTTP.Token)
+}
+
+// Changed configuration sections, and the ones of them requiring a restart.
+func diffSettings(prev *AppSettings, next *AppSettings) ConfigSummary {
+	summary := ConfigSummary{Changed: []string{}, RestartRequired: []string{}}
+	changed := func(name string, a any, b any, restart bool) {
+		if !reflect.DeepEqual(a, b) {
+			summary.Changed = append(summary.Changed, name)
+			if restart {
+				summary.RestartRequired = append(summary.RestartRequired, name)
+			}
+		}
+	}
+	pmqtt, nmqtt := prev.MQTT, next.MQTT
+	pmqtt.Topics, nmqtt.Topics = nil, nil
+	changed("mqtt", pmqtt, nmqtt, false)
+	changed("mqtt.topics", prev.MQTT.Topics, next.MQTT.Topics, false)
+	prec, nrec := prev.Recorder, next.Recorder
+	prec.Verbose, nrec.Verbose = false, false // Command line option
+	changed("recorder", prec, nrec, false)
+	changed("alerts", prev.Alerts, next.Alerts, false)
+	changed("http", prev.HTTP, next.HTTP, true)
+	changed("logfile", prev.LogFile, next.LogFile, true)
+	return summary
+}
+
+// Alert rules running a command, only changed in the config file (the config
+// API must not allow to run arbitrary programs).
+func commandRules(settings *AppSettings) []alert.Rule {
+	rules := []alert.Rule{}
+	for _, rule := range settings.Alerts.Rules {
+		if slices.Contains(rule.Actions, alert.ActionCommand) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// RFC7396 JSON merge patch.
+func mergePatch(target any, patch any) any {
+	pm, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]any)
+	if !ok {
+		tm = map[string]any{}
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+		} else {
+			tm[k] = mergePatch(tm[k], v)
+		}
+	}
+	return tm
+}
+
+// Writes the config file atomically (comments of the original file are lost).
+func (me *AppSettings) Save(filePath string) error {
+	text, err := json.MarshalIndent(me, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+	if err := os.WriteFile(tmp, append(text, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write config file: %s", err.Error())
+	}
+	if err := os.Rename(tmp, filePath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace config file: %s", err.Error())
+	}
+	return nil
+}
+
+// Replaces the broker connection. The previous connection is only closed
+// after connecting with the new settings succeeded, otherwise it is kept.
+func (me *App) reconnect(settings *mqttnode.Settings) error {
+	log.Print("Reconnecting to broker ", settings.BrokerIP)
+	node, err := mqttnode.Connect(settings)
+	if err != nil {
+		node.Disconnect()
+		return err
+	}
+	me.node.Disconnect()
+	me.node = node
+	me.recorder.SetPublisher(me.node)
+	me.notifier.SetPublisher(me.node)
+	return nil
+}
+
+// Checks the watchdog rules and the alert rule hold times (main loop ticker).
+func (me *App) checkAlerts(now time.Time) {
+	me.engine.Tick()
+	if !me.watchdog.Enabled() {
+		return
+	}
+	for _, alert := range me.watchdog.Check(now, me.recorder.LastSeen()) {
+		me.notifier.Notify(alert)
+	}
+}
+
+// Re-reads the config file (SIGHUP) and applies the changes. Must not be
+// called in the main loop, the changes are applied there like config API
+// updates.
+func (me *App) reload() {
+	me.updating.Lock() // Also while reading, the file may be saved by a config API update
+	defer me.updating.Unlock()
+	next := AppSettings{}
+	if err := next.Load(me.configFile); err != nil {
+		log.Print("Config reload rejected: ", err.Error())
+		return
+	} else if err := next.Validate(); err != nil {
+		log.Print("Config reload rejected: ", err.Error())
+		return
+	}
+	if err := me.submit(next); err != nil {
+		log.Print("Config reload rejected: ", err.Error())
+	} else if len(next.Recorder.Scripts) > 0 {
+		me.recorder.ReloadScripts()
+	}
+}
+
+// Passes new settings to the main loop and waits until they are applied.
+func (me *App) submit(next AppSettings) error {
+	result := make(chan error, 1)
+	me.reconfig <- configChange{settings: next, result: result}
+	return <-result
+}
+
+//------------------------------------------------------------------------
+
+// Config API: effective settings, secrets redacted.
+func (me *App) Config() any {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.settings.Redacted()
+}
+
+// Config API: Parses, validates, applies and persists a new configuration.
+// Called from the HTTP server goroutine, the changes are applied in the main
+// loop. The config file is only written if the changes were applied.
+func (me *App) UpdateConfig(data []byte, patch bool) (any, error) {
+	me.updating.Lock()
+	defer me.updating.Unlock()
+	me.mu.Lock()
+	current := me.settings
+	me.mu.Unlock()
+	if patch {
+		var doc, diff any
+		cur, _ := json.Marshal(current)
+		json.Unmarshal(cur, &doc)
+		if err := json.Unmarshal(data, &diff); err != nil {
+			return nil, fmt.Errorf("invalid JSON patch: %s", err.Error())
+		}
+		data, _ = json.Marshal(mergePatch(doc, diff))
+	}
+	next := AppSettings{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&next); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err.Error())
+	}
+	next.SetMissingFieldDefaults()
+	next.unredact(&current)
+	if err := next.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err.Error())
+	} else if !reflect.DeepEqual(commandRules(&current), commandRules(&next)) {
+		return nil, errors.New("alert rules with command actions can only be changed in the config file")
+	}
+	if err := me.submit(next); err != nil {
+		return nil, err
+	}
+	if err := next.Save(me.configFile); err != nil {
+		return nil, fmt.Errorf("configuration applied, but not saved: %s", err.Error())
+	}
+	return diffSettings(&current, &next), nil
+}
+
+// Applies new settings in the main loop: recorder settings and subscription
+// topics at runtime, reconnects to the broker if connection or credential
+// settings changed. Changes of other sections require a restart.
+func (me *App) apply(next AppSettings) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	next.Recorder.Verbose = me.settings.Recorder.Verbose
+	summary := diffSettings(&me.settings, &next)
+	if slices.Contains(summary.Changed, "mqtt") {
+		if err := me.reconnect(&next.MQTT); err != nil {
+			return fmt.Errorf("reconnecting with the new broker settings failed, keeping previous: %s", err.Error())
+		}
+	} else if slices.Contains(summary.Changed, "mqtt.topics") {
+		me.node.Resubscribe(next.MQTT.Topics)
+	}
+	if slices.Contains(summary.Changed, "recorder") {
+		if err := me.recorder.Reconfigure(next.Recorder); err != nil {
+			return err
+		}
+	}
+	if slices.Contains(summary.Changed, "alerts") {
+		me.notifier.Reconfigure(next.Alerts)
+		me.watchdog.Reconfigure(next.Alerts.Stale)
+		me.engine = alert.NewEngine(next.Alerts.Rules, alert.SystemClock{}, me.notifier)
+	}
+	me.settings = next
+	if len(summary.Changed) == 0 {
+		log.Print("Configuration unchanged.")
+	} else {
+		log.Printf("Configuration changed: %v (restart required: %v)", summary.Changed, summary.RestartRequired)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand/v2"
+	"mqttrack/alert"
+	"mqttrack/recorder"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------
+
+// App with a recorder in a temporary directory and the config file saved
+// there. Config changes are applied like in the main loop until cleanup,
+// changes to the log file `reject` fail.
+func mktestapp(t *testing.T) (*App, func()) {
+	root := path.Join(os.TempDir(), fmt.Sprintf("_app_test-%d.tmp", rand.Int64()))
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal("Failed to create test output directory:", root)
+	}
+	settings := AppSettings{}
+	settings.MQTT.BrokerIP = "127.0.0.1"
+	settings.Recorder.RootDirectory = root
+	settings.SetMissingFieldDefaults()
+	rec := recorder.New(settings.Recorder)
+	if err := rec.Open(); err != nil {
+		t.Fatal(err)
+	}
+	notifier := alert.NewNotifier(settings.Alerts)
+	app := &App{
+		configFile: path.Join(root, "mqttrack.json"),
+		settings:   settings,
+		recorder:   &rec,
+		notifier:   notifier,
+		watchdog:   alert.NewWatchdog(settings.Alerts.Stale),
+		engine:     alert.NewEngine(settings.Alerts.Rules, alert.SystemClock{}, notifier),
+		reconfig:   make(chan configChange),
+	}
+	if err := settings.Save(app.configFile); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case change := <-app.reconfig:
+				if change.settings.LogFile == "reject" {
+					change.result <- errors.New("rejected")
+				} else {
+					change.result <- app.apply(change.settings)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return app, func() {
+		close(done)
+		rec.Close()
+		os.RemoveAll(root)
+	}
+}
+
+//------------------------------------------------------------------------
+
+func TestDiffSettings(t *testing.T) {
+	prev := AppSettings{}
+	prev.SetMissingFieldDefaults()
+	next := prev
+	if d := diffSettings(&prev, &next); len(d.Changed) != 0 || len(d.RestartRequired) != 0 {
+		t.Errorf("Expected no changes, got %+v", d)
+	}
+	next.Recorder.Verbose = true
+	if d := diffSettings(&prev, &next); len(d.Changed) != 0 {
+		t.Errorf("Expected verbose flag ignored, got %+v", d)
+	}
+	next.MQTT.Topics = []string{"home/#"}
+	next.Recorder.TopicFilters = []string{"home/**"}
+	next.HTTP.Listen = "127.0.0.1:8080"
+	if d := diffSettings(&prev, &next); fmt.Sprint(d.Changed) != "[mqtt.topics recorder http]" || fmt.Sprint(d.RestartRequired) != "[http]" {
+		t.Errorf("Unexpected changes: %+v", d)
+	}
+	next = prev
+	next.MQTT.BrokerIP = "broker"
+	next.LogFile = "stderr"
+	if d := diffSettings(&prev, &next); fmt.Sprint(d.Changed) != "[mqtt logfile]" || fmt.Sprint(d.RestartRequired) != "[logfile]" {
+		t.Errorf("Unexpected changes: %+v", d)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	target := map[string]any{"a": "b", "c": map[string]any{"d": "e", "f": "g"}, "l": []any{1.0}}
+	patch := map[string]any{"a": "z", "c": map[string]any{"f": nil, "h": "i"}, "l": []any{2.0}, "n": map[string]any{"x": nil}}
+	expected := map[string]any{"a": "z", "c": map[string]any{"d": "e", "h": "i"}, "l": []any{2.0}, "n": map[string]any{}}
+	if actual := mergePatch(target, patch); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected merge result: %v", actual)
+	}
+	if actual := mergePatch(target, "x"); actual != "x" {
+		t.Errorf("Expected non-object patch to replace the target, got %v", actual)
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	app, cleaner := mktestapp(t)
+	defer cleaner()
+	saved := func() AppSettings {
+		var s AppSettings
+		if err := s.Load(app.configFile); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	app.settings.Recorder.Verbose = true // Command line option, not in the file
+
+	// Patch applied and saved, unknown fields and invalid values rejected.
+	summary, err := app.UpdateConfig([]byte(`{"recorder":{"filters":["home/**"]}}`), true)
+	if err != nil {
+		t.Fatalf("Unexpected update error: %v", err)
+	} else if s := summary.(ConfigSummary); fmt.Sprint(s.Changed) != "[recorder]" {
+		t.Errorf("Unexpected change summary: %+v", s)
+	} else if fmt.Sprint(saved().Recorder.TopicFilters) != "[home/**]" || fmt.Sprint(app.settings.Recorder.TopicFilters) != "[home/**]" {
+		t.Errorf("Expected filters applied and saved")
+	}
+	for _, patch := range []string{`{"recorder":{"no_such_field":1}}`, `{"mqtt":{"protocol":"ws"}}`, `{"recorder":{"timestamp_format":"x"}}`, `{`} {
+		if _, err := app.UpdateConfig([]byte(patch), true); err == nil {
+			t.Errorf("Expected update error for '%s'", patch)
+		}
+	}
+
+	// Secrets sent back redacted are kept.
+	app.settings.MQTT.AuthPassword = "secret"
+	config := app.Config().(AppSettings)
+	if config.MQTT.AuthPassword != REDACTED {
+		t.Errorf("Expected redacted password in the config response")
+	}
+	config.LogFile = "stderr"
+	text, _ := json.Marshal(config)
+	if summary, err := app.UpdateConfig(text, false); err != nil {
+		t.Errorf("Unexpected update error: %v", err)
+	} else if s := summary.(ConfigSummary); fmt.Sprint(s.Changed) != "[logfile]" {
+		t.Errorf("Unexpected change summary: %+v", s)
+	} else if app.settings.MQTT.AuthPassword != "secret" || saved().MQTT.AuthPassword != "secret" {
+		t.Errorf("Expected redacted password restored")
+	}
+
+	// Command actions only in the config file.
+	for _, patch := range []string{
+		`{"alerts":{"rules":[{"pattern":"a","above":1,"actions":["command"],"command":["/bin/sh","-c","x"]}]}}`,
+		`{"alerts":{"rules":[{"pattern":"a","above":1,"actions":["log","command"],"command":["/bin/true"]}]}}`,
+	} {
+		if _, err := app.UpdateConfig([]byte(patch), true); err == nil || !strings.Contains(err.Error(), "command") {
+			t.Errorf("Expected command action rejected for '%s', got %v", patch, err)
+		}
+	}
+	above := 1.0
+	app.settings.Alerts.Rules = []alert.Rule{{Pattern: "a", Above: &above, Actions: []string{alert.ActionCommand}, Command: []string{"/bin/true"}}}
+	if _, err := app.UpdateConfig([]byte(`{"alerts":{"topic":"x/alerts"}}`), true); err != nil {
+		t.Errorf("Unexpected update error with unchanged command rules: %v", err)
+	}
+	if _, err := app.UpdateConfig([]byte(`{"alerts":{"rules":[]}}`), true); err == nil {
+		t.Errorf("Expected removal of a command rule rejected")
+	}
+
+	// Changes that were not applied are not saved.
+	if _, err := app.UpdateConfig([]byte(`{"mqtt":{"port":1}}`), true); err == nil || !strings.Contains(err.Error(), "reconnecting") {
+		t.Errorf("Expected reconnect error, got %v", err)
+	} else if saved().MQTT.Port == 1 || app.settings.MQTT.Port == 1 {
+		t.Errorf("Failed broker settings were saved or applied")
+	}
+	if _, err := app.UpdateConfig([]byte(`{"logfile":"reject"}`), true); err == nil {
+		t.Errorf("Expected apply error")
+	} else if saved().LogFile == "reject" || app.settings.LogFile == "reject" {
+		t.Errorf("Rejected config was saved or applied")
+	}
+}
+
+func TestReload(t *testing.T) {
+	app, cleaner := mktestapp(t)
+	defer cleaner()
+	settings := func() AppSettings {
+		app.mu.Lock()
+		defer app.mu.Unlock()
+		return app.settings
+	}
+
+	// Reload (SIGHUP) concurrently with a config API update.
+	next := app.settings
+	next.Recorder.TopicFilters = []string{"plug?/power"}
+	next.Save(app.configFile)
+	done := make(chan error, 2)
+	go func() { app.reload(); done <- nil }()
+	go func() {
+		_, err := app.UpdateConfig([]byte(`{"alerts":{"topic":"x/alerts"}}`), true)
+		done <- err
+	}()
+	for range 2 {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Unexpected update error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Config reload and update blocked")
+		}
+	}
+	saved := AppSettings{}
+	if err := saved.Load(app.configFile); err != nil {
+		t.Fatal(err)
+	} else if s := settings(); !reflect.DeepEqual(saved, s) || s.Alerts.Topic != "x/alerts" {
+		t.Errorf("Running config does not match the config file: %+v", s)
+	}
+
+	// Invalid config files are rejected.
+	for _, text := range []string{`{"mqtt":{"broker_ip":""}}`, `{"recorder":{"rootdir":"/no/such/dir"}}`, `{`} {
+		os.WriteFile(app.configFile, []byte(text), 0644)
+		prev := settings()
+		app.reload()
+		if !reflect.DeepEqual(prev, settings()) {
+			t.Errorf("Config file '%s' was applied", text)
+		}
+	}
+}
+
+// Self-signed certificate and key PEM files in the directory.
+func mktestcert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	return certFile, keyFile
+}
+
+func TestValidate(t *testing.T) {
+	app, cleaner := mktestapp(t)
+	defer cleaner()
+	dir := app.settings.Recorder.RootDirectory
+	certFile, keyFile := mktestcert(t, dir)
+	invalid := path.Join(dir, "invalid.pem")
+	os.WriteFile(invalid, []byte("invalid"), 0644)
+
+	for _, test := range []struct {
+		protocol, ca, cert, key string
+		valid                   bool
+	}{
+		{"mqtts", "", "", "", true},
+		{"mqtts", certFile, certFile, keyFile, true},
+		{"mqtt", invalid, invalid, "", true}, // Not used without TLS
+		{"mqtts", path.Join(dir, "missing.pem"), "", "", false},
+		{"mqtts", invalid, "", "", false},
+		{"mqtts", "", certFile, "", false},
+		{"mqtts", "", certFile, invalid, false},
+		{"mqtts", "", keyFile, certFile, false},
+		{"ws", "", "", "", false},
+	} {
+		settings := app.settings
+		settings.MQTT.Protocol, settings.MQTT.CAFile, settings.MQTT.ClientCertFile, settings.MQTT.ClientKeyFile = test.protocol, test.ca, test.cert, test.key
+		if err := settings.Validate(); (err == nil) != test.valid {
+			t.Errorf("Settings %+v: got %v, expected valid=%v", test, err, test.valid)
+		}
+	}
+
+	// Rejected by the config API before reconnecting.
+	if _, err := app.UpdateConfig([]byte(`{"mqtt":{"protocol":"mqtts","ca_cert_file":"`+invalid+`"}}`), true); err == nil || !strings.Contains(err.Error(), "CA file") {
+		t.Errorf("Expected invalid CA file rejected, got %v", err)
+	}
+}
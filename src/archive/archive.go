@@ -0,0 +1,376 @@
+// Reading of recorded topic files, including rotated and gzipped archives.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"fmt"
+	"io"
+	"io/fs"
+	"mqttrack/codec"
+	"mqttrack/timefmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Entry struct {
+	Time  time.Time
+	Topic string
+	Value []byte
+	Raw   []byte // Original payload of transformed values, nil if not recorded
+}
+
+var rotatedRe = regexp.MustCompile(`^(.+)\.(\d+)(\.gz)?$`)
+var rollupRe = regexp.MustCompile(`@[0-9]+[smhdw]$`)
+
+// Returns if a topic (file path) is a rollup file (`<topic>@<interval>`).
+func IsRollup(topic string) bool {
+	return rollupRe.MatchString(topic)
+}
+
+// Returns if the file is a multi-column group file (CSV with `time` header).
+func isGroupFile(filePath string) bool {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 5)
+	n, _ := io.ReadFull(f, head)
+	return string(head[:n]) == "time,"
+}
+
+// Returns the base name and rotation index if the file name is a rotated
+// record file name (`<name>.<index>` or `<name>.<index>.gz`).
+func RotatedName(name string) (string, int, bool) {
+	m := rotatedRe.FindStringSubmatch(name)
+	if m == nil {
+		return "", 0, false
+	}
+	idx, err := strconv.Atoi(m[2])
+	return m[1], idx, err == nil
+}
+
+// Lists the topics (relative record file paths) under the root directory.
+// Rotated files are listed by their topic, also if the live file is missing,
+// hidden files (e.g. index sidecars), rollup and group files are not listed.
+func Topics(root string) ([]string, error) {
+	return list(root, false)
+}
+
+// Lists the rollup files under the root directory, like Topics.
+func Rollups(root string) ([]string, error) {
+	return list(root, true)
+}
+
+func list(root string, rollups bool) ([]string, error) {
+	topics := []string{}
+	listed := map[string]bool{}
+	err := filepath.WalkDir(root, func(fpath string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if fpath == root {
+			return nil
+		} else if strings.HasPrefix(de.Name(), ".") {
+			if de.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if !de.Type().IsRegular() {
+			return nil
+		}
+		rotated := false
+		if base, _, ok := RotatedName(de.Name()); ok {
+			fpath, rotated = path.Join(path.Dir(fpath), base), true
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
+		topic := filepath.ToSlash(rel)
+		if !listed[topic] && IsRollup(topic) == rollups && (rotated || rollups || !isGroupFile(fpath)) {
+			listed[topic] = true
+			topics = append(topics, topic)
+		}
+		return nil
+	})
+	return topics, err
+}
+
+type File struct {
+	Path    string
+	Index   int   // Rotation index, 0 for the live file
+	Offset  int64 // Start reading at this offset (from the index)
+	Ordered bool  // Lines known to be in chronological order (from the index)
+}
+
+// Returns the record files of a topic in chronological order: the rotated
+// files by ascending index (plain or gzipped), then the live file.
+func Files(root string, topic string) ([]File, error) {
+	live := path.Join(root, topic)
+	ls, err := os.ReadDir(path.Dir(live))
+	if err != nil {
+		return nil, err
+	}
+	files := []File{}
+	for _, de := range ls {
+		if !de.Type().IsRegular() {
+			continue
+		}
+		if base, idx, ok := RotatedName(de.Name()); ok && base == path.Base(live) && idx > 0 {
+			files = append(files, File{Path: path.Join(path.Dir(live), de.Name()), Index: idx})
+		}
+	}
+	slices.SortStableFunc(files, func(a, b File) int { return a.Index - b.Index })
+	if st, err := os.Stat(live); err == nil && st.Mode().IsRegular() {
+		files = append(files, File{Path: live, Index: 0})
+	}
+	return files, nil
+}
+
+//------------------------------------------------------------------------
+
+// Sequential reader of the entries of one topic within a time range. The
+// entries are returned in the order of the files, hence out-of-order lines
+// (older than a previous line) are returned where they were recorded.
+type Reader struct {
+	root    string
+	topic   string
+	from    time.Time
+	to      time.Time
+	files   []File
+	current io.Closer
+	ordered bool
+	lines   *bufio.Reader
+	Skipped uint // Lines that could not be decoded
+}
+
+// Opens the entries of the topic in the range from <= t < to, zero times
+// are unbounded. If the topic has an index, only the files overlapping the
+// range are read, and reading ordered live files starts at the closest
+// offset. Files are read to the end unless known to be ordered.
+func Open(root string, topic string, from time.Time, to time.Time) (*Reader, error) {
+	files, err := Files(root, topic)
+	if err != nil {
+		return nil, err
+	}
+	if idx := readIndex(path.Join(root, topic)); idx != nil && !(from.IsZero() && to.IsZero()) {
+		files = slices.DeleteFunc(files, func(f File) bool {
+			if f.Index == 0 {
+				return idx.Live.Lines > 0 && !to.IsZero() && idx.Live.First >= to.UnixMilli()
+			} else if r := idx.rotated(f.Index); r != nil {
+				return !overlaps(r.IndexRange, from, to)
+			}
+			return false
+		})
+		for i := range files {
+			if files[i].Index == 0 {
+				files[i].Ordered = idx.Live.Ordered
+			} else if r := idx.rotated(files[i].Index); r != nil {
+				files[i].Ordered = r.Ordered
+			}
+		}
+		if n := len(files); n > 0 && files[n-1].Index == 0 && !from.IsZero() {
+			if st, err := os.Stat(files[n-1].Path); err == nil && st.Size() >= idx.Live.Size {
+				files[n-1].Offset = idx.Live.seek(from)
+			}
+		}
+	}
+	return &Reader{root: root, topic: topic, from: from, to: to, files: files}, nil
+}
+
+func (me *Reader) Topic() string {
+	return me.topic
+}
+
+func (me *Reader) Close() {
+	if me.current != nil {
+		me.current.Close()
+		me.current = nil
+	}
+	me.lines = nil
+	me.files = nil
+}
+
+func (me *Reader) openNext() error {
+	if me.current != nil {
+		me.current.Close()
+		me.current = nil
+		me.lines = nil
+	}
+	if len(me.files) == 0 {
+		return io.EOF
+	}
+	file := me.files[0]
+	me.files = me.files[1:]
+	me.ordered = file.Ordered
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return err
+	}
+	if file.Offset > 0 {
+		if _, err := f.Seek(file.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if !strings.HasSuffix(file.Path, ".gz") {
+		me.current = f
+		me.lines = bufio.NewReaderSize(f, 64*1024)
+		return nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("corrupt gzip file '%s': %s", file.Path, err.Error())
+	}
+	me.current = multiCloser{gz, f}
+	me.lines = bufio.NewReaderSize(gz, 64*1024)
+	return nil
+}
+
+// Returns the next entry, io.EOF at the end of the range.
+func (me *Reader) Next() (Entry, error) {
+	for {
+		if me.lines == nil {
+			if err := me.openNext(); err != nil {
+				return Entry{}, err
+			}
+		}
+		line, err := me.lines.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			if e, ok := me.decode(line); !ok {
+				continue
+			} else if !me.to.IsZero() && !e.Time.Before(me.to) {
+				if me.ordered {
+					me.lines = nil // Rest of the file out of range
+				}
+				continue
+			} else if !me.from.IsZero() && e.Time.Before(me.from) {
+				continue
+			} else {
+				return e, nil
+			}
+		}
+		if len(line) > 0 {
+			me.Skipped++ // Truncated last line
+		}
+		if err == io.EOF {
+			me.lines = nil
+		} else if err != nil {
+			me.Close()
+			return Entry{}, err
+		}
+	}
+}
+
+func (me *Reader) decode(line []byte) (Entry, bool) {
+	rec, err := codec.Decode(line)
+	if err != nil {
+		me.Skipped++
+		return Entry{}, false
+	}
+	t, err := timefmt.Parse(rec.Time, timefmt.Auto)
+	if err != nil {
+		me.Skipped++
+		return Entry{}, false
+	}
+	return Entry{Time: t, Topic: me.topic, Value: bytes.Clone(rec.Value), Raw: bytes.Clone(rec.Raw)}, true
+}
+
+type multiCloser []io.Closer
+
+func (me multiCloser) Close() error {
+	var err error
+	for _, c := range me {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+//------------------------------------------------------------------------
+
+// Merges the entries of several readers in chronological order.
+type Merger struct {
+	queue mergeQueue
+	err   error
+}
+
+type mergeItem struct {
+	entry  Entry
+	reader *Reader
+	order  int
+}
+
+type mergeQueue []mergeItem
+
+func (me mergeQueue) Len() int { return len(me) }
+func (me mergeQueue) Less(i, j int) bool {
+	if me[i].entry.Time.Equal(me[j].entry.Time) {
+		return me[i].order < me[j].order
+	}
+	return me[i].entry.Time.Before(me[j].entry.Time)
+}
+func (me mergeQueue) Swap(i, j int) { me[i], me[j] = me[j], me[i] }
+func (me *mergeQueue) Push(x any)   { *me = append(*me, x.(mergeItem)) }
+func (me *mergeQueue) Pop() any {
+	old := *me
+	item := old[len(old)-1]
+	*me = old[:len(old)-1]
+	return item
+}
+
+func NewMerger(readers []*Reader) *Merger {
+	me := &Merger{queue: make(mergeQueue, 0, len(readers))}
+	for i, rd := range readers {
+		me.advance(mergeItem{reader: rd, order: i})
+	}
+	return me
+}
+
+func (me *Merger) advance(item mergeItem) {
+	e, err := item.reader.Next()
+	if err != nil {
+		if err != io.EOF && me.err == nil {
+			me.err = fmt.Errorf("reading '%s' failed: %s", item.reader.Topic(), err.Error())
+		}
+		item.reader.Close()
+		return
+	}
+	item.entry = e
+	heap.Push(&me.queue, item)
+}
+
+// Returns the next entry of all readers, io.EOF if all are exhausted. Read
+// errors of single topics do not abort the merge, the first one is returned
+// by Err().
+func (me *Merger) Next() (Entry, error) {
+	if len(me.queue) == 0 {
+		return Entry{}, io.EOF
+	}
+	item := heap.Pop(&me.queue).(mergeItem)
+	e := item.entry
+	me.advance(item)
+	return e, nil
+}
+
+func (me *Merger) Err() error {
+	return me.err
+}
+
+func (me *Merger) Close() {
+	for _, item := range me.queue {
+		item.reader.Close()
+	}
+	me.queue = nil
+}
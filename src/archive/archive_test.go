@@ -0,0 +1,206 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------
+
+func mktestroot() (string, func()) {
+	root := path.Join(os.TempDir(), fmt.Sprintf("_archive_test-%d.tmp", rand.Int64()))
+	if err := os.Mkdir(root, 0755); err != nil {
+		panic("Failed to create test output directory (unexpectedly):" + root)
+	}
+	return root, func() {
+		os.RemoveAll(root)
+	}
+}
+
+func mkfile(root string, name string, text string) {
+	fpath := path.Join(root, name)
+	os.MkdirAll(path.Dir(fpath), 0755)
+	if path.Ext(name) != ".gz" {
+		os.WriteFile(fpath, []byte(text), 0644)
+		return
+	}
+	f, _ := os.Create(fpath)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	gz.Write([]byte(text))
+}
+
+func readall(t *testing.T, next func() (Entry, error)) []string {
+	out := []string{}
+	for e, err := next(); err != io.EOF; e, err = next() {
+		if err != nil {
+			t.Fatalf("Unexpected read error: %s", err.Error())
+		}
+		out = append(out, fmt.Sprintf("%d:%s=%s", e.Time.Unix(), e.Topic, e.Value))
+	}
+	return out
+}
+
+//------------------------------------------------------------------------
+
+func TestReadMerged(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	mkfile(root, "plug1/power.1.gz", "100.00,1\n101.00,2\n")
+	mkfile(root, "plug1/power.2", "102.00,3\n103.00,4\n")
+	mkfile(root, "plug1/power", "104.00,5\n")
+	mkfile(root, "plug2/power", "{\"t\":101.5,\"v\":7}\ninvalid\n103.5,hex:4142\npartial")
+	mkfile(root, "plug2/.power.idx", "{}")
+	mkfile(root, "plug3/power.1.gz", "100.00,1\n")
+	mkfile(root, "plug3/power.2", "101.00,2\n")
+	mkfile(root, "plug1/power@1h", "0.00,5,1,5,3,5\n")
+	mkfile(root, "plugs.csv", "time,plug1,plug2\n100.00,1,\n")
+
+	topics, err := Topics(root)
+	if err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(topics) != "[plug1/power plug2/power plug3/power]" {
+		t.Errorf("Unexpected topics: %v", topics)
+	}
+	if rollups, _ := Rollups(root); fmt.Sprint(rollups) != "[plug1/power@1h]" {
+		t.Errorf("Unexpected rollups: %v", rollups)
+	}
+	for pattern, expected := range map[string]string{"*": "[plug1/power plug2/power plug3/power]", "plug1/*": "[plug1/power]", "plug?/power@*": "[plug1/power@1h]"} {
+		readers, err := OpenMatching(root, []string{pattern}, time.Time{}, time.Time{})
+		matched := []string{}
+		for _, rd := range readers {
+			matched = append(matched, rd.Topic())
+			rd.Close()
+		}
+		if err != nil || fmt.Sprint(matched) != expected {
+			t.Errorf("Unexpected matching topics of '%s': %v (%v), expected %s", pattern, matched, err, expected)
+		}
+	}
+
+	rd, _ := Open(root, "plug1/power", time.Time{}, time.Time{})
+	if out := fmt.Sprint(readall(t, rd.Next)); out != "[100:plug1/power=1 101:plug1/power=2 102:plug1/power=3 103:plug1/power=4 104:plug1/power=5]" {
+		t.Errorf("Unexpected topic entries: %s", out)
+	}
+
+	rd1, _ := Open(root, "plug1/power", time.Unix(101, 0), time.Unix(104, 0))
+	rd2, _ := Open(root, "plug2/power", time.Unix(101, 0), time.Unix(104, 0))
+	merger := NewMerger([]*Reader{rd1, rd2})
+	if out := fmt.Sprint(readall(t, merger.Next)); out != "[101:plug1/power=2 101:plug2/power=7 102:plug1/power=3 103:plug1/power=4 103:plug2/power=AB]" {
+		t.Errorf("Unexpected merged entries: %s", out)
+	} else if rd2.Skipped != 2 {
+		t.Errorf("Expected invalid and truncated line skipped, got %d", rd2.Skipped)
+	}
+}
+
+func TestReadUnordered(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	// Late line 102 after 105, the range must not end at the first line >= to.
+	mkfile(root, "dev/temp.1", "90,0\n95,1\n")
+	mkfile(root, "dev/temp", "100,1\n105,2\n102,3\n103,4\n")
+	rd, _ := Open(root, "dev/temp", time.Unix(100, 0), time.Unix(104, 0))
+	if out := fmt.Sprint(readall(t, rd.Next)); out != "[100:dev/temp=1 102:dev/temp=3 103:dev/temp=4]" {
+		t.Errorf("Unexpected unordered entries: %s", out)
+	}
+
+	// Index of the same files, the live file is marked as not ordered.
+	live, err := ScanFile(path.Join(root, "dev/temp"), true)
+	if err != nil || live.Ordered || live.First != 100000 || live.Last != 105000 {
+		t.Fatalf("Unexpected live index: %+v (%v)", live.IndexRange, err)
+	}
+	rotated, _ := ScanFile(path.Join(root, "dev/temp.1"), false)
+	if !rotated.Ordered {
+		t.Errorf("Expected ordered rotated index: %+v", rotated.IndexRange)
+	}
+	idx := &Index{Rotated: []RotatedIndex{{Index: 1, IndexRange: rotated.IndexRange}}, Live: live}
+	idx.Live.Offsets = []IndexOffset{{Time: 100000, Offset: 0}, {Time: 102000, Offset: 12}} // Seek would skip 105
+	idx.Save(path.Join(root, "dev/temp"))
+	rd, _ = Open(root, "dev/temp", time.Unix(104, 0), time.Time{})
+	if out := fmt.Sprint(readall(t, rd.Next)); out != "[105:dev/temp=2]" {
+		t.Errorf("Unexpected indexed unordered entries: %s", out)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	mkfile(root, "good/t.1.gz", "100.00,1\n")
+	mkfile(root, "good/t.2", "101.00,2\n")
+	mkfile(root, "good/t", "102.00,3\n")
+	mkfile(root, "good/.t.idx", "{}")
+	mkfile(root, "plugs/p1.csv", "time,power\n100.00,1\n")
+	mkfile(root, "trunc/t", "100.00,1\n101.00,2\n101.5")
+	mkfile(root, "order/t", "100.00,1\n99.00,2\n")
+	mkfile(root, "invalid/t", "garbage\n100.00,1\n")
+	mkfile(root, "bad/t.1.gz", "")
+	os.WriteFile(path.Join(root, "bad/t.1.gz"), []byte("not gzipped"), 0644)
+	mkfile(root, "bad/t", "200.00,1\n")
+	mkfile(root, "gap/t.2", "100.00,1\n")
+	mkfile(root, "gap/t.4.gz", "101.00,2\n")
+	mkfile(root, "gap/t", "102.00,3\n")
+	mkfile(root, "gap/.t.idx", "{}")
+	mkfile(root, "stray/.x.idx", "{}")
+	mkfile(root, "stray/.y.tmp", "")
+	mkfile(root, "stray/.compact-z.tmp/z", "")
+
+	expected := map[string]string{
+		"trunc/t":              "truncated",
+		"order/t":              "order",
+		"invalid/t":            "invalid",
+		"bad/t.1.gz":           "gzip",
+		"gap/t":                "gap",
+		"stray/.x.idx":         "stray",
+		"stray/.y.tmp":         "stray",
+		"stray/.compact-z.tmp": "stray",
+	}
+	check := func(report VerifyReport, repaired bool) {
+		issues := map[string]string{}
+		for _, issue := range report.Issues {
+			issues[issue.Path] = issue.Kind
+			if repaired != (issue.Repaired != "") && issue.Kind != IssueOrder && issue.Kind != IssueInvalid {
+				t.Errorf("Unexpected repair state: %s", issue)
+			}
+		}
+		if fmt.Sprint(issues) != fmt.Sprint(expected) {
+			t.Errorf("Unexpected issues: %v", report.Issues)
+		}
+	}
+
+	report, err := Verify(root, false)
+	if err != nil {
+		t.Fatalf("Unexpected verify error: %v", err)
+	} else if report.Files != 12 || report.Unrepaired() != len(expected) {
+		t.Errorf("Unexpected report: %d files, %d unrepaired", report.Files, report.Unrepaired())
+	}
+	check(report, false)
+
+	report, _ = Verify(root, true)
+	check(report, true)
+	if text, _ := os.ReadFile(path.Join(root, "trunc/t")); string(text) != "100.00,1\n101.00,2\n" {
+		t.Errorf("Unexpected truncated file: %q", text)
+	}
+	for _, file := range []string{".quarantine/bad/t.1.gz", ".quarantine/stray/.x.idx", ".quarantine/stray/.compact-z.tmp/z", "gap/t.1", "gap/t.2.gz", "gap/t"} {
+		if _, err := os.Stat(path.Join(root, file)); err != nil {
+			t.Errorf("Expected file '%s' after repair", file)
+		}
+	}
+	if rd, err := Open(root, "gap/t", time.Time{}, time.Time{}); err != nil {
+		t.Errorf("Unexpected open error: %v", err)
+	} else if out := readall(t, rd.Next); fmt.Sprint(out) != "[100:gap/t=1 101:gap/t=2 102:gap/t=3]" {
+		t.Errorf("Unexpected renumbered entries: %v", out)
+	}
+
+	expected = map[string]string{"order/t": "order", "invalid/t": "invalid"}
+	report, _ = Verify(root, true)
+	check(report, false)
+}
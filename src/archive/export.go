@@ -0,0 +1,110 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mqttrack/codec"
+	"mqttrack/fnmatch"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ExportCSV  = "csv"  // `time,topic,value` with header
+	ExportJSON = "json" // Array of `{"t":...,"topic":...,"v":...}`
+)
+
+// Opens the readers for all topics under the root directory matching one of
+// the fnmatch patterns (all topics if no patterns are given). Rollup files
+// are included if a pattern contains an interval suffix (`@`).
+func OpenMatching(root string, patterns []string, from time.Time, to time.Time) ([]*Reader, error) {
+	topics, err := Topics(root)
+	if err != nil {
+		return nil, err
+	}
+	if slices.ContainsFunc(patterns, func(p string) bool { return strings.Contains(p, "@") }) {
+		rollups, err := Rollups(root)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, rollups...)
+	}
+	readers := []*Reader{}
+	for _, topic := range topics {
+		matched := len(patterns) == 0
+		for _, pattern := range patterns {
+			if fnmatch.Match(pattern, topic, fnmatch.FNM_NOESCAPE) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		rd, err := Open(root, topic, from, to)
+		if err != nil {
+			for _, r := range readers {
+				r.Close()
+			}
+			return nil, err
+		}
+		readers = append(readers, rd)
+	}
+	return readers, nil
+}
+
+// Writes all entries returned by `next` (until io.EOF) in the given format,
+// timestamps composed using `timestamp`.
+func Export(w io.Writer, format string, next func() (Entry, error), timestamp func(time.Time) string) error {
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	switch format {
+	case ExportCSV:
+		cw := csv.NewWriter(out)
+		cw.Write([]string{"time", "topic", "value"})
+		for e, err := next(); err != io.EOF; e, err = next() {
+			if err != nil {
+				return err
+			}
+			value := string(e.Value)
+			if !codec.IsTextSafe(e.Value) {
+				value = "b64:" + base64.StdEncoding.EncodeToString(e.Value)
+			}
+			cw.Write([]string{timestamp(e.Time), e.Topic, value})
+		}
+		cw.Flush()
+		return cw.Error()
+	case ExportJSON:
+		var buf bytes.Buffer
+		out.WriteString("[")
+		sep := "\n"
+		for e, err := next(); err != io.EOF; e, err = next() {
+			if err != nil {
+				return err
+			}
+			buf.Reset()
+			buf.WriteString(sep + `{"t":`)
+			buf.Write(codec.JSONTime(timestamp(e.Time)))
+			topic, _ := json.Marshal(e.Topic)
+			buf.WriteString(`,"topic":`)
+			buf.Write(topic)
+			buf.WriteString(`,`)
+			codec.WriteJSONValue(&buf, e.Value)
+			buf.WriteString(`}`)
+			if _, err := out.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			sep = ",\n"
+		}
+		_, err := out.WriteString("\n]\n")
+		return err
+	default:
+		return fmt.Errorf("invalid output format '%s', allowed are '%s', '%s'", format, ExportCSV, ExportJSON)
+	}
+}
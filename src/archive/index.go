@@ -0,0 +1,221 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Distance in bytes between the sparse time offsets of the live file.
+const IndexOffsetInterval int64 = 64 * 1024
+
+// Time range (min/max) of a record file, times in unix milliseconds. Ordered
+// is false if a line is older than a previous one (e.g. appended out-of-order
+// device times), or if unknown (index files of previous versions).
+type IndexRange struct {
+	First   int64 `json:"first"`
+	Last    int64 `json:"last"`
+	Lines   int64 `json:"lines"`
+	Ordered bool  `json:"ordered"`
+}
+
+type IndexOffset struct {
+	Time   int64 `json:"t"` // Time of the line at the offset, unix ms
+	Offset int64 `json:"o"` // Byte offset of the line
+}
+
+type RotatedIndex struct {
+	Index int `json:"index"` // Rotation index, file `<name>.<index>[.gz]`
+	IndexRange
+}
+
+type LiveIndex struct {
+	IndexRange
+	Size    int64         `json:"size"` // File size covered by the index
+	Offsets []IndexOffset `json:"offsets"`
+}
+
+// Sidecar index of a record file (`.<name>.idx` in the same directory).
+type Index struct {
+	Rotated []RotatedIndex `json:"rotated"`
+	Live    LiveIndex      `json:"live"`
+}
+
+func IndexPath(filePath string) string {
+	return path.Join(path.Dir(filePath), "."+path.Base(filePath)+".idx")
+}
+
+// Loads the index of a record file, and rescans the live file if the index
+// does not match its size (e.g. after a crash or written without index).
+// Returns an empty index if no index file exists.
+func LoadIndex(filePath string) (*Index, error) {
+	idx := readIndex(filePath)
+	if idx == nil {
+		idx = &Index{}
+	}
+	size := int64(0)
+	if st, err := os.Stat(filePath); err == nil {
+		size = st.Size()
+	}
+	if size != idx.Live.Size {
+		live, err := ScanFile(filePath, true)
+		if err != nil && !os.IsNotExist(err) {
+			return idx, err
+		}
+		idx.Live = live
+	}
+	return idx, nil
+}
+
+// Reads the index file as is, nil if not existing or invalid.
+func readIndex(filePath string) *Index {
+	idx := &Index{}
+	if text, err := os.ReadFile(IndexPath(filePath)); err != nil {
+		return nil
+	} else if err := json.Unmarshal(text, idx); err != nil {
+		return nil
+	}
+	return idx
+}
+
+// Writes the index atomically.
+func (me *Index) Save(filePath string) error {
+	text, err := json.Marshal(me)
+	if err != nil {
+		return err
+	}
+	ipath := IndexPath(filePath)
+	tmp := ipath + ".tmp"
+	if err := os.WriteFile(tmp, text, 0644); err != nil {
+		return fmt.Errorf("failed to write index '%s': %s", ipath, err.Error())
+	}
+	if err := os.Rename(tmp, ipath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write index '%s': %s", ipath, err.Error())
+	}
+	return nil
+}
+
+// Updates the live file index with a line of `size` bytes written at `offset`.
+// Returns true if a sparse offset was added (the index should be saved).
+func (me *Index) Append(t time.Time, offset int64, size int64) bool {
+	return me.Live.append(t.UnixMilli(), offset, size)
+}
+
+func (me *LiveIndex) append(ms int64, offset int64, size int64) bool {
+	if me.Lines == 0 {
+		me.Ordered = true
+	} else if ms < me.Last {
+		me.Ordered = false
+	}
+	if me.Lines == 0 || ms < me.First {
+		me.First = ms
+	}
+	if me.Lines == 0 || ms > me.Last {
+		me.Last = ms
+	}
+	me.Lines++
+	me.Size = offset + size
+	if len(me.Offsets) == 0 || offset-me.Offsets[len(me.Offsets)-1].Offset >= IndexOffsetInterval {
+		me.Offsets = append(me.Offsets, IndexOffset{Time: ms, Offset: offset})
+		return true
+	}
+	return false
+}
+
+// Moves the live file range to the rotated files after renaming the live
+// file to `<name>.<index>`.
+func (me *Index) Rotate(index int) {
+	if me.Live.Lines > 0 {
+		me.Rotated = slices.DeleteFunc(me.Rotated, func(r RotatedIndex) bool { return r.Index == index })
+		me.Rotated = append(me.Rotated, RotatedIndex{Index: index, IndexRange: me.Live.IndexRange})
+	}
+	me.Live = LiveIndex{}
+}
+
+// Removes the range of a deleted rotated file.
+func (me *Index) Remove(index int) {
+	me.Rotated = slices.DeleteFunc(me.Rotated, func(r RotatedIndex) bool { return r.Index == index })
+}
+
+func (me *Index) rotated(index int) *RotatedIndex {
+	for i := range me.Rotated {
+		if me.Rotated[i].Index == index {
+			return &me.Rotated[i]
+		}
+	}
+	return nil
+}
+
+func overlaps(r IndexRange, from time.Time, to time.Time) bool {
+	if r.Lines == 0 {
+		return false
+	}
+	return (from.IsZero() || r.Last >= from.UnixMilli()) && (to.IsZero() || r.First < to.UnixMilli())
+}
+
+// Offset in the live file to start reading for entries from the given time,
+// 0 if the lines are not ordered.
+func (me *LiveIndex) seek(from time.Time) int64 {
+	offset := int64(0)
+	if !me.Ordered {
+		return offset
+	}
+	for _, o := range me.Offsets {
+		if o.Time > from.UnixMilli() {
+			break
+		}
+		offset = o.Offset
+	}
+	return offset
+}
+
+// Scans a (plain or gzipped) record file and composes its index, with sparse
+// offsets if requested (meaningless for gzipped files).
+func ScanFile(filePath string, offsets bool) (LiveIndex, error) {
+	idx := LiveIndex{}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return idx, err
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if strings.HasSuffix(filePath, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return idx, fmt.Errorf("corrupt gzip file '%s': %s", filePath, err.Error())
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	lines := bufio.NewReaderSize(rd, 64*1024)
+	dec := Reader{}
+	offset := int64(0)
+	for {
+		line, err := lines.ReadBytes('\n')
+		idx.Size += int64(len(line))
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			if e, ok := dec.decode(line); ok {
+				size := idx.Size
+				if idx.append(e.Time.UnixMilli(), offset, int64(len(line))); !offsets {
+					idx.Offsets = nil
+				}
+				idx.Size = size
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return idx, err
+		}
+	}
+	return idx, nil
+}
@@ -0,0 +1,308 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mqttrack/codec"
+	"mqttrack/timefmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory below the root directory where `Verify` moves corrupt and stray files.
+const QuarantineDir = ".quarantine"
+
+const (
+	IssueTruncated = "truncated" // Last line without newline
+	IssueInvalid   = "invalid"   // Lines that cannot be decoded
+	IssueOrder     = "order"     // Timestamps older than the previous line
+	IssueGZip      = "gzip"      // Corrupt compressed archive
+	IssueGap       = "gap"       // Missing or duplicate rotation indices
+	IssueStray     = "stray"     // Leftover temporary files, orphaned indexes
+)
+
+type Issue struct {
+	Path     string // Relative to the root directory
+	Kind     string
+	Message  string
+	Repaired string // Action taken, empty if not repaired
+}
+
+func (me Issue) String() string {
+	if me.Repaired != "" {
+		return fmt.Sprintf("%s: %s: %s (repaired: %s)", me.Path, me.Kind, me.Message, me.Repaired)
+	}
+	return fmt.Sprintf("%s: %s: %s", me.Path, me.Kind, me.Message)
+}
+
+type VerifyReport struct {
+	Files  int // Checked record files
+	Lines  int // Checked lines
+	Issues []Issue
+}
+
+// Number of issues that were not repaired.
+func (me *VerifyReport) Unrepaired() int {
+	n := 0
+	for _, issue := range me.Issues {
+		if issue.Repaired == "" {
+			n++
+		}
+	}
+	return n
+}
+
+type verifier struct {
+	root   string
+	repair bool
+	report VerifyReport
+}
+
+// Checks the record files under the root directory. With `repair`, truncated
+// last lines are removed, rotation indices renumbered, and corrupt archives
+// and stray files moved to the quarantine directory. Invalid lines and
+// timestamp order issues are only reported.
+func Verify(root string, repair bool) (VerifyReport, error) {
+	me := &verifier{root: root, repair: repair}
+	err := filepath.WalkDir(root, func(fpath string, de os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if !de.IsDir() {
+			return nil
+		} else if fpath != root && strings.HasPrefix(de.Name(), ".") {
+			if de.Name() == QuarantineDir && path.Dir(filepath.ToSlash(fpath)) == path.Clean(filepath.ToSlash(root)) {
+				return filepath.SkipDir
+			} else if strings.HasPrefix(de.Name(), ".compact-") {
+				me.stray(fpath, "leftover compaction directory")
+			}
+			return filepath.SkipDir
+		}
+		return me.directory(fpath)
+	})
+	return me.report, err
+}
+
+func (me *verifier) rel(fpath string) string {
+	rel, err := filepath.Rel(me.root, fpath)
+	if err != nil {
+		return fpath
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (me *verifier) issue(fpath string, kind string, message string, repaired string) {
+	me.report.Issues = append(me.report.Issues, Issue{Path: me.rel(fpath), Kind: kind, Message: message, Repaired: repaired})
+}
+
+// Moves a file or directory to the quarantine directory, returns the action
+// description, empty if not moved.
+func (me *verifier) quarantine(fpath string) string {
+	if !me.repair {
+		return ""
+	}
+	dst := path.Join(me.root, QuarantineDir, me.rel(fpath))
+	if _, err := os.Lstat(dst); err == nil {
+		dst += "." + time.Now().Format("20060102-150405")
+	}
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return ""
+	} else if err := os.Rename(fpath, dst); err != nil {
+		return ""
+	}
+	return "moved to " + me.rel(dst)
+}
+
+func (me *verifier) stray(fpath string, message string) {
+	me.issue(fpath, IssueStray, message, me.quarantine(fpath))
+}
+
+// Checks the files of a directory grouped by record file name.
+func (me *verifier) directory(dir string) error {
+	ls, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	records := map[string][]int{} // Name -> rotation indices, 0 for the live file
+	names := []string{}
+	hidden := []string{}
+	for _, de := range ls {
+		name := de.Name()
+		if de.IsDir() {
+			continue
+		} else if strings.HasPrefix(name, ".") {
+			hidden = append(hidden, name)
+			continue
+		} else if !de.Type().IsRegular() {
+			me.stray(path.Join(dir, name), "not a regular file")
+			continue
+		}
+		base, idx, ok := RotatedName(name)
+		if !ok || idx == 0 {
+			base, idx = name, 0
+		}
+		if _, ok := records[base]; !ok {
+			names = append(names, base)
+		}
+		records[base] = append(records[base], idx)
+	}
+	for _, name := range hidden {
+		fpath := path.Join(dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			me.stray(fpath, "leftover temporary file")
+		} else if base, ok := strings.CutSuffix(strings.TrimPrefix(name, "."), ".idx"); ok && records[base] == nil {
+			me.stray(fpath, "index without record file")
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		indices := records[name]
+		slices.Sort(indices)
+		me.topic(path.Join(dir, name), indices)
+	}
+	return nil
+}
+
+// Checks the rotation indices and the files of a record file in chronological order.
+func (me *verifier) topic(filePath string, indices []int) {
+	rotated := slices.DeleteFunc(slices.Clone(indices), func(i int) bool { return i == 0 })
+	if len(rotated) > 0 && (rotated[0] != 1 || rotated[len(rotated)-1] != len(rotated)) {
+		me.renumber(filePath, rotated)
+	}
+	files, err := Files(path.Dir(filePath), path.Base(filePath))
+	if err != nil {
+		return
+	}
+	var last time.Time
+	for _, file := range files {
+		last = me.file(file.Path, last)
+	}
+}
+
+// Renumbers the rotated files to 1..n (keeping the order), unless indices are duplicate.
+func (me *verifier) renumber(filePath string, rotated []int) {
+	message := fmt.Sprintf("rotation indices %s", strings.Trim(fmt.Sprint(rotated), "[]"))
+	if len(slices.Compact(slices.Clone(rotated))) != len(rotated) {
+		me.issue(filePath, IssueGap, message+", duplicates (plain and gzipped)", "")
+		return
+	} else if !me.repair {
+		me.issue(filePath, IssueGap, message, "")
+		return
+	}
+	files, err := Files(path.Dir(filePath), path.Base(filePath))
+	if err != nil {
+		me.issue(filePath, IssueGap, message, "")
+		return
+	}
+	n := 0
+	for _, file := range files {
+		if file.Index == 0 {
+			continue
+		}
+		n++
+		name := filePath + "." + strconv.Itoa(n)
+		if strings.HasSuffix(file.Path, ".gz") {
+			name += ".gz"
+		}
+		if file.Path != name {
+			if err := os.Rename(file.Path, name); err != nil {
+				me.issue(filePath, IssueGap, message, "")
+				return
+			}
+		}
+	}
+	os.Remove(IndexPath(filePath))
+	me.issue(filePath, IssueGap, message, fmt.Sprintf("renumbered 1 to %d, index removed", n))
+}
+
+// Checks the lines of a (possibly gzipped) record file, returns the last timestamp.
+func (me *verifier) file(filePath string, last time.Time) time.Time {
+	me.report.Files++
+	f, err := os.Open(filePath)
+	if err != nil {
+		me.issue(filePath, IssueInvalid, err.Error(), "")
+		return last
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	gzipped := strings.HasSuffix(filePath, ".gz")
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			me.issue(filePath, IssueGZip, err.Error(), me.quarantine(filePath))
+			return last
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	lines := bufio.NewReaderSize(rd, 64*1024)
+	invalid, unordered, firstInvalid, firstUnordered := 0, 0, 0, 0
+	offset := int64(0) // Start of the current line
+	for n := 1; ; n++ {
+		line, err := lines.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			me.report.Lines++
+			offset += int64(len(line))
+			if n == 1 && bytes.HasPrefix(line, []byte("time,")) {
+				continue // Group file header
+			}
+			rec, derr := codec.Decode(line)
+			var t time.Time
+			if derr == nil {
+				t, derr = timefmt.Parse(rec.Time, timefmt.Auto)
+			}
+			if derr != nil {
+				if invalid++; invalid == 1 {
+					firstInvalid = n
+				}
+			} else if t.Before(last) {
+				if unordered++; unordered == 1 {
+					firstUnordered = n
+				}
+			} else {
+				last = t
+			}
+		} else if len(line) > 0 && err == io.EOF {
+			if gzipped {
+				me.issue(filePath, IssueTruncated, "last line without newline", "")
+			} else {
+				me.issue(filePath, IssueTruncated, fmt.Sprintf("last line without newline (%d bytes)", len(line)), me.truncate(filePath, offset))
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if gzipped {
+				f.Close()
+				me.issue(filePath, IssueGZip, err.Error(), me.quarantine(filePath))
+			} else {
+				me.issue(filePath, IssueInvalid, err.Error(), "")
+			}
+			return last
+		}
+	}
+	if invalid > 0 {
+		me.issue(filePath, IssueInvalid, fmt.Sprintf("%d lines cannot be decoded, first in line %d", invalid, firstInvalid), "")
+	}
+	if unordered > 0 {
+		me.issue(filePath, IssueOrder, fmt.Sprintf("%d lines older than the previous line, first in line %d", unordered, firstUnordered), "")
+	}
+	return last
+}
+
+func (me *verifier) truncate(filePath string, size int64) string {
+	if !me.repair {
+		return ""
+	} else if err := os.Truncate(filePath, size); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("truncated to %d bytes", size)
+}
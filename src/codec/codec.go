@@ -0,0 +1,271 @@
+// Record line encodings. Lines are self-describing, so that readers
+// do not need to know the recorder settings to decode them:
+//
+//   - csv:    `<time>,<text>` with newlines escaped as `\n`.
+//   - base64: `<time>,b64:<base64 data>`
+//   - hex:    `<time>,hex:<hex data>`
+//   - jsonl:  `{"t":<time>,"v":<value>}`, where the value is native JSON if
+//     the payload is a JSON object, array, number, boolean or null, and a JSON
+//     string otherwise. Binary payloads are stored as `{"t":<time>,"b64":"..."}`.
+//
+// Transformed values can have the original payload appended, as base64
+// `,raw:b64:<data>` column, or `"raw"` (`"raw_b64"`) member of jsonl lines.
+// Lines of previous versions may contain `,raw:` as payload text, hence the
+// column is only split off if it is valid base64.
+//
+// Payloads that are not text-safe (invalid UTF-8, control characters) are
+// automatically stored base64 encoded, as well as CSV payloads that would
+// be ambiguous because they start with one of the prefixes above or contain
+// `,raw:`.
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	CSV    = "csv"
+	JSONL  = "jsonl"
+	Base64 = "base64"
+	Hex    = "hex"
+)
+
+const DefaultEncoding = CSV
+
+const (
+	base64Prefix = "b64:"
+	hexPrefix    = "hex:"
+	rawSeparator = ",raw:"                     // Payloads containing it are stored base64 encoded
+	rawColumn    = rawSeparator + base64Prefix // Optional raw payload column of transformed values
+)
+
+type Line struct {
+	Time  string // Timestamp text as written (numeric or date/time).
+	Value []byte // Decoded payload.
+	Raw   []byte // Original payload of transformed values, nil if not recorded.
+}
+
+func Valid(encoding string) bool {
+	switch encoding {
+	case "", CSV, JSONL, Base64, Hex:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns true if the data are valid UTF-8 without control characters other
+// than tab and newline.
+func IsTextSafe(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	return !bytes.ContainsFunc(data, func(ch rune) bool {
+		return ch != '\t' && ch != '\n' && unicode.IsControl(ch)
+	})
+}
+
+// Composes a record line including the trailing newline.
+func Encode(encoding string, ts string, data []byte) []byte {
+	switch encoding {
+	case JSONL:
+		return encodeJSONL(ts, data)
+	case Base64:
+		return encodeCSV(ts, base64Prefix, []byte(base64.StdEncoding.EncodeToString(data)))
+	case Hex:
+		return encodeCSV(ts, hexPrefix, []byte(hex.EncodeToString(data)))
+	default:
+		if !IsTextSafe(data) || bytes.HasPrefix(data, []byte(base64Prefix)) || bytes.HasPrefix(data, []byte(hexPrefix)) || bytes.Contains(data, []byte(rawSeparator)) {
+			return encodeCSV(ts, base64Prefix, []byte(base64.StdEncoding.EncodeToString(data)))
+		}
+		return encodeCSV(ts, "", bytes.ReplaceAll(data, []byte("\n"), []byte("\\n")))
+	}
+}
+
+// Composes a record line with the original payload of a transformed value,
+// as additional `,raw:b64:<data>` column, or `"raw"` member of jsonl lines.
+func EncodeRaw(encoding string, ts string, data []byte, raw []byte) []byte {
+	if encoding == JSONL {
+		line := bytes.NewBuffer(encodeJSONL(ts, data))
+		line.Truncate(line.Len() - 2)
+		if utf8.Valid(raw) {
+			v, _ := json.Marshal(string(raw))
+			line.WriteString(`,"raw":`)
+			line.Write(v)
+		} else {
+			line.WriteString(`,"raw_b64":"`)
+			line.WriteString(base64.StdEncoding.EncodeToString(raw))
+			line.WriteString(`"`)
+		}
+		line.WriteString("}\n")
+		return line.Bytes()
+	}
+	line := Encode(encoding, ts, data)
+	line = append(line[:len(line)-1], rawColumn...)
+	line = append(line, base64.StdEncoding.EncodeToString(raw)...)
+	return append(line, '\n')
+}
+
+// Parses a record line (with or without trailing newline) of any encoding.
+func Decode(line []byte) (Line, error) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) > 0 && line[0] == '{' {
+		return decodeJSONL(line)
+	}
+	ts, data, ok := bytes.Cut(line, []byte(","))
+	if !ok || len(ts) == 0 {
+		return Line{}, fmt.Errorf("invalid record line, expected 'timestamp,data': '%s'", line)
+	}
+	var raw []byte
+	if i := bytes.LastIndex(data, []byte(rawColumn)); i >= 0 {
+		if v, err := base64.StdEncoding.DecodeString(string(data[i+len(rawColumn):])); err == nil {
+			data, raw = data[:i], v
+		}
+	}
+	rec, err := decodeCSV(ts, data)
+	rec.Raw = raw
+	return rec, err
+}
+
+func decodeCSV(ts []byte, data []byte) (Line, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte(base64Prefix)):
+		v, err := base64.StdEncoding.DecodeString(string(data[len(base64Prefix):]))
+		if err != nil {
+			return Line{}, fmt.Errorf("invalid base64 record data: %s", err.Error())
+		}
+		return Line{Time: string(ts), Value: v}, nil
+	case bytes.HasPrefix(data, []byte(hexPrefix)):
+		v, err := hex.DecodeString(string(data[len(hexPrefix):]))
+		if err != nil {
+			return Line{}, fmt.Errorf("invalid hex record data: %s", err.Error())
+		}
+		return Line{Time: string(ts), Value: v}, nil
+	default:
+		return Line{Time: string(ts), Value: bytes.ReplaceAll(data, []byte("\\n"), []byte("\n"))}, nil
+	}
+}
+
+//------------------------------------------------------------------------
+
+func encodeCSV(ts string, prefix string, data []byte) []byte {
+	line := make([]byte, 0, len(ts)+len(prefix)+len(data)+2)
+	line = append(line, ts...)
+	line = append(line, ',')
+	line = append(line, prefix...)
+	line = append(line, data...)
+	return append(line, '\n')
+}
+
+// Numeric timestamps are written as JSON numbers, date/time texts as strings.
+func JSONTime(ts string) []byte {
+	if len(ts) > 0 && ts[0] != '"' && json.Valid([]byte(ts)) {
+		return []byte(ts)
+	}
+	t, _ := json.Marshal(ts)
+	return t
+}
+
+// Writes the payload as JSON object member, `"v":<value>` or `"b64":"<data>"`
+// for binary data.
+func WriteJSONValue(out *bytes.Buffer, data []byte) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] != '"' && json.Valid(trimmed) {
+		out.WriteString(`"v":`)
+		json.Compact(out, trimmed) // Valid JSON, no error expected
+	} else if utf8.Valid(data) {
+		v, _ := json.Marshal(string(data))
+		out.WriteString(`"v":`)
+		out.Write(v)
+	} else {
+		out.WriteString(`"b64":"`)
+		out.WriteString(base64.StdEncoding.EncodeToString(data))
+		out.WriteString(`"`)
+	}
+}
+
+func encodeJSONL(ts string, data []byte) []byte {
+	line := bytes.NewBuffer(make([]byte, 0, len(ts)+len(data)+16))
+	line.WriteString(`{"t":`)
+	line.Write(JSONTime(ts))
+	line.WriteString(`,`)
+	WriteJSONValue(line, data)
+	line.WriteString("}\n")
+	return line.Bytes()
+}
+
+func decodeJSONL(line []byte) (Line, error) {
+	var rec struct {
+		T      json.RawMessage `json:"t"`
+		V      json.RawMessage `json:"v"`
+		B64    *string         `json:"b64"`
+		Raw    *string         `json:"raw"`
+		RawB64 *string         `json:"raw_b64"`
+	}
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return Line{}, fmt.Errorf("invalid jsonl record line: %s", err.Error())
+	} else if len(rec.T) == 0 {
+		return Line{}, fmt.Errorf("invalid jsonl record line, missing time: '%s'", line)
+	}
+	out := Line{Time: string(rec.T)}
+	if rec.T[0] == '"' {
+		json.Unmarshal(rec.T, &out.Time)
+	}
+	switch {
+	case rec.B64 != nil:
+		v, err := base64.StdEncoding.DecodeString(*rec.B64)
+		if err != nil {
+			return Line{}, fmt.Errorf("invalid base64 record data: %s", err.Error())
+		}
+		out.Value = v
+	case len(rec.V) > 0 && rec.V[0] == '"':
+		var v string
+		json.Unmarshal(rec.V, &v)
+		out.Value = []byte(v)
+	default:
+		out.Value = []byte(rec.V)
+	}
+	if rec.Raw != nil {
+		out.Raw = []byte(*rec.Raw)
+	} else if rec.RawB64 != nil {
+		v, err := base64.StdEncoding.DecodeString(*rec.RawB64)
+		if err != nil {
+			return Line{}, fmt.Errorf("invalid base64 raw data: %s", err.Error())
+		}
+		out.Raw = v
+	}
+	return out, nil
+}
+
+// Value of a (dot separated) field path in a JSON object payload, numbers as
+// their JSON text.
+func JSONField(payload []byte, field string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", fmt.Errorf("payload is no JSON: %s", err.Error())
+	}
+	for _, key := range strings.Split(field, ".") {
+		if obj, ok := v.(map[string]any); !ok {
+			return "", fmt.Errorf("field '%s' not found", field)
+		} else if v, ok = obj[key]; !ok {
+			return "", fmt.Errorf("field '%s' not found", field)
+		}
+	}
+	switch v := v.(type) {
+	case json.Number:
+		return v.String(), nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("field '%s' is neither number nor string", field)
+	}
+}
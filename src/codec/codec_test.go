@@ -0,0 +1,57 @@
+package codec
+
+import (
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	for _, test := range []struct {
+		encoding string
+		data     string
+		expected string
+	}{
+		{CSV, "21.5", "1.00,21.5\n"},
+		{CSV, "a\nb", "1.00,a\\nb\n"},
+		{CSV, "b64:x", "1.00,b64:YjY0Ong=\n"},
+		{CSV, "a,raw:b", "1.00,b64:YSxyYXc6Yg==\n"},
+		{CSV, "\x00\x01", "1.00,b64:AAE=\n"},
+		{Hex, "AB", "1.00,hex:4142\n"},
+		{JSONL, `{"a": 1}`, "{\"t\":1.00,\"v\":{\"a\":1}}\n"},
+		{JSONL, "on", "{\"t\":1.00,\"v\":\"on\"}\n"},
+	} {
+		line := Encode(test.encoding, "1.00", []byte(test.data))
+		if string(line) != test.expected {
+			t.Errorf("Encode %s '%s': got '%s', expected '%s'", test.encoding, test.data, line, test.expected)
+		}
+		if rec, err := Decode(line); err != nil {
+			t.Errorf("Decode '%s': %v", line, err)
+		} else if rec.Time != "1.00" || (string(rec.Value) != test.data && test.encoding != JSONL) || rec.Raw != nil {
+			t.Errorf("Decode '%s': unexpected %+v", line, rec)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	for _, encoding := range []string{CSV, JSONL} {
+		for _, raw := range []string{"1234 Wh", "a,b\nc", "", "\xff"} {
+			line := EncodeRaw(encoding, "1.00", []byte("1.234"), []byte(raw))
+			if rec, err := Decode(line); err != nil || string(rec.Value) != "1.234" || rec.Raw == nil || string(rec.Raw) != raw {
+				t.Errorf("Raw roundtrip of '%s' (%s): %+v, %v", line, encoding, rec, err)
+			}
+		}
+	}
+	if line := EncodeRaw(CSV, "1.00", []byte("1.234"), []byte("1234 Wh")); string(line) != "1.00,1.234,raw:b64:MTIzNCBXaA==\n" {
+		t.Errorf("Unexpected raw column: '%s'", line)
+	}
+
+	// Lines of previous versions with `,raw:` as payload text are not split.
+	for line, expected := range map[string]string{
+		"1.00,state,raw:idle\n":       "state,raw:idle",
+		"1.00,a,raw:b64:not base64\n": "a,raw:b64:not base64",
+		"1.00,x,raw:1,raw:b64:eQ==\n": "x,raw:1",
+	} {
+		if rec, err := Decode([]byte(line)); err != nil || string(rec.Value) != expected {
+			t.Errorf("Decode '%s': got %+v (%v), expected value '%s'", line, rec, err, expected)
+		}
+	}
+}
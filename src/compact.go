@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mqttrack/archive"
+	"mqttrack/fnmatch"
+	"mqttrack/recorder"
+)
+
+// Rewrites the record files of topics with the current recorder settings.
+func runCompact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	configFile := flags.String("c", DEFAULT_CONFIG_FILE, "Config file path to use.")
+	root := flags.String("root", "", "Data root directory (default from the config file).")
+	dryRun := flags.Bool("dry-run", false, "Only report the changes, do not replace the files.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s compact [options] <topic patterns ...>\n", PROGRAM_NAME)
+		fmt.Fprintf(flags.Output(), "Rewrites the live and rotated files of the topics with the current recorder settings.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no topic patterns specified")
+	}
+
+	settings, err := loadRecorderSettings(*configFile, *root)
+	if err != nil {
+		return err
+	} else if err := settings.Validate(); err != nil {
+		return err
+	}
+	topics, err := archive.Topics(settings.RootDirectory)
+	if err != nil {
+		return err
+	}
+	rec := recorder.New(settings)
+	var errs error
+	for _, topic := range topics {
+		matched := false
+		for _, pattern := range flags.Args() {
+			matched = matched || fnmatch.Match(pattern, topic, fnmatch.FNM_NOESCAPE)
+		}
+		if !matched || recorder.IsRollup(topic) {
+			continue
+		}
+		report, err := rec.Compact(topic, *dryRun)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		fmt.Println(report.String())
+	}
+	if *dryRun {
+		fmt.Println("Dry run, no files changed.")
+	}
+	return errs
+}
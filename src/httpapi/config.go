@@ -0,0 +1,58 @@
+package httpapi
+
+import (
+	"io"
+	"net/http"
+)
+
+const maxConfigSize = 1024 * 1024
+
+// Access to the application configuration.
+type ConfigProvider interface {
+	// Returns the effective configuration, secrets redacted.
+	Config() any
+	// Validates, persists and applies a new configuration (complete JSON
+	// document, or JSON merge patch). Returns a summary of the changes.
+	UpdateConfig(data []byte, patch bool) (any, error)
+}
+
+// Registers the configuration endpoints. They require that credentials are
+// configured, and are not available in read-only mode.
+//
+//   - GET /config: Effective configuration (secrets redacted).
+//   - PUT /config: Replace the configuration.
+//   - PATCH /config: Change parts of the configuration (JSON merge patch, RFC7396).
+func (me *Server) HandleConfig(provider ConfigProvider) {
+	me.mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		if !me.hasCredentials() {
+			http.Error(w, "config API requires authentication settings", http.StatusForbidden)
+			return
+		}
+		writeJSON(w, provider.Config())
+	})
+	update := func(patch bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !me.hasCredentials() {
+				http.Error(w, "config API requires authentication settings", http.StatusForbidden)
+				return
+			}
+			data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			summary, err := provider.UpdateConfig(data, patch)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, summary)
+		}
+	}
+	me.mux.HandleFunc("PUT /config", update(false))
+	me.mux.HandleFunc("PATCH /config", update(true))
+}
+
+func (me *Server) hasCredentials() bool {
+	return me.settings.Token != "" || me.settings.AuthUser != ""
+}
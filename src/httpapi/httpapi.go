@@ -0,0 +1,262 @@
+// Optional embedded HTTP server for reading the recorded data.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mqttrack/archive"
+	"mqttrack/codec"
+	"mqttrack/recorder"
+	"mqttrack/timefmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Settings struct {
+	Listen       string `json:"listen"`        // Address, e.g. ":8080" or "127.0.0.1:8080", empty: disabled
+	AuthUser     string `json:"auth_user"`     // Basic auth, together with `auth_password`
+	AuthPassword string `json:"auth_password"` //
+	Token        string `json:"token"`         // Bearer token
+	ReadOnly     bool   `json:"read_only"`     // Only GET requests
+}
+
+type Server struct {
+	settings Settings
+	recorder *recorder.Recorder
+	mux      *http.ServeMux
+	server   *http.Server
+}
+
+// Without credentials, the API may only listen on a loopback address.
+func (me *Settings) Validate() error {
+	if me.Listen == "" || me.AuthUser != "" || me.Token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(me.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid http listen address '%s': %s", me.Listen, err.Error())
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("http listen address '%s' is not a loopback address, auth_user or token required", me.Listen)
+	}
+	return nil
+}
+
+func New(settings Settings, rec *recorder.Recorder) *Server {
+	me := &Server{
+		settings: settings,
+		recorder: rec,
+		mux:      http.NewServeMux(),
+	}
+	me.mux.HandleFunc("GET /topics", me.handleTopics)
+	me.mux.HandleFunc("GET /latest", me.handleLatest)
+	me.mux.HandleFunc("GET /history", me.handleHistory)
+	me.mux.HandleFunc("GET /filters", me.handleFilters)
+	return me
+}
+
+// Registers an additional handler (before Start).
+func (me *Server) Handle(pattern string, handler http.Handler) {
+	me.mux.Handle(pattern, handler)
+}
+
+func (me *Server) Start() error {
+	if err := me.settings.Validate(); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", me.settings.Listen)
+	if err != nil {
+		return err
+	}
+	me.server = &http.Server{
+		Handler:           me.authorize(me.mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := me.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Print("HTTP server failed: ", err.Error())
+		}
+	}()
+	log.Print("HTTP API listening on ", listener.Addr().String())
+	return nil
+}
+
+func (me *Server) Stop() {
+	if me.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	me.server.Shutdown(ctx)
+	me.server = nil
+}
+
+//------------------------------------------------------------------------
+
+func secureEquals(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (me *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized := me.settings.AuthUser == "" && me.settings.Token == ""
+		if !authorized && me.settings.Token != "" {
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				authorized = secureEquals(token, me.settings.Token)
+			}
+		}
+		if !authorized && me.settings.AuthUser != "" {
+			if user, pass, ok := r.BasicAuth(); ok {
+				authorized = secureEquals(user, me.settings.AuthUser) && secureEquals(pass, me.settings.AuthPassword)
+			}
+		}
+		if !authorized {
+			if me.settings.AuthUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mqttrack"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if me.settings.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "read-only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print("HTTP response failed: ", err.Error())
+	}
+}
+
+// GET /filters: Number of received topics matched per recorder filter pattern.
+func (me *Server) handleFilters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, me.recorder.FilterStats())
+}
+
+// GET /topics: Tree of the recorded topics, leaves are the topic paths.
+func (me *Server) handleTopics(w http.ResponseWriter, r *http.Request) {
+	topics, err := archive.Topics(me.recorder.RootDirectory())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tree := map[string]any{}
+	for _, topic := range topics {
+		node := tree
+		parts := strings.Split(topic, "/")
+		for _, part := range parts[:len(parts)-1] {
+			sub, ok := node[part].(map[string]any)
+			if !ok {
+				sub = map[string]any{}
+				node[part] = sub
+			}
+			node = sub
+		}
+		node[parts[len(parts)-1]] = topic
+	}
+	writeJSON(w, tree)
+}
+
+func (me *Server) latestJSON(topic string, rec recorder.Record) json.RawMessage {
+	var buf bytes.Buffer
+	buf.WriteString(`{"t":`)
+	buf.Write(codec.JSONTime(me.recorder.Timestamp(rec.Time())))
+	tp, _ := json.Marshal(topic)
+	buf.WriteString(`,"topic":`)
+	buf.Write(tp)
+	buf.WriteString(`,`)
+	codec.WriteJSONValue(&buf, rec.Data())
+	buf.WriteString(`}`)
+	return buf.Bytes()
+}
+
+// GET /latest?topic=...: Last received value of a topic (object), or of all
+// topics matching the fnmatch `pattern=...` (array).
+func (me *Server) handleLatest(w http.ResponseWriter, r *http.Request) {
+	if pattern := r.URL.Query().Get("pattern"); pattern != "" {
+		recs := me.recorder.LatestMatching(pattern)
+		topics := make([]string, 0, len(recs))
+		for topic := range recs {
+			topics = append(topics, topic)
+		}
+		slices.Sort(topics)
+		out := make([]json.RawMessage, 0, len(recs))
+		for _, topic := range topics {
+			out = append(out, me.latestJSON(topic, recs[topic]))
+		}
+		writeJSON(w, out)
+		return
+	}
+	topic := strings.Trim(r.URL.Query().Get("topic"), "/.")
+	if topic == "" {
+		http.Error(w, "missing topic or pattern", http.StatusBadRequest)
+		return
+	}
+	rec, ok := me.recorder.Latest(topic)
+	if !ok {
+		http.Error(w, "topic not received yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, me.latestJSON(topic, rec))
+}
+
+// GET /history?topic=...&from=...&to=...&format=csv|json: Recorded values of
+// the topics matching the fnmatch pattern(s) in chronological order, from the
+// live and rotated files.
+func (me *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	patterns := query["topic"]
+	if len(patterns) == 0 {
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+	var from, to time.Time
+	var err error
+	if s := query.Get("from"); s != "" {
+		if from, err = timefmt.Parse(s, timefmt.Auto); err != nil {
+			http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("to"); s != "" {
+		if to, err = timefmt.Parse(s, timefmt.Auto); err != nil {
+			http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	format := query.Get("format")
+	switch format {
+	case "", archive.ExportJSON:
+		format = archive.ExportJSON
+		w.Header().Set("Content-Type", "application/json")
+	case archive.ExportCSV:
+		w.Header().Set("Content-Type", "text/csv")
+	default:
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	readers, err := archive.OpenMatching(me.recorder.RootDirectory(), patterns, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	merger := archive.NewMerger(readers)
+	defer merger.Close()
+	if err := archive.Export(w, format, merger.Next, me.recorder.Timestamp); err != nil {
+		log.Print("HTTP history response failed: ", err.Error())
+	} else if err := merger.Err(); err != nil {
+		log.Print("HTTP history read error: ", err.Error())
+	}
+}
@@ -0,0 +1,165 @@
+package httpapi
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mqttrack/recorder"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mktestrecorder(t *testing.T) (*recorder.Recorder, func()) {
+	root := path.Join(os.TempDir(), fmt.Sprintf("_httpapi_test-%d.tmp", rand.Int64()))
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal("Failed to create test output directory:", root)
+	}
+	rec := recorder.New(recorder.Settings{RootDirectory: root})
+	if err := rec.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return &rec, func() {
+		rec.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func request(t *testing.T, handler http.Handler, method string, url string, auth func(*http.Request), content ...string) (int, string) {
+	req := httptest.NewRequest(method, url, strings.NewReader(strings.Join(content, "")))
+	if auth != nil {
+		auth(req)
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	body, _ := io.ReadAll(rw.Result().Body)
+	return rw.Code, string(body)
+}
+
+func TestAPI(t *testing.T) {
+	rec, cleaner := mktestrecorder(t)
+	defer cleaner()
+
+	t0 := time.Unix(1577840400, 0)
+	rec.Write(recorder.NewRecord(t0, "plug1/power", []byte("10")))
+	rec.Write(recorder.NewRecord(t0.Add(time.Second), "plug1/state", []byte("ON")))
+	rec.Write(recorder.NewRecord(t0.Add(2*time.Second), "plug1/power", []byte("12")))
+
+	server := New(Settings{Token: "secret", AuthUser: "user", AuthPassword: "pass", ReadOnly: true}, rec)
+	handler := server.authorize(server.mux)
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }
+	basic := func(r *http.Request) { r.SetBasicAuth("user", "pass") }
+
+	tests := []struct {
+		method   string
+		url      string
+		auth     func(*http.Request)
+		code     int
+		expected string
+	}{
+		{"GET", "/topics", nil, 401, ""},
+		{"GET", "/topics", func(r *http.Request) { r.SetBasicAuth("user", "wrong") }, 401, ""},
+		{"GET", "/topics", bearer, 200, `{"plug1":{"power":"plug1/power","state":"plug1/state"}}`},
+		{"GET", "/latest?topic=plug1/power", basic, 200, `{"t":1577840402.00,"topic":"plug1/power","v":12}`},
+		{"GET", "/latest?topic=plug1/none", basic, 404, ""},
+		{"GET", "/latest?pattern=plug1/*", basic, 200, `[{"t":1577840402.00,"topic":"plug1/power","v":12},{"t":1577840401.00,"topic":"plug1/state","v":"ON"}]`},
+		{"GET", "/history?topic=plug1/*&from=1577840400.5&format=csv", bearer, 200, "time,topic,value\n1577840401.00,plug1/state,ON\n1577840402.00,plug1/power,12"},
+		{"GET", "/history?topic=plug1/power&to=1577840401", bearer, 200, "[\n{\"t\":1577840400.00,\"topic\":\"plug1/power\",\"v\":10}\n]"},
+		{"GET", "/history", bearer, 400, ""},
+		{"POST", "/topics", bearer, 403, ""},
+	}
+	for _, test := range tests {
+		code, body := request(t, handler, test.method, test.url, test.auth)
+		if code != test.code {
+			t.Errorf("%s %s: status %d, expected %d (%s)", test.method, test.url, code, test.code, body)
+		} else if test.expected != "" && strings.TrimSpace(body) != test.expected {
+			t.Errorf("%s %s: unexpected response '%s', expected '%s'", test.method, test.url, body, test.expected)
+		}
+	}
+}
+
+type testConfig struct {
+	config  map[string]any
+	patched bool
+}
+
+func (me *testConfig) Config() any {
+	return me.config
+}
+
+func (me *testConfig) UpdateConfig(data []byte, patch bool) (any, error) {
+	if string(data) == "invalid" {
+		return nil, fmt.Errorf("invalid config")
+	}
+	me.patched = patch
+	return map[string]any{"changed": []string{"recorder"}}, nil
+}
+
+func TestConfigAPI(t *testing.T) {
+	rec, cleaner := mktestrecorder(t)
+	defer cleaner()
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }
+	provider := &testConfig{config: map[string]any{"logfile": "stdout"}}
+
+	// No credentials configured: config API not available.
+	server := New(Settings{}, rec)
+	server.HandleConfig(provider)
+	if code, _ := request(t, server.authorize(server.mux), "GET", "/config", nil); code != 403 {
+		t.Errorf("Expected config API forbidden without credentials, got %d", code)
+	}
+
+	server = New(Settings{Token: "secret"}, rec)
+	server.HandleConfig(provider)
+	handler := server.authorize(server.mux)
+	if code, body := request(t, handler, "GET", "/config", bearer); code != 200 || strings.TrimSpace(body) != `{"logfile":"stdout"}` {
+		t.Errorf("Unexpected config response: %d '%s'", code, body)
+	}
+	if code, body := request(t, handler, "PATCH", "/config", bearer, `{"recorder":{}}`); code != 200 || !provider.patched || !strings.Contains(body, "recorder") {
+		t.Errorf("Unexpected config patch response: %d '%s'", code, body)
+	}
+	if code, _ := request(t, handler, "PUT", "/config", bearer, `{}`); code != 200 || provider.patched {
+		t.Errorf("Unexpected config put response: %d", code)
+	}
+	if code, _ := request(t, handler, "PUT", "/config", bearer, `invalid`); code != 400 {
+		t.Errorf("Expected bad request for invalid config, got %d", code)
+	}
+
+	// Read-only
+	server = New(Settings{Token: "secret", ReadOnly: true}, rec)
+	server.HandleConfig(provider)
+	if code, _ := request(t, server.authorize(server.mux), "PUT", "/config", bearer, `{}`); code != 403 {
+		t.Errorf("Expected config change forbidden in read-only mode, got %d", code)
+	}
+}
+
+func TestListenWithoutCredentials(t *testing.T) {
+	for listen, valid := range map[string]bool{
+		"":               true,
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"192.0.2.1:8080": false,
+		"example:8080":   false,
+		"8080":           false,
+	} {
+		settings := Settings{Listen: listen}
+		if err := settings.Validate(); (err == nil) != valid {
+			t.Errorf("Listen '%s' without credentials: got %v, expected valid=%v", listen, err, valid)
+		}
+		settings.Token = "secret"
+		if err := settings.Validate(); err != nil {
+			t.Errorf("Listen '%s' with token: unexpected error %v", listen, err)
+		}
+	}
+	server := New(Settings{Listen: ":0"}, nil)
+	if err := server.Start(); err == nil {
+		server.Stop()
+		t.Errorf("Expected start refused without credentials on all interfaces")
+	}
+}
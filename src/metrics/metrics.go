@@ -0,0 +1,227 @@
+// Minimal Prometheus/OpenMetrics text exposition of counters, gauges and
+// histograms, without client library dependency.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Registry used by the New... functions.
+var Default = &Registry{}
+
+func (me *Registry) register(m metric) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.metrics = append(me.metrics, m)
+}
+
+// Writes all metrics in the Prometheus text format.
+func (me *Registry) WriteText(w io.Writer) error {
+	me.mu.Lock()
+	metrics := slices.Clone(me.metrics)
+	me.mu.Unlock()
+	out := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(out)
+	}
+	return out.Flush()
+}
+
+func (me *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		me.WriteText(w)
+	})
+}
+
+func header(w *bufio.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//------------------------------------------------------------------------
+
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+func NewCounter(name string, help string) *Counter {
+	me := &Counter{name: name, help: help}
+	Default.register(me)
+	return me
+}
+
+func (me *Counter) Inc() {
+	me.value.Add(1)
+}
+
+func (me *Counter) Add(n uint64) {
+	me.value.Add(n)
+}
+
+func (me *Counter) Value() uint64 {
+	return me.value.Load()
+}
+
+func (me *Counter) write(w *bufio.Writer) {
+	header(w, me.name, me.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", me.name, me.value.Load())
+}
+
+//------------------------------------------------------------------------
+
+// Counters with one label.
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	me := &CounterVec{name: name, help: help, label: label, values: make(map[string]*atomic.Uint64)}
+	Default.register(me)
+	return me
+}
+
+func (me *CounterVec) Inc(label string) {
+	me.mu.Lock()
+	v, ok := me.values[label]
+	if !ok {
+		v = &atomic.Uint64{}
+		me.values[label] = v
+	}
+	me.mu.Unlock()
+	v.Add(1)
+}
+
+func (me *CounterVec) Value(label string) uint64 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if v, ok := me.values[label]; ok {
+		return v.Load()
+	}
+	return 0
+}
+
+func (me *CounterVec) write(w *bufio.Writer) {
+	header(w, me.name, me.help, "counter")
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	labels := make([]string, 0, len(me.values))
+	for label := range me.values {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", me.name, me.label, labelEscaper.Replace(label), me.values[label].Load())
+	}
+}
+
+//------------------------------------------------------------------------
+
+type Gauge struct {
+	name string
+	help string
+	bits atomic.Uint64
+}
+
+func NewGauge(name string, help string) *Gauge {
+	me := &Gauge{name: name, help: help}
+	Default.register(me)
+	return me
+}
+
+func (me *Gauge) Set(v float64) {
+	me.bits.Store(math.Float64bits(v))
+}
+
+func (me *Gauge) Value() float64 {
+	return math.Float64frombits(me.bits.Load())
+}
+
+func (me *Gauge) write(w *bufio.Writer) {
+	header(w, me.name, me.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", me.name, formatFloat(me.Value()))
+}
+
+//------------------------------------------------------------------------
+
+type Histogram struct {
+	name    string
+	help    string
+	mu      sync.Mutex
+	buckets []float64 // Upper bounds, ascending
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	me := &Histogram{name: name, help: help, buckets: slices.Sorted(slices.Values(buckets)), counts: make([]uint64, len(buckets))}
+	Default.register(me)
+	return me
+}
+
+func (me *Histogram) Observe(v float64) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if i, _ := slices.BinarySearch(me.buckets, v); i < len(me.counts) {
+		me.counts[i]++
+	}
+	me.sum += v
+	me.count++
+}
+
+func (me *Histogram) Count() uint64 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.count
+}
+
+func (me *Histogram) write(w *bufio.Writer) {
+	header(w, me.name, me.help, "histogram")
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	cumulative := uint64(0)
+	for i, le := range me.buckets {
+		cumulative += me.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", me.name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", me.name, me.count)
+	fmt.Fprintf(w, "%s_sum %s\n", me.name, formatFloat(me.sum))
+	fmt.Fprintf(w, "%s_count %d\n", me.name, me.count)
+}
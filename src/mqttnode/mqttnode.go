@@ -5,20 +5,25 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"log"
+	"mqttrack/metrics"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+var metricReceived = metrics.NewCounterVec("mqttrack_messages_received_total", "Messages received per subscription.", "subscription")
+
 type ConnectionEventType int
 
 const (
 	ConnectionEstablished ConnectionEventType = iota
 	ConnectionLost
 	SubscribeFailed
+	ResubscribeFailed
 )
 
 type ConnectionEvent struct {
@@ -61,6 +66,9 @@ type Settings struct {
 
 type Node struct {
 	settings   Settings
+	mu         sync.Mutex // Subscription topics, changed at runtime
+	resub      sync.Mutex // Serializes the runtime subscription changes
+	subscribed []string   // Topics subscribed at runtime or on connect
 	client     mqtt.Client
 	Data       chan DataEvent
 	Connection chan ConnectionEvent
@@ -101,25 +109,9 @@ func (me *Node) getClientOptions(settings *Settings) (*mqtt.ClientOptions, error
 	opts.SetUsername(settings.AuthUser)
 	opts.SetPassword(settings.AuthPassword)
 	if isTls {
-		var rootcas *x509.CertPool = nil
-		if settings.CAFile != "" {
-			if ca, err := os.ReadFile(settings.CAFile); err != nil {
-				log.Fatalln("CA file: ", err.Error())
-			} else {
-				rootcas = x509.NewCertPool()
-				rootcas.AppendCertsFromPEM(ca)
-			}
-		}
-
-		var certs []tls.Certificate = nil
-		if settings.ClientCertFile != "" {
-			if settings.ClientKeyFile == "" {
-				log.Fatalln("Invalid TLS config: If a client certificate is specified, the key file for it must also be given.")
-			} else if cert, err := tls.LoadX509KeyPair(settings.ClientCertFile, settings.ClientKeyFile); err != nil {
-				log.Fatalln("Client certificate:", err.Error())
-			} else {
-				certs = []tls.Certificate{cert}
-			}
+		rootcas, certs, err := settings.loadCerts()
+		if err != nil {
+			return nil, err
 		}
 
 		// @todo: This needs review from a TLS Pro, not sure if I'm
@@ -148,26 +140,138 @@ func (me *Node) getClientOptions(settings *Settings) (*mqtt.ClientOptions, error
 	return opts, nil
 }
 
-func (me *Node) subscribeTo(topic string, qos byte) error {
+// Loads the CA and client certificate files, nil if not configured.
+func (me *Settings) loadCerts() (*x509.CertPool, []tls.Certificate, error) {
+	var rootcas *x509.CertPool = nil
+	if me.CAFile != "" {
+		if ca, err := os.ReadFile(me.CAFile); err != nil {
+			return nil, nil, fmt.Errorf("CA file: %s", err.Error())
+		} else if rootcas = x509.NewCertPool(); !rootcas.AppendCertsFromPEM(ca) {
+			return nil, nil, fmt.Errorf("CA file: no PEM certificates in '%s'", me.CAFile)
+		}
+	}
+	var certs []tls.Certificate = nil
+	if me.ClientCertFile != "" {
+		if me.ClientKeyFile == "" {
+			return nil, nil, errors.New("invalid TLS config: If a client certificate is specified, the key file for it must also be given")
+		} else if cert, err := tls.LoadX509KeyPair(me.ClientCertFile, me.ClientKeyFile); err != nil {
+			return nil, nil, fmt.Errorf("client certificate: %s", err.Error())
+		} else {
+			certs = []tls.Certificate{cert}
+		}
+	}
+	return rootcas, certs, nil
+}
+
+// Checks the protocol, broker and (for mqtts) the certificate files.
+func (me *Settings) Validate() error {
+	switch strings.ToLower(me.Protocol) {
+	case "mqtt":
+	case "mqtts":
+		if _, _, err := me.loadCerts(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid protocol setting '%s', allowed are 'mqtt', 'mqtts'", me.Protocol)
+	}
+	if me.BrokerIP == "" {
+		return errors.New("broker_ip not set")
+	}
+	return nil
+}
+
+func (me *Node) subscribe(topic string, qos byte) error {
 	if token := me.client.Subscribe(topic, qos, func(client mqtt.Client, msg mqtt.Message) {
+		metricReceived.Inc(topic)
 		me.Data <- DataEvent{
 			time:  time.Now(),
 			topic: msg.Topic(),
 			data:  msg.Payload(),
 		}
 	}); token.Wait() && token.Error() != nil {
+		return errors.New("failed to subscribe to topic " + topic + ":" + token.Error().Error())
+	}
+	return nil
+}
+
+func (me *Node) subscribeTo(topic string, qos byte) error {
+	if err := me.subscribe(topic, qos); err != nil {
 		me.Connection <- ConnectionEvent{
 			Time:  time.Now(),
 			Type:  SubscribeFailed,
-			Error: errors.New("failed to subscribe to topic " + topic + ":" + token.Error().Error()),
+			Error: err,
 		}
-		return token.Error()
+		return err
 	}
 	return nil
 }
 
-func Connect(settings *Settings) (Node, error) {
-	me := Node{
+func subscriptions(topics []string) []string {
+	if len(topics) == 0 {
+		return []string{"#"}
+	}
+	return topics
+}
+
+// Changes the subscriptions without reconnecting: Unsubscribes removed
+// topics and subscribes new ones. The topics are also used for subsequent
+// reconnects. The requests are sent in the background, as the broker
+// acknowledgements are only processed after the pending messages are read
+// from the Data channel. Failures are sent as ResubscribeFailed events.
+func (me *Node) Resubscribe(topics []string) {
+	me.mu.Lock()
+	me.settings.Topics = slices.Clone(topics)
+	me.mu.Unlock()
+	go func() {
+		if err := me.resubscribe(); err != nil {
+			me.Connection <- ConnectionEvent{
+				Time:  time.Now(),
+				Type:  ResubscribeFailed,
+				Error: err,
+			}
+		}
+	}()
+}
+
+// Applies the latest subscription topics, skipped if already done by a
+// subsequent change.
+func (me *Node) resubscribe() error {
+	me.resub.Lock()
+	defer me.resub.Unlock()
+	me.mu.Lock()
+	previous := me.subscribed
+	next := subscriptions(me.settings.Topics)
+	me.subscribed = next
+	me.mu.Unlock()
+
+	var err error
+	removed := slices.DeleteFunc(slices.Clone(previous), func(t string) bool { return slices.Contains(next, t) })
+	if len(removed) > 0 {
+		if token := me.client.Unsubscribe(removed...); token.WaitTimeout(5*time.Second) && token.Error() != nil {
+			err = errors.Join(err, fmt.Errorf("failed to unsubscribe %v: %s", removed, token.Error()))
+		}
+	}
+	for _, topic := range next {
+		if !slices.Contains(previous, topic) {
+			err = errors.Join(err, me.subscribe(topic, 0))
+		}
+	}
+	return err
+}
+
+func Connect(settings *Settings) (*Node, error) {
+	return connect(settings, true)
+}
+
+// Connects without subscriptions, for publishing only, with the client ID
+// of the settings. The connection events are still sent and must be read
+// from the Connection channel.
+func ConnectPublisher(settings *Settings) (*Node, error) {
+	return connect(settings, false)
+}
+
+func connect(settings *Settings, subscribe bool) (*Node, error) {
+	me := &Node{
 		settings:   *settings,
 		client:     nil,
 		Data:       make(chan DataEvent),
@@ -177,6 +281,8 @@ func Connect(settings *Settings) (Node, error) {
 	opts, err := me.getClientOptions(settings)
 	if err != nil {
 		return me, err
+	} else if !subscribe && settings.ClientID != "" {
+		opts.SetClientID(settings.ClientID)
 	}
 
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
@@ -185,12 +291,15 @@ func Connect(settings *Settings) (Node, error) {
 			Type:  ConnectionEstablished,
 			Error: nil,
 		}
-		if len(me.settings.Topics) == 0 {
-			me.subscribeTo("#", 0)
-		} else {
-			for _, topic := range me.settings.Topics {
-				me.subscribeTo(topic, 0)
-			}
+		if !subscribe {
+			return
+		}
+		me.mu.Lock()
+		topics := subscriptions(me.settings.Topics)
+		me.subscribed = topics
+		me.mu.Unlock()
+		for _, topic := range topics {
+			me.subscribeTo(topic, 0)
 		}
 	})
 
@@ -209,6 +318,13 @@ func Connect(settings *Settings) (Node, error) {
 	return me, nil
 }
 
+func (me *Node) Publish(topic string, data []byte, qos byte, retain bool) error {
+	if token := me.client.Publish(topic, qos, retain, data); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to publish topic %s: %s", topic, token.Error().Error())
+	}
+	return nil
+}
+
 func (me *Node) Disconnect() {
 	if me.client == nil {
 		return
@@ -0,0 +1,173 @@
+package mqttnode
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//------------------------------------------------------------------------
+
+type testToken struct {
+	done chan struct{}
+	err  error
+}
+
+func (me *testToken) Wait() bool { <-me.done; return true }
+func (me *testToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-me.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+func (me *testToken) Done() <-chan struct{} { return me.done }
+func (me *testToken) Error() error          { return me.err }
+
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (me testMessage) Topic() string   { return me.topic }
+func (me testMessage) Payload() []byte { return me.payload }
+
+// Client processing messages and acknowledgements in order like paho, a
+// blocked message handler delays the acknowledgements.
+type testClient struct {
+	mqtt.Client
+	mu       sync.Mutex
+	handlers map[string]mqtt.MessageHandler
+	incoming chan func()
+	fail     string // Topic not allowed to subscribe
+}
+
+func newTestClient() *testClient {
+	me := &testClient{handlers: map[string]mqtt.MessageHandler{}, incoming: make(chan func(), 100)}
+	go func() {
+		for f := range me.incoming {
+			f()
+		}
+	}()
+	return me
+}
+
+func (me *testClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	token := &testToken{done: make(chan struct{})}
+	me.incoming <- func() {
+		me.mu.Lock()
+		if topic == me.fail {
+			token.err = errors.New("not authorized")
+		} else {
+			me.handlers[topic] = callback
+		}
+		me.mu.Unlock()
+		close(token.done)
+	}
+	return token
+}
+
+func (me *testClient) Unsubscribe(topics ...string) mqtt.Token {
+	token := &testToken{done: make(chan struct{})}
+	me.incoming <- func() {
+		me.mu.Lock()
+		for _, topic := range topics {
+			delete(me.handlers, topic)
+		}
+		me.mu.Unlock()
+		close(token.done)
+	}
+	return token
+}
+
+func (me *testClient) deliver(topic string, payload string) {
+	me.incoming <- func() {
+		me.mu.Lock()
+		handler := me.handlers[topic]
+		me.mu.Unlock()
+		if handler != nil {
+			handler(me, testMessage{topic: topic, payload: []byte(payload)})
+		}
+	}
+}
+
+func (me *testClient) subscribed() []string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	topics := []string{}
+	for topic := range me.handlers {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+//------------------------------------------------------------------------
+
+func TestResubscribe(t *testing.T) {
+	client := newTestClient()
+	node := &Node{settings: Settings{Topics: []string{"a"}}, subscribed: []string{"a"}, client: client, Data: make(chan DataEvent), Connection: make(chan ConnectionEvent)}
+	if err := node.subscribe("a", 0); err != nil {
+		t.Fatalf("Unexpected subscribe error: %v", err)
+	}
+	receive := func(expected string) {
+		t.Helper()
+		select {
+		case data := <-node.Data:
+			if data.Topic()+"="+string(data.Data()) != expected {
+				t.Errorf("Unexpected data %s=%s, expected %s", data.Topic(), data.Data(), expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for %s", expected)
+		}
+	}
+	waitSubscribed := func(expected []string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !slices.Equal(client.subscribed(), expected); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Unexpected subscriptions %v, expected %v", client.subscribed(), expected)
+			}
+		}
+	}
+
+	// The handler blocks until the message is read, Resubscribe must not wait.
+	client.deliver("a", "1")
+	done := make(chan struct{})
+	go func() {
+		node.Resubscribe([]string{"a", "b"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Resubscribe blocked by pending message")
+	}
+	receive("a=1")
+	waitSubscribed([]string{"a", "b"})
+	client.deliver("b", "2")
+	receive("b=2")
+
+	node.Resubscribe([]string{"b"})
+	waitSubscribed([]string{"b"})
+	if node.settings.Topics[0] != "b" || len(node.settings.Topics) != 1 {
+		t.Errorf("Unexpected topics for reconnects: %v", node.settings.Topics)
+	}
+
+	// Failures are reported as connection events.
+	client.fail = "c"
+	node.Resubscribe([]string{"b", "c"})
+	select {
+	case con := <-node.Connection:
+		if con.Type != ResubscribeFailed || con.Error == nil {
+			t.Errorf("Unexpected connection event: %+v", con)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for the resubscribe failure")
+	}
+}
@@ -6,9 +6,13 @@ import (
 	"errors"
 	"flag"
 	"log"
+	"mqttrack/alert"
+	"mqttrack/httpapi"
 	"mqttrack/jsonc"
+	"mqttrack/metrics"
 	"mqttrack/mqttnode"
 	"mqttrack/recorder"
+	"mqttrack/timefmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -21,9 +25,16 @@ var PROGRAM_NAME string = "mqttrack"
 var PROGRAM_VERSION string = "v1.0"
 var GIT_VERSION string = ""
 
+var (
+	metricConnected  = metrics.NewGauge("mqttrack_mqtt_connected", "Broker connection state (1 connected, 0 disconnected).")
+	metricReconnects = metrics.NewCounter("mqttrack_mqtt_reconnects_total", "Connections re-established after a connection loss.")
+)
+
 type AppSettings struct {
 	MQTT     mqttnode.Settings `json:"mqtt"`
 	Recorder recorder.Settings `json:"recorder"`
+	HTTP     httpapi.Settings  `json:"http"`
+	Alerts   alert.Settings    `json:"alerts"`
 	LogFile  string            `json:"logfile"`
 }
 
@@ -55,6 +66,7 @@ func (me *AppSettings) SetMissingFieldDefaults() {
 }
 
 func (me *AppSettings) SetExampleValues() {
+	exampleAbove := 30.0
 	me.MQTT = mqttnode.Settings{
 		Protocol:       "mqtts (prefer) OR mqtt",
 		BrokerIP:       "192.168.xxx.xxx|fe80::xxxx|DNS",
@@ -68,7 +80,8 @@ func (me *AppSettings) SetExampleValues() {
 		Topics:         []string{"#", "or/specific/topic1", "or/specific/topic2"},
 	}
 	me.Recorder = recorder.Settings{
-		RootDirectory: "./data",
+		RootDirectory:   "./data",
+		TimestampFormat: "unix",
 		TopicFilters: []string{
 			"home/**/power",
 			"plug?/energy",
@@ -76,10 +89,25 @@ func (me *AppSettings) SetExampleValues() {
 			"home/doors/**",
 		},
 	}
+	me.HTTP = httpapi.Settings{
+		Listen:   "127.0.0.1:8080 (empty: disabled)",
+		Token:    "bearer-token*****************",
+		ReadOnly: true,
+	}
+	me.Alerts = alert.Settings{
+		Topic:   "mqttrack/alerts",
+		Webhook: "http://127.0.0.1:8123/hook (empty: disabled)",
+		Stale: []alert.StaleRule{
+			{Pattern: "home/**/temperature", MaxInterval: timefmt.Duration(15 * time.Minute)},
+		},
+		Rules: []alert.Rule{
+			{Name: "hot", Pattern: "home/**/temperature", Above: &exampleAbove, For: timefmt.Duration(5 * time.Minute)},
+		},
+	}
 	me.LogFile = "stdout OR stderr OR file path"
 }
 
-func processCLIArgs() (bool, AppSettings, error) {
+func processCLIArgs() (bool, string, AppSettings, error) {
 	// TODO: Long options don't seem to be on the menu in vanilla GO.
 	var isVerboseShort bool
 	flag.BoolVar(&isVerboseShort, "v", false, "Verbose logging of each received message.")
@@ -95,7 +123,7 @@ func processCLIArgs() (bool, AppSettings, error) {
 		settings.SetExampleValues()
 		jst, err := json.MarshalIndent(settings, "", " ")
 		if err != nil {
-			return false, settings, errors.New("failed to compose example config")
+			return false, "", settings, errors.New("failed to compose example config")
 		} else {
 			println(string(jst))
 			os.Exit(0)
@@ -104,10 +132,10 @@ func processCLIArgs() (bool, AppSettings, error) {
 
 	err := settings.Load(configFile)
 	if err != nil {
-		return false, settings, err
+		return false, configFile, settings, err
 	}
 
-	return isVerboseShort, settings, nil
+	return isVerboseShort, configFile, settings, nil
 }
 
 func programInfo() string {
@@ -121,11 +149,29 @@ func programInfo() string {
 	return ver
 }
 
+// Offline tools, invoked as `mqttrack <subcommand> [options]`.
+var subcommands = map[string]func(args []string) error{
+	"compact": runCompact,
+	"query":   runQuery,
+	"replay":  runReplay,
+	"rollup":  runRollup,
+	"verify":  runVerify,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	log.Print("Starting ", programInfo())
 
 	// Settings
-	isverbose, settings, err := processCLIArgs()
+	isverbose, configFile, settings, err := processCLIArgs()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -165,32 +211,79 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer node.Disconnect()
+	recorder.SetPublisher(node)
+	notifier := alert.NewNotifier(settings.Alerts)
+	notifier.SetPublisher(node)
+
+	app := App{
+		configFile: configFile,
+		settings:   settings,
+		recorder:   &recorder,
+		node:       node,
+		notifier:   notifier,
+		watchdog:   alert.NewWatchdog(settings.Alerts.Stale),
+		engine:     alert.NewEngine(settings.Alerts.Rules, alert.SystemClock{}, notifier),
+		reconfig:   make(chan configChange),
+	}
+	defer func() { app.node.Disconnect() }()
+
+	if settings.HTTP.Listen != "" {
+		server := httpapi.New(settings.HTTP, &recorder)
+		server.HandleConfig(&app)
+		server.Handle("GET /metrics", metrics.Default.Handler())
+		if err := server.Start(); err != nil {
+			log.Fatal("Failed to start HTTP API: ", err)
+		}
+		defer server.Stop()
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
 
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
+	connected := false // Connected at least once, further connections count as reconnects
 	// Process loop
 	for quit := false; !quit; {
 		select {
-		case data := <-node.Data:
+		case data := <-app.node.Data:
 			if isverbose {
 				log.Print("Incoming: " + data.Topic() + " = " + string(data.Data()))
 			}
 			recorder.Write(data)
+			app.engine.Process(data.Topic(), data.Data())
 			continue
-		case con := <-node.Connection:
+		case con := <-app.node.Connection:
 			switch con.Type {
 			case mqttnode.ConnectionEstablished:
 				log.Print("Connected to broker")
+				if metricConnected.Value() == 0 && connected {
+					metricReconnects.Inc()
+				}
+				metricConnected.Set(1)
+				connected = true
 			case mqttnode.SubscribeFailed:
 				log.Print("Subscribe failed: ", con.Error.Error())
 				quit = true
+			case mqttnode.ResubscribeFailed:
+				log.Print("Resubscribing failed: ", con.Error.Error())
 			case mqttnode.ConnectionLost:
 				log.Print("Connection lost: ", con.Error.Error())
+				metricConnected.Set(0)
 			}
 			continue
-		case <-ticker.C:
+		case change := <-app.reconfig:
+			change.result <- app.apply(change.settings)
+			continue
+		case <-hangup:
+			log.Print("Reloading config file due to HUP signal.")
+			go app.reload()
+			continue
+		case now := <-ticker.C:
+			app.checkAlerts(now)
+			recorder.Flush()
 			continue
 		case <-ctx.Done():
 			log.Println("Terminating due to TERM signal.")
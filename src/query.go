@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mqttrack/archive"
+	"mqttrack/recorder"
+	"mqttrack/timefmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Recorder settings for offline subcommands: from the config file, the
+// root directory optionally overridden.
+func loadRecorderSettings(configFile string, root string) (recorder.Settings, error) {
+	var settings AppSettings
+	if err := settings.Load(configFile); err != nil {
+		if root == "" {
+			return settings.Recorder, err
+		}
+	}
+	if root != "" {
+		settings.Recorder.RootDirectory = root
+	}
+	if settings.Recorder.RootDirectory == "" {
+		return settings.Recorder, errors.New("data root directory not specified")
+	}
+	return settings.Recorder, nil
+}
+
+// Parses a time argument, absolute timestamp (unix, RFC3339) or negative
+// duration relative to now (e.g. -24h).
+func parseTimeArg(text string) (time.Time, error) {
+	if text == "" {
+		return time.Time{}, nil
+	} else if strings.HasPrefix(text, "-") {
+		if d, err := timefmt.ParseDuration(text); err == nil {
+			return time.Now().Add(d), nil
+		}
+	}
+	return timefmt.Parse(text, timefmt.Auto)
+}
+
+func runQuery(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	configFile := flags.String("c", DEFAULT_CONFIG_FILE, "Config file path to use.")
+	root := flags.String("root", "", "Data root directory (default from the config file).")
+	fromArg := flags.String("from", "", "Start time (inclusive), unix timestamp, RFC3339, or relative like -24h.")
+	toArg := flags.String("to", "", "End time (exclusive), unix timestamp, RFC3339, or relative like -1h.")
+	format := flags.String("format", archive.ExportCSV, "Output format: csv, json.")
+	timeFormat := flags.String("time-format", "", "Output timestamp format (default from the config file).")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s query [options] [topic patterns ...]\n", PROGRAM_NAME)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	settings, err := loadRecorderSettings(*configFile, *root)
+	if err != nil {
+		return err
+	}
+	from, err := parseTimeArg(*fromArg)
+	if err != nil {
+		return fmt.Errorf("invalid --from time: %s", err.Error())
+	}
+	to, err := parseTimeArg(*toArg)
+	if err != nil {
+		return fmt.Errorf("invalid --to time: %s", err.Error())
+	}
+	if *timeFormat == "" {
+		*timeFormat = settings.TimestampFormat
+	}
+	if *timeFormat != "" && !timefmt.Valid(*timeFormat) {
+		return fmt.Errorf("invalid timestamp format: '%s'", *timeFormat)
+	}
+	decimals := -1
+	if settings.TimestampDecimals != nil {
+		decimals = int(*settings.TimestampDecimals)
+	}
+
+	readers, err := archive.OpenMatching(settings.RootDirectory, flags.Args(), from, to)
+	if err != nil {
+		return err
+	}
+	merger := archive.NewMerger(readers)
+	defer merger.Close()
+
+	err = archive.Export(os.Stdout, *format, merger.Next, func(t time.Time) string {
+		return timefmt.Format(t, *timeFormat, decimals)
+	})
+	if err != nil {
+		return err
+	}
+	return merger.Err()
+}
@@ -0,0 +1,268 @@
+package recorder
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mqttrack/archive"
+	"mqttrack/codec"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Result of compacting the record files of a topic.
+type CompactReport struct {
+	Topic       string
+	FilesBefore int
+	FilesAfter  int
+	LinesBefore int
+	LinesAfter  int
+	Unchanged   int   // Lines removed by the change detection
+	BytesBefore int64 // File sizes as stored (compressed)
+	BytesAfter  int64
+}
+
+func (me CompactReport) String() string {
+	return fmt.Sprintf("%s: %d files, %d lines, %d bytes -> %d files, %d lines (%d unchanged removed), %d bytes",
+		me.Topic, me.FilesBefore, me.LinesBefore, me.BytesBefore, me.FilesAfter, me.LinesAfter, me.Unchanged, me.BytesAfter)
+}
+
+// Rewrites the live and rotated record files of a topic with the current
+// settings: Unchanged values (equal, deadband, heartbeat) are removed,
+// timestamps and values re-encoded, and the lines split into files of the
+// rotation size, so that small rotated files are merged. The new files
+// replace the old ones only if all were written, with `dryRun` only the
+// report is made. The topic must not be recorded meanwhile.
+func (me *Recorder) Compact(topic string, dryRun bool) (CompactReport, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	report := CompactReport{Topic: topic}
+	topic, err := sanitizeTopic(topic)
+	if err != nil {
+		return report, err
+	}
+	root := me.settings.RootDirectory
+	files, err := archive.Files(root, topic)
+	if err != nil {
+		return report, err
+	} else if len(files) == 0 {
+		return report, fmt.Errorf("no record files of topic '%s'", topic)
+	}
+	report.FilesBefore = len(files)
+	for _, file := range files {
+		if st, err := os.Stat(file.Path); err == nil {
+			report.BytesBefore += st.Size()
+		}
+	}
+
+	filePath := path.Join(root, topic)
+	tmp := path.Join(path.Dir(filePath), ".compact-"+path.Base(filePath)+".tmp")
+	os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return report, fmt.Errorf("failed to create compaction directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tmp)
+
+	pol := me.policy(topic)
+	out := &compactWriter{dir: tmp, base: path.Base(filePath), limit: int64(pol.rotateSize) * 1024, gzip: pol.gzip}
+	if !me.settings.DisableIndex {
+		out.index = &archive.Index{}
+	}
+	rd, err := archive.Open(root, topic, time.Time{}, time.Time{})
+	if err != nil {
+		return report, err
+	}
+	defer rd.Close()
+	var prev Record
+	for {
+		e, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			out.close()
+			return report, err
+		}
+		report.LinesBefore++
+		rec := NewRecord(e.Time, topic, e.Value)
+		if pol.unchanged(prev, rec) {
+			report.Unchanged++
+			continue
+		}
+		prev = rec
+		line := codec.Encode(pol.encoding, me.timestamp(e.Time), e.Value)
+		if e.Raw != nil {
+			line = codec.EncodeRaw(pol.encoding, me.timestamp(e.Time), e.Value, e.Raw)
+		}
+		if err := out.write(e.Time, line); err != nil {
+			out.close()
+			return report, err
+		}
+	}
+	if err := out.close(); err != nil {
+		return report, err
+	} else if rd.Skipped > 0 {
+		return report, fmt.Errorf("topic '%s' not compacted, %d invalid or truncated lines", topic, rd.Skipped)
+	} else if report.LinesBefore == 0 {
+		return report, fmt.Errorf("topic '%s' not compacted, no records", topic)
+	}
+	report.LinesAfter = out.lines
+	report.FilesAfter = out.rotated + 1
+	outputs, err := os.ReadDir(tmp)
+	if err != nil {
+		return report, err
+	}
+	for _, de := range outputs {
+		if fi, err := de.Info(); err == nil && de.Name() != path.Base(archive.IndexPath(filePath)) {
+			report.BytesAfter += fi.Size()
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	// Swap: The previous files are moved aside, the new ones moved in, and on
+	// failure the previous state is restored.
+	previous := []string{}
+	for _, file := range files {
+		previous = append(previous, file.Path)
+	}
+	if _, err := os.Stat(archive.IndexPath(filePath)); err == nil {
+		previous = append(previous, archive.IndexPath(filePath))
+	}
+	backup := path.Join(path.Dir(filePath), ".compact-"+path.Base(filePath)+".old")
+	os.RemoveAll(backup)
+	if err := os.Mkdir(backup, 0755); err != nil {
+		return report, fmt.Errorf("failed to create compaction backup directory: %s", err.Error())
+	}
+	moved, added := []string{}, []string{}
+	restore := func(err error) (CompactReport, error) {
+		for _, p := range added {
+			os.Remove(p)
+		}
+		restored := true
+		for _, p := range moved {
+			if rerr := os.Rename(path.Join(backup, path.Base(p)), p); rerr != nil {
+				err, restored = errors.Join(err, rerr), false
+			}
+		}
+		if restored {
+			os.RemoveAll(backup)
+		} else {
+			err = errors.Join(err, fmt.Errorf("previous files kept in '%s'", backup))
+		}
+		return report, fmt.Errorf("failed to replace the files of topic '%s': %s", topic, err.Error())
+	}
+	for _, p := range previous {
+		if err := os.Rename(p, path.Join(backup, path.Base(p))); err != nil {
+			return restore(err)
+		}
+		moved = append(moved, p)
+	}
+	for _, de := range outputs {
+		p := path.Join(path.Dir(filePath), de.Name())
+		if err := os.Rename(path.Join(tmp, de.Name()), p); err != nil {
+			return restore(err)
+		}
+		added = append(added, p)
+	}
+	delete(me.indexes, filePath)
+	delete(me.lastWritten, topic)
+	os.RemoveAll(backup)
+	return report, nil
+}
+
+// Writes the compacted lines in rotated files like the recorder: the file is
+// rotated when it reached the size limit, the previous rotated file gzipped.
+type compactWriter struct {
+	dir     string
+	base    string
+	limit   int64
+	gzip    bool
+	index   *archive.Index
+	file    *os.File
+	size    int64
+	rotated int
+	lines   int
+}
+
+func (me *compactWriter) write(t time.Time, line []byte) error {
+	if me.file != nil && me.limit > 0 && me.size >= me.limit {
+		if err := me.rotate(); err != nil {
+			return err
+		}
+	}
+	if me.file == nil {
+		f, err := os.OpenFile(path.Join(me.dir, me.base), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		me.file, me.size = f, 0
+	}
+	if _, err := me.file.Write(line); err != nil {
+		return err
+	}
+	if me.index != nil {
+		me.index.Append(t, me.size, int64(len(line)))
+	}
+	me.size += int64(len(line))
+	me.lines++
+	return nil
+}
+
+func (me *compactWriter) rotate() error {
+	if err := me.file.Close(); err != nil {
+		return err
+	}
+	me.file = nil
+	me.rotated++
+	live := path.Join(me.dir, me.base)
+	if err := os.Rename(live, live+"."+strconv.Itoa(me.rotated)); err != nil {
+		return err
+	}
+	if me.index != nil {
+		me.index.Rotate(me.rotated)
+	}
+	if me.gzip && me.rotated > 1 {
+		return gzipFile(live + "." + strconv.Itoa(me.rotated-1))
+	}
+	return nil
+}
+
+// Closes the live file and writes the index.
+func (me *compactWriter) close() error {
+	if me.file == nil {
+		return nil
+	}
+	err := me.file.Close()
+	me.file = nil
+	if err == nil && me.index != nil {
+		err = me.index.Save(path.Join(me.dir, me.base))
+	}
+	return err
+}
+
+// Compresses a file to `<file>.gz` and removes it.
+func gzipFile(filePath string) error {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(filePath+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	gz, _ := gzip.NewWriterLevel(dst, gzip.BestCompression)
+	if _, err := io.Copy(gz, src); err != nil {
+		return err
+	} else if err := gz.Close(); err != nil {
+		return err
+	} else if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
@@ -0,0 +1,204 @@
+package recorder
+
+import (
+	"fmt"
+	"mqttrack/codec"
+	"mqttrack/timefmt"
+	"mqttrack/topicfilter"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DerivedDelta    = "delta"    // Counter increase
+	DerivedRate     = "rate"     // Counter increase per time unit
+	DerivedIntegral = "integral" // Cumulative time integral, e.g. power to energy
+)
+
+// Virtual topic computed from numeric source topics, e.g. pattern "plug?/power",
+// topic "{topic}_energy", kind "integral", per "1h", scale 0.001 records the
+// energy in kWh from the power in W.
+type DerivedRule struct {
+	Pattern  string           `json:"pattern"`            // fnmatch, MQTT or `re:` pattern of the source topics
+	Topic    string           `json:"topic"`              // Output topic, `{topic}` is the source topic, `{1}`, `{2}`, ... its levels
+	Kind     string           `json:"kind"`               // delta|rate|integral
+	Field    string           `json:"field,omitempty"`    // JSON payload field of the value, empty: whole payload
+	Interval timefmt.Duration `json:"interval,omitempty"` // Minimum time between outputs, 0: each message
+	Per      timefmt.Duration `json:"per,omitempty"`      // Time unit of rates and integrals, default 1s
+	Scale    *float64         `json:"scale,omitempty"`    // Output factor, default 1
+	MaxGap   timefmt.Duration `json:"max_gap,omitempty"`  // Longer gaps between samples are not integrated, 0: no limit
+	Decimals *uint            `json:"decimals,omitempty"` // Output decimals, nil: as needed
+}
+
+func (me *DerivedRule) Validate() error {
+	if _, err := topicfilter.Compile(me.Pattern); err != nil {
+		return fmt.Errorf("derived rule for '%s': %s", me.Pattern, err.Error())
+	} else if _, err := sanitizeTopic(me.Topic); err != nil {
+		return fmt.Errorf("derived rule for '%s': %s", me.Pattern, err.Error())
+	} else if me.Kind != DerivedDelta && me.Kind != DerivedRate && me.Kind != DerivedIntegral {
+		return fmt.Errorf("derived rule for '%s': invalid kind '%s', allowed are delta, rate, integral", me.Pattern, me.Kind)
+	} else if me.Interval < 0 || me.Per < 0 || me.MaxGap < 0 {
+		return fmt.Errorf("derived rule for '%s': durations must not be negative", me.Pattern)
+	}
+	return nil
+}
+
+func (me *DerivedRule) outputTopic(topic string) string {
+	out := strings.ReplaceAll(me.Topic, "{topic}", topic)
+	levels := strings.Split(topic, "/")
+	for i := len(levels); i > 0; i-- {
+		out = strings.ReplaceAll(out, "{"+strconv.Itoa(i)+"}", levels[i-1])
+	}
+	return out
+}
+
+type derivedState struct {
+	value float64   // Last sample
+	time  time.Time // Last sample time
+	since time.Time // Last output time
+	acc   float64   // Delta since the last output, integral total
+}
+
+type compiledDerived struct {
+	*DerivedRule
+	pattern *topicfilter.Pattern
+	scale   float64
+	per     float64 // seconds
+}
+
+type derivedSeries struct {
+	rules  []compiledDerived
+	states map[string]*derivedState // Key: rule index and source topic
+	active bool                     // Writing outputs, which are not derived again
+}
+
+// Compiled derived rules, invalid ones (reported by Validate()) are skipped.
+func newDerivedSeries(rules []DerivedRule) *derivedSeries {
+	ds := &derivedSeries{states: make(map[string]*derivedState)}
+	for i := range rules {
+		if rules[i].Validate() != nil {
+			continue
+		}
+		cd := compiledDerived{DerivedRule: &rules[i], scale: 1, per: 1}
+		cd.pattern, _ = topicfilter.Compile(rules[i].Pattern)
+		if rules[i].Scale != nil {
+			cd.scale = *rules[i].Scale
+		}
+		if rules[i].Per > 0 {
+			cd.per = rules[i].Per.D().Seconds()
+		}
+		ds.rules = append(ds.rules, cd)
+	}
+	return ds
+}
+
+// Feeds a received value into all matching derived rules and writes the
+// outputs that are due.
+func (me *Recorder) derive(topic string, data Record) {
+	if len(me.derived.rules) == 0 || me.derived.active {
+		return
+	}
+	for i := range me.derived.rules {
+		rule := &me.derived.rules[i]
+		if !rule.pattern.Match(topic) {
+			continue
+		}
+		text := string(data.Data())
+		if rule.Field != "" {
+			var err error
+			if text, err = codec.JSONField(data.Data(), rule.Field); err != nil {
+				me.logVerbose("Derived value of ", topic, " ignored: ", err.Error())
+				continue
+			}
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			me.logVerbose("Derived value of ", topic, " ignored: not a number")
+			continue
+		}
+		out := rule.outputTopic(topic)
+		if value, ok := me.deriveSample(i, rule, topic, out, v, data.Time()); ok {
+			decimals := -1
+			if rule.Decimals != nil {
+				decimals = int(*rule.Decimals)
+			}
+			me.writeDerived(out, NewRecord(data.Time(), out, strconv.AppendFloat(nil, value, 'f', decimals, 64)))
+		}
+	}
+}
+
+// Updates the state of a rule and topic, returns the output value if due.
+func (me *Recorder) deriveSample(i int, rule *compiledDerived, topic string, out string, v float64, t time.Time) (float64, bool) {
+	key := strconv.Itoa(i) + ":" + topic
+	st, ok := me.derived.states[key]
+	if !ok {
+		st = &derivedState{value: v, time: t, since: t}
+		if rule.Kind == DerivedIntegral {
+			st.acc = me.lastDerivedValue(out)
+		}
+		me.derived.states[key] = st
+		return 0, false
+	} else if t.Before(st.time) {
+		return 0, false
+	}
+	dt := t.Sub(st.time)
+	switch rule.Kind {
+	case DerivedIntegral:
+		if rule.MaxGap == 0 || dt <= rule.MaxGap.D() {
+			st.acc += (st.value + v) / 2 * dt.Seconds() / rule.per * rule.scale
+		}
+	default:
+		if v >= st.value {
+			st.acc += v - st.value
+		} else {
+			st.acc += v // Counter reset
+		}
+	}
+	st.value, st.time = v, t
+	elapsed := t.Sub(st.since)
+	if elapsed < rule.Interval.D() || (rule.Kind == DerivedRate && elapsed <= 0) {
+		return 0, false
+	}
+	st.since = t
+	switch rule.Kind {
+	case DerivedIntegral:
+		return st.acc, true
+	case DerivedRate:
+		value := st.acc / elapsed.Seconds() * rule.per * rule.scale
+		st.acc = 0
+		return value, true
+	default:
+		value := st.acc * rule.scale
+		st.acc = 0
+		return value, true
+	}
+}
+
+// Last recorded value of an output topic, integrals continue from there.
+func (me *Recorder) lastDerivedValue(topic string) float64 {
+	if line := lastLine(path.Join(me.settings.RootDirectory, topic)); line != nil {
+		if rec, err := codec.Decode(line); err == nil {
+			if v, err := strconv.ParseFloat(string(rec.Value), 64); err == nil {
+				return v
+			}
+		}
+	}
+	return 0
+}
+
+func (me *Recorder) writeDerived(topic string, data Record) {
+	topic, err := sanitizeTopic(topic)
+	if err == nil && me.isMirrorTopic(topic) {
+		err = fmt.Errorf("derived topic must not be the mirror topic '%s'", topic)
+	} else if err == nil {
+		me.derived.active = true
+		err = me.write(topic, data)
+		me.derived.active = false
+	}
+	if err != nil {
+		metricWriteErrors.Inc()
+		me.logVerbose("Derived topic not written: ", err.Error())
+	}
+}
@@ -0,0 +1,120 @@
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"mqttrack/topicfilter"
+	"strings"
+)
+
+const (
+	FilterExcludeWins = "exclude_wins" // Default: excluded if any `!` pattern matches, otherwise included if any pattern matches
+	FilterFirstMatch  = "first_match"  // The first matching pattern in the list decides
+)
+
+type FilterStat struct {
+	Pattern string `json:"pattern"`
+	Topics  uint64 `json:"topics"` // Number of received topics matching the pattern
+}
+
+// Maximum number of cached filter decisions, further topics are evaluated
+// for each message (and not counted in the filter stats).
+const MaxFilterCacheSize = 100000
+
+// Compiled filter patterns with per-topic decision cache, rebuilt on
+// configuration changes.
+type topicFilter struct {
+	patterns []string
+	excludes []bool
+	includes bool // Any include pattern
+	mode     string
+	set      *topicfilter.Set
+	cache    map[string]bool
+	counts   []uint64 // Number of cached topics matched per pattern
+	matches  []int
+}
+
+func validateFilters(patterns []string, mode string) error {
+	switch mode {
+	case "", FilterExcludeWins, FilterFirstMatch:
+	default:
+		return fmt.Errorf("invalid filter mode: '%s'", mode)
+	}
+	_, err := newTopicFilter(patterns, mode)
+	return err
+}
+
+// Compiles the filter patterns (`!` prefix for excludes, then fnmatch, MQTT
+// or `re:` pattern). Invalid patterns never match.
+func newTopicFilter(patterns []string, mode string) (*topicFilter, error) {
+	me := &topicFilter{
+		patterns: patterns,
+		mode:     mode,
+		cache:    make(map[string]bool),
+		counts:   make([]uint64, len(patterns)),
+	}
+	compiled := []*topicfilter.Pattern{}
+	var errs error
+	for _, text := range patterns {
+		expr, exclude := strings.CutPrefix(text, "!")
+		pattern, err := topicfilter.Compile(expr)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("invalid filter pattern '%s': %s", text, err.Error()))
+		}
+		compiled = append(compiled, pattern)
+		me.excludes = append(me.excludes, exclude)
+		me.includes = me.includes || !exclude
+	}
+	me.set = topicfilter.NewSet(compiled)
+	return me, errs
+}
+
+// Returns if a topic is recorded. Without include patterns, all topics
+// that are not excluded are recorded.
+func (me *topicFilter) accept(topic string) bool {
+	if len(me.patterns) == 0 {
+		return true
+	} else if accepted, ok := me.cache[topic]; ok {
+		return accepted
+	}
+	me.matches = me.set.Matches(topic, me.matches[:0])
+	accepted := me.decide(me.matches)
+	if len(me.cache) < MaxFilterCacheSize {
+		me.cache[topic] = accepted
+		for _, i := range me.matches {
+			me.counts[i]++
+		}
+	}
+	return accepted
+}
+
+// Decision for the (sorted) indices of the matching patterns.
+func (me *topicFilter) decide(matches []int) bool {
+	if len(matches) == 0 {
+		return !me.includes
+	} else if me.mode == FilterFirstMatch {
+		return !me.excludes[matches[0]]
+	}
+	for _, i := range matches {
+		if me.excludes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (me *Recorder) filter(topic string) bool {
+	return me.filters.accept(topic)
+}
+
+// Number of received topics matched per filter pattern (since the start or
+// the last configuration change).
+func (me *Recorder) FilterStats() []FilterStat {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	stats := make([]FilterStat, 0, len(me.filters.patterns))
+	for i, pattern := range me.filters.patterns {
+		stats = append(stats, FilterStat{Pattern: pattern, Topics: me.filters.counts[i]})
+	}
+	return stats
+}
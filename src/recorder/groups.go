@@ -0,0 +1,184 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"mqttrack/codec"
+	"mqttrack/fnmatch"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maps several topics into one multi-column CSV file with header, e.g.
+// pattern "plug?/*", file "{1}.csv", columns ["power", "current"] records
+// `plug1/power` and `plug1/current` in `plug1.csv` as `time,power,current`.
+type GroupRule struct {
+	Pattern        string   `json:"pattern"`          // fnmatch per topic segment, wildcard segments are captured as {1}, {2}, ...
+	File           string   `json:"file"`             // Group file path template, e.g. "{1}.csv"
+	Column         string   `json:"column"`           // Column name template, default: last capture
+	Columns        []string `json:"columns"`          // Column order, topics with other column names are not grouped
+	KeepTopicFiles bool     `json:"keep_topic_files"` // Write the individual topic files as well
+}
+
+type groupFile struct {
+	values []string // Last values, carried forward
+}
+
+func (me *GroupRule) Validate() error {
+	if me.File == "" {
+		return fmt.Errorf("group rule for '%s': missing file", me.Pattern)
+	} else if len(me.Columns) == 0 {
+		return fmt.Errorf("group rule for '%s': missing columns", me.Pattern)
+	}
+	for i, col := range me.Columns {
+		if col == "" || col == "time" || slices.Contains(me.Columns[:i], col) {
+			return fmt.Errorf("group rule for '%s': invalid or duplicate column name '%s'", me.Pattern, col)
+		}
+	}
+	return nil
+}
+
+// Matches the topic segment wise and returns the captured wildcard segments,
+// nil if not matching.
+func (me *GroupRule) match(topic string) []string {
+	patterns := strings.Split(me.Pattern, "/")
+	segments := strings.Split(topic, "/")
+	if len(patterns) != len(segments) {
+		return nil
+	}
+	captures := make([]string, 0, 2)
+	for i, pattern := range patterns {
+		if !fnmatch.Match(pattern, segments[i], fnmatch.FNM_NOESCAPE) {
+			return nil
+		} else if strings.ContainsAny(pattern, "*?[") {
+			captures = append(captures, segments[i])
+		}
+	}
+	return captures
+}
+
+func expandCaptures(template string, captures []string) string {
+	for i := len(captures); i > 0; i-- {
+		template = strings.ReplaceAll(template, "{"+strconv.Itoa(i)+"}", captures[i-1])
+	}
+	return template
+}
+
+// Returns the group rule, group file path and column index for a topic,
+// nil if the topic is not grouped.
+func (me *Recorder) group(topic string) (*GroupRule, string, int) {
+	for i := range me.settings.Groups {
+		rule := &me.settings.Groups[i]
+		captures := rule.match(topic)
+		if captures == nil {
+			continue
+		}
+		column := ""
+		if rule.Column != "" {
+			column = expandCaptures(rule.Column, captures)
+		} else if len(captures) > 0 {
+			column = captures[len(captures)-1]
+		}
+		if col := slices.Index(rule.Columns, column); col >= 0 {
+			return rule, expandCaptures(rule.File, captures), col
+		}
+	}
+	return nil, "", -1
+}
+
+func groupValue(data []byte) string {
+	if !codec.IsTextSafe(data) {
+		return "b64:" + base64.StdEncoding.EncodeToString(data)
+	}
+	return strings.ReplaceAll(string(data), "\n", "\\n")
+}
+
+func csvLine(fields []string) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(fields)
+	w.Flush()
+	return buf.Bytes()
+}
+
+// Loads the carried forward values from the last line of an existing group
+// file, fails if the file header does not match the configured columns.
+func loadGroupFile(filePath string, columns []string) (*groupFile, error) {
+	grp := &groupFile{values: make([]string, len(columns))}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return grp, nil // New file
+	}
+	header, err := csv.NewReader(f).Read()
+	f.Close()
+	if err != nil {
+		return grp, nil // Empty file
+	}
+	if !slices.Equal(header, append([]string{"time"}, columns...)) {
+		return nil, fmt.Errorf("group file '%s' header '%s' does not match the configured columns", filePath, strings.Join(header, ","))
+	}
+	if line := lastLine(filePath); line != nil {
+		if fields, err := csv.NewReader(bytes.NewReader(line)).Read(); err == nil && len(fields) == len(columns)+1 && fields[0] != "time" {
+			copy(grp.values, fields[1:])
+		}
+	}
+	return grp, nil
+}
+
+func (me *Recorder) writeGroup(rule *GroupRule, file string, column int, data Record) error {
+	filePath := path.Join(me.settings.RootDirectory, file)
+	grp, ok := me.groups[filePath]
+	if !ok {
+		var err error
+		if _, err = sanitizeTopic(file); err != nil {
+			return fmt.Errorf("invalid group file path: '%s'", file)
+		} else if grp, err = loadGroupFile(filePath, rule.Columns); err != nil {
+			return err
+		}
+		me.groups[filePath] = grp
+	}
+	grp.values[column] = groupValue(data.Data())
+
+	dir := path.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create group file directory '%s': %s", dir, err.Error())
+	}
+	if err := me.rotate(filePath); err != nil {
+		log.Print(err.Error())
+	}
+
+	start := time.Now()
+	idx := me.index(filePath)
+	fos, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed write group file '%s': %s", filePath, err.Error())
+	}
+	defer fos.Close()
+
+	text := []byte{}
+	offset := int64(0)
+	if st, err := fos.Stat(); err == nil && st.Size() == 0 {
+		text = csvLine(append([]string{"time"}, rule.Columns...))
+	} else if err == nil {
+		offset = st.Size()
+	}
+	row := csvLine(append([]string{me.timestamp(data.Time())}, grp.values...))
+	text = append(text, row...)
+	if n, err := fos.Write(text); err != nil {
+		return fmt.Errorf("failed to write group file '%s', %s", filePath, err.Error())
+	} else if n != len(text) {
+		return fmt.Errorf("failed to write all bytes of group file '%s'", filePath)
+	}
+	me.indexWrite(filePath, idx, data.Time(), offset+int64(len(text)-len(row)), int64(len(row)))
+	metricWriteDurations.Observe(time.Since(start).Seconds())
+	metricLinesWritten.Inc()
+	metricBytesWritten.Add(uint64(len(text)))
+	return nil
+}
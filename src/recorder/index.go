@@ -0,0 +1,67 @@
+package recorder
+
+import (
+	"log"
+	"mqttrack/archive"
+	"time"
+)
+
+type fileIndex struct {
+	index *archive.Index
+	dirty bool // Changes not saved yet
+}
+
+// Returns the (cached) sidecar index of a record file, nil if disabled.
+func (me *Recorder) index(filePath string) *fileIndex {
+	if me.settings.DisableIndex {
+		return nil
+	}
+	if fi, ok := me.indexes[filePath]; ok {
+		return fi
+	}
+	idx, err := archive.LoadIndex(filePath)
+	if err != nil {
+		log.Print("Failed to load index of '", filePath, "': ", err.Error())
+	}
+	fi := &fileIndex{index: idx, dirty: err != nil}
+	me.indexes[filePath] = fi
+	return fi
+}
+
+func (me *Recorder) saveIndex(filePath string, fi *fileIndex) {
+	if err := fi.index.Save(filePath); err != nil {
+		log.Print(err.Error())
+		return
+	}
+	fi.dirty = false
+}
+
+// Updates the index after a line was appended to the record file. The index
+// must be obtained before writing. It is saved when a sparse offset was added,
+// otherwise on rotation and close.
+func (me *Recorder) indexWrite(filePath string, fi *fileIndex, t time.Time, offset int64, size int64) {
+	if fi == nil {
+		return
+	} else if fi.index.Append(t, offset, size) {
+		me.saveIndex(filePath, fi)
+	} else {
+		fi.dirty = true
+	}
+}
+
+// Updates the index after the record file was renamed to `<file>.<rotindex>`.
+func (me *Recorder) indexRotate(filePath string, fi *fileIndex, rotindex int) {
+	if fi == nil {
+		return
+	}
+	fi.index.Rotate(rotindex)
+	me.saveIndex(filePath, fi)
+}
+
+func (me *Recorder) flushIndexes() {
+	for filePath, fi := range me.indexes {
+		if fi.dirty {
+			me.saveIndex(filePath, fi)
+		}
+	}
+}
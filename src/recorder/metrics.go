@@ -0,0 +1,19 @@
+package recorder
+
+import "mqttrack/metrics"
+
+var (
+	metricFiltered       = metrics.NewCounter("mqttrack_messages_filtered_total", "Messages dropped by the topic filters.")
+	metricUnchanged      = metrics.NewCounter("mqttrack_messages_unchanged_total", "Messages skipped because the value did not change.")
+	metricOutOfOrder     = metrics.NewCounter("mqttrack_messages_out_of_order_total", "Messages older than the last line of the record file.")
+	metricRejected       = metrics.NewCounter("mqttrack_messages_rejected_total", "Out-of-order messages dropped.")
+	metricLinesWritten   = metrics.NewCounter("mqttrack_lines_written_total", "Lines appended to record and group files.")
+	metricBytesWritten   = metrics.NewCounter("mqttrack_bytes_written_total", "Bytes appended to record and group files.")
+	metricWriteErrors    = metrics.NewCounter("mqttrack_write_errors_total", "Failed record writes.")
+	metricRotations      = metrics.NewCounter("mqttrack_rotations_total", "Rotated record files.")
+	metricRotateErrors   = metrics.NewCounter("mqttrack_rotate_errors_total", "Failed record file rotations.")
+	metricExpired        = metrics.NewCounter("mqttrack_files_expired_total", "Rotated files deleted due to the retention time.")
+	metricGZipFailures   = metrics.NewCounter("mqttrack_gzip_failures_total", "Failed compressions of rotated record files.")
+	metricWriteDurations = metrics.NewHistogram("mqttrack_write_duration_seconds", "Duration of appending a line to a record or group file.",
+		[]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1})
+)
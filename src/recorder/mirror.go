@@ -0,0 +1,60 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mqttrack/codec"
+	"mqttrack/metrics"
+	"strings"
+)
+
+// Publishes messages, e.g. a connected mqttnode.Node.
+type Publisher interface {
+	Publish(topic string, data []byte, qos byte, retain bool) error
+}
+
+var metricMirrorErrors = metrics.NewCounter("mqttrack_mirror_errors_total", "Failed publications of mirror topics.")
+
+func validateMirrorTopic(topic string) error {
+	if topic == "" {
+		return nil
+	} else if strings.ContainsAny(topic, "+#") || strings.HasPrefix(topic, "/") || strings.HasSuffix(topic, "/") {
+		return fmt.Errorf("invalid mirror topic: '%s'", topic)
+	}
+	return nil
+}
+
+// Sets the publisher for the mirror topics, nil disables publishing.
+func (me *Recorder) SetPublisher(publisher Publisher) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.publisher = publisher
+}
+
+// Loop protection, the own mirror topics are never recorded.
+func (me *Recorder) isMirrorTopic(topic string) bool {
+	prefix := me.settings.MirrorTopic
+	return prefix != "" && (topic == prefix || strings.HasPrefix(topic, prefix+"/"))
+}
+
+// Publishes the last written value of a topic retained to
+// `<mirror_topic>/<topic>` as `{"t":...,"v":...,"file":...}`.
+func (me *Recorder) mirror(topic string, data Record, filePath string) {
+	if me.settings.MirrorTopic == "" || me.publisher == nil {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"t":`)
+	buf.Write(codec.JSONTime(me.timestamp(data.Time())))
+	buf.WriteString(`,`)
+	codec.WriteJSONValue(&buf, data.Data())
+	fp, _ := json.Marshal(filePath)
+	buf.WriteString(`,"file":`)
+	buf.Write(fp)
+	buf.WriteString(`}`)
+	if err := me.publisher.Publish(me.settings.MirrorTopic+"/"+topic, buf.Bytes(), 0, true); err != nil {
+		metricMirrorErrors.Inc()
+		me.logVerbose("Mirror publish failed: ", err.Error())
+	}
+}
@@ -0,0 +1,167 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"mqttrack/archive"
+	"mqttrack/codec"
+	"mqttrack/timefmt"
+	"mqttrack/topicfilter"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Per-pattern overrides of the recording settings. All matching policies
+// apply in list order, later ones override the values set by earlier ones.
+type Policy struct {
+	Pattern          string            `json:"pattern"`                  // fnmatch, MQTT or `re:` pattern of topics or group files
+	Enabled          *bool             `json:"enabled,omitempty"`        // false: not recorded
+	RotationFileSize *uint             `json:"rotate_at_size,omitempty"` // kB, 0: no rotation
+	GZipRotated      *bool             `json:"gzip_rotated,omitempty"`   // Compress rotated files
+	Encoding         *string           `json:"encoding,omitempty"`       // Overrides also the `encodings` rules
+	Deadband         *float64          `json:"deadband,omitempty"`       // Numeric changes less than this count as unchanged
+	Heartbeat        *timefmt.Duration `json:"heartbeat,omitempty"`      // Record unchanged values at least in this interval
+	Retention        *timefmt.Duration `json:"retention,omitempty"`      // Delete rotated files older than this
+}
+
+func (me *Policy) Validate() error {
+	if _, err := topicfilter.Compile(me.Pattern); err != nil {
+		return fmt.Errorf("policy for '%s': %s", me.Pattern, err.Error())
+	} else if me.Encoding != nil && !codec.Valid(*me.Encoding) {
+		return fmt.Errorf("policy for '%s': invalid encoding '%s'", me.Pattern, *me.Encoding)
+	} else if me.Deadband != nil && *me.Deadband < 0 {
+		return fmt.Errorf("policy for '%s': negative deadband", me.Pattern)
+	} else if me.Heartbeat != nil && *me.Heartbeat < 0 {
+		return fmt.Errorf("policy for '%s': negative heartbeat", me.Pattern)
+	} else if me.Retention != nil && *me.Retention <= 0 {
+		return fmt.Errorf("policy for '%s': retention must be positive", me.Pattern)
+	}
+	return nil
+}
+
+// Effective recording settings of a topic or group file.
+type policy struct {
+	enabled    bool
+	rotateSize uint
+	gzip       bool
+	encoding   string
+	deadband   float64
+	heartbeat  time.Duration
+	retention  time.Duration
+}
+
+// Compiled policies with per-topic resolution cache, rebuilt on
+// configuration changes.
+type policies struct {
+	rules    []Policy
+	patterns []*topicfilter.Pattern
+	cache    map[string]*policy
+}
+
+func newPolicies(rules []Policy) *policies {
+	me := &policies{rules: rules, cache: make(map[string]*policy)}
+	for _, rule := range rules {
+		pattern, _ := topicfilter.Compile(rule.Pattern) // nil (never matching) if invalid, reported by Validate()
+		me.patterns = append(me.patterns, pattern)
+	}
+	return me
+}
+
+// Returns the (cached) effective settings of a topic, or a group file path
+// relative to the root directory.
+func (me *Recorder) policy(topic string) *policy {
+	if pol, ok := me.policies.cache[topic]; ok {
+		return pol
+	}
+	pol := &policy{
+		enabled:    true,
+		rotateSize: me.settings.RotationFileSize,
+		gzip:       me.settings.GZipRotated,
+		encoding:   me.encoding(topic),
+	}
+	for i, rule := range me.policies.rules {
+		if p := me.policies.patterns[i]; p == nil || !p.Match(topic) {
+			continue
+		}
+		if rule.Enabled != nil {
+			pol.enabled = *rule.Enabled
+		}
+		if rule.RotationFileSize != nil {
+			pol.rotateSize = *rule.RotationFileSize
+		}
+		if rule.GZipRotated != nil {
+			pol.gzip = *rule.GZipRotated
+		}
+		if rule.Encoding != nil {
+			pol.encoding = *rule.Encoding
+		}
+		if rule.Deadband != nil {
+			pol.deadband = *rule.Deadband
+		}
+		if rule.Heartbeat != nil {
+			pol.heartbeat = rule.Heartbeat.D()
+		}
+		if rule.Retention != nil {
+			pol.retention = rule.Retention.D()
+		}
+	}
+	if len(me.policies.cache) < MaxFilterCacheSize {
+		me.policies.cache[topic] = pol
+	}
+	return pol
+}
+
+// Policy of a record or group file path.
+func (me *Recorder) filePolicy(filePath string) *policy {
+	return me.policy(strings.TrimPrefix(filePath, me.settings.RootDirectory+"/"))
+}
+
+// Change detection: Equal payloads, or numeric values within the deadband
+// of the last written value, unless the heartbeat interval elapsed.
+func (me *policy) unchanged(prev Record, data Record) bool {
+	if prev == nil {
+		return false
+	} else if me.heartbeat > 0 && data.Time().Sub(prev.Time()) >= me.heartbeat {
+		return false
+	} else if bytes.Equal(prev.Data(), data.Data()) {
+		return true
+	} else if me.deadband <= 0 {
+		return false
+	}
+	a, erra := strconv.ParseFloat(string(bytes.TrimSpace(prev.Data())), 64)
+	b, errb := strconv.ParseFloat(string(bytes.TrimSpace(data.Data())), 64)
+	return erra == nil && errb == nil && math.Abs(a-b) < me.deadband
+}
+
+// Deletes rotated files of a record file that were last modified before the
+// retention time.
+func (me *Recorder) expire(filePath string, fi *fileIndex, retention time.Duration) {
+	files, err := archive.Files(path.Dir(filePath), path.Base(filePath))
+	if err != nil {
+		return
+	}
+	changed := false
+	for _, file := range files {
+		if file.Index == 0 {
+			continue
+		} else if st, err := os.Stat(file.Path); err != nil || time.Since(st.ModTime()) < retention {
+			continue
+		} else if err := os.Remove(file.Path); err != nil {
+			me.logVerbose("Failed to remove expired file: ", err.Error())
+			continue
+		}
+		me.logVerbose("Removed expired file: ", file.Path)
+		metricExpired.Inc()
+		if fi != nil {
+			fi.index.Remove(file.Index)
+			changed = true
+		}
+	}
+	if changed {
+		me.saveIndex(filePath, fi)
+	}
+}
@@ -1,17 +1,21 @@
 package recorder
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"mqttrack/codec"
 	"mqttrack/fnmatch"
+	"mqttrack/sparkplug"
+	"mqttrack/timefmt"
 	"os"
 	"os/exec"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unicode"
@@ -27,32 +31,167 @@ type Record interface {
 	Data() []byte
 }
 
+type record struct {
+	time  time.Time
+	topic string
+	data  []byte
+}
+
+func (me record) Time() time.Time {
+	return me.time
+}
+
+func (me record) Topic() string {
+	return me.topic
+}
+
+func (me record) Data() []byte {
+	return me.data
+}
+
+func NewRecord(t time.Time, topic string, data []byte) Record {
+	return record{time: t, topic: topic, data: data}
+}
+
+type EncodingRule struct {
+	Pattern  string `json:"pattern"`
+	Encoding string `json:"encoding"`
+}
+
 type Settings struct {
-	RootDirectory    string   `json:"rootdir"`
-	RotationFileSize uint     `json:"rotate_at_size"`
-	GZipRotated      bool     `json:"gzip_rotated"`
-	TopicFilters     []string `json:"filters"`
-	Verbose          bool     `json:"-"`
+	RootDirectory     string          `json:"rootdir"`
+	RotationFileSize  uint            `json:"rotate_at_size"`
+	GZipRotated       bool            `json:"gzip_rotated"`
+	TopicFilters      []string        `json:"filters"`                      // fnmatch patterns, `!pattern` excludes
+	FilterMode        string          `json:"filter_mode,omitempty"`        // exclude_wins (default)|first_match
+	TimestampFormat   string          `json:"timestamp_format"`             // unix|unix_ms|unix_us|rfc3339|rfc3339nano|local
+	TimestampDecimals *uint           `json:"timestamp_decimals,omitempty"` // nil: default of the format
+	Encoding          string          `json:"encoding"`                     // csv|jsonl|base64|hex
+	Encodings         []EncodingRule  `json:"encodings,omitempty"`          // First matching pattern wins, default `Encoding`
+	Sparkplug         bool            `json:"sparkplug"`                    // Decode spBv1.0 topics into metric topics
+	TimestampRules    []TimestampRule `json:"timestamp_rules,omitempty"`    // First matching pattern wins
+	Groups            []GroupRule     `json:"groups,omitempty"`             // Multi-column group files, first matching rule wins
+	DisableIndex      bool            `json:"disable_index"`                // No `.<name>.idx` sidecar files
+	MirrorTopic       string          `json:"mirror_topic,omitempty"`       // Publish last written values retained to `<mirror_topic>/<topic>`
+	Policies          []Policy        `json:"policies,omitempty"`           // Per-pattern overrides, all matching apply in order
+	Transforms        []Transform     `json:"transforms,omitempty"`         // Payload transformations, first matching pattern wins
+	Scripts           []ScriptRule    `json:"scripts,omitempty"`            // Decoding scripts, first matching pattern wins
+	Derived           []DerivedRule   `json:"derived,omitempty"`            // Virtual topics computed from received values, all matching apply
+	Rollups           []RollupRule    `json:"rollups,omitempty"`            // Downsampled `<topic>@<interval>` files, first matching rule wins
+	Verbose           bool            `json:"-"`
+}
+
+func (me *Settings) Validate() error {
+	if tf := me.TimestampFormat; tf != "" && !timefmt.Valid(tf) {
+		return fmt.Errorf("invalid timestamp format: '%s'", tf)
+	}
+	if err := validateFilters(me.TopicFilters, me.FilterMode); err != nil {
+		return err
+	}
+	if !codec.Valid(me.Encoding) {
+		return fmt.Errorf("invalid record encoding: '%s'", me.Encoding)
+	}
+	for _, rule := range me.Encodings {
+		if !codec.Valid(rule.Encoding) {
+			return fmt.Errorf("invalid record encoding for '%s': '%s'", rule.Pattern, rule.Encoding)
+		}
+	}
+	for _, rule := range me.TimestampRules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range me.Groups {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range me.Policies {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range me.Transforms {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range me.Scripts {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range me.Derived {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range me.Rollups {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return validateMirrorTopic(me.MirrorTopic)
+}
+
+type Stats struct {
+	RotateErrors uint64 // Rotation/compression errors
+	OutOfOrder   uint64 // Lines older than the last line of the record file
+	Rejected     uint64 // Out-of-order lines dropped
 }
 
 type Recorder struct {
+	mu              sync.Mutex // Access from other goroutines (e.g. HTTP API)
 	settings        Settings
-	cache           map[string]Record
+	cache           map[string]Record // Last received
+	written         map[string]Record // Last written
+	lastWritten     map[string]time.Time
+	lastSeen        map[string]time.Time
+	filters         *topicFilter
+	policies        *policies
+	transforms      []compiledTransform
+	scripts         []compiledScript
+	derived         *derivedSeries
+	rollups         *rollups
+	groups          map[string]*groupFile
+	indexes         map[string]*fileIndex
+	sparkplug       *sparkplug.Decoder
+	publisher       Publisher
 	isopen          bool
 	numRotateErrors atomic.Uint32
+	numOutOfOrder   atomic.Uint64
+	numRejected     atomic.Uint64
 }
 
 func New(settings Settings) Recorder {
+	var spdecoder *sparkplug.Decoder = nil
+	if settings.Sparkplug {
+		spdecoder = sparkplug.NewDecoder()
+	}
+	filters, _ := newTopicFilter(settings.TopicFilters, settings.FilterMode) // Errors reported by Open()
 	return Recorder{
 		settings:        settings,
 		cache:           make(map[string]Record),
+		written:         make(map[string]Record),
+		lastWritten:     make(map[string]time.Time),
+		lastSeen:        make(map[string]time.Time),
+		filters:         filters,
+		policies:        newPolicies(settings.Policies),
+		transforms:      newTransforms(settings.Transforms),
+		scripts:         newScripts(settings.Scripts),
+		derived:         newDerivedSeries(settings.Derived),
+		rollups:         newRollups(settings.Rollups),
+		groups:          make(map[string]*groupFile),
+		indexes:         make(map[string]*fileIndex),
+		sparkplug:       spdecoder,
 		isopen:          false,
 		numRotateErrors: atomic.Uint32{}, // Log spam prevention
 	}
 }
 
 func (me *Recorder) rotate(filepath string) error {
-	if me.settings.RotationFileSize <= 0 || uint(me.numRotateErrors.Load()) > MaxNumRotateErrors {
+	pol := me.filePolicy(filepath)
+	if pol.rotateSize <= 0 || uint(me.numRotateErrors.Load()) > MaxNumRotateErrors {
 		return nil
 	}
 
@@ -64,13 +203,15 @@ func (me *Recorder) rotate(filepath string) error {
 		}
 	} else if !st.Mode().IsRegular() {
 		me.numRotateErrors.Add(1)
+		metricRotateErrors.Inc()
 		return fmt.Errorf("record file unexpectedly not a file: %s", filepath)
-	} else if st.Size()/1024 < int64(me.settings.RotationFileSize) {
+	} else if st.Size()/1024 < int64(pol.rotateSize) {
 		return nil
 	}
 
 	if ls, err := os.ReadDir(path.Dir(filepath)); err != nil {
 		me.numRotateErrors.Add(1)
+		metricRotateErrors.Inc()
 		return fmt.Errorf("reading directory for record rotating failed: %s", path.Dir(filepath))
 	} else {
 		rotindex := 0
@@ -92,12 +233,19 @@ func (me *Recorder) rotate(filepath string) error {
 		rotindex += 1
 		newpath := fmt.Sprintf("%s.%d", filepath, rotindex)
 		me.logVerbose("Rotating: ", filepath, "->", newpath)
+		idx := me.index(filepath)
 		if err := os.Rename(filepath, newpath); err != nil {
 			me.numRotateErrors.Add(1)
+			metricRotateErrors.Inc()
 			return fmt.Errorf("renaming record file failed %s->%s: %s", filepath, newpath, err.Error())
 		}
+		me.indexRotate(filepath, idx, rotindex)
+		metricRotations.Inc()
+		if pol.retention > 0 {
+			me.expire(filepath, idx, pol.retention)
+		}
 		lastrec := fmt.Sprintf("%s.%d", filepath, rotindex-1)
-		if st, err := os.Stat(lastrec); err != nil {
+		if st, err := os.Stat(lastrec); err != nil || !pol.gzip {
 			return nil
 		} else if st.Mode().IsRegular() {
 			if err := me.gzip(lastrec); err != nil {
@@ -108,26 +256,24 @@ func (me *Recorder) rotate(filepath string) error {
 	return nil
 }
 
-func (me *Recorder) filter(topic string) bool {
-	if len(me.settings.TopicFilters) == 0 {
-		return true
-	}
-	for _, pattern := range me.settings.TopicFilters {
-		if fnmatch.Match(pattern, topic, fnmatch.FNM_NOESCAPE) {
-			return true
+func (me *Recorder) encoding(topic string) string {
+	for _, rule := range me.settings.Encodings {
+		if fnmatch.Match(rule.Pattern, topic, fnmatch.FNM_NOESCAPE) {
+			return rule.Encoding
 		}
 	}
-	return false
+	return me.settings.Encoding
 }
 
 func (me *Recorder) gzip(filepath string) error {
-	if !me.settings.GZipRotated || uint(me.numRotateErrors.Load()) > MaxNumRotateErrors {
+	if uint(me.numRotateErrors.Load()) > MaxNumRotateErrors {
 		return nil
 	}
 	me.logVerbose("GZipping ", filepath)
 	cmd := exec.Command("gzip", "-9", filepath)
 	if cmd.Err != nil {
 		me.numRotateErrors.Add(1)
+		metricGZipFailures.Inc()
 		return cmd.Err
 	}
 	go func() {
@@ -135,8 +281,7 @@ func (me *Recorder) gzip(filepath string) error {
 		defer zipping.Store(false)
 		if err := cmd.Run(); err != nil {
 			me.numRotateErrors.Add(1)
-		} else if err := cmd.Wait(); err != nil {
-			me.numRotateErrors.Add(1)
+			metricGZipFailures.Inc()
 		}
 	}()
 	return nil
@@ -156,6 +301,8 @@ func (me *Recorder) Open() error {
 		return fmt.Errorf("data root directory does not exist or not accessible: %s (error=%s)", dir, err.Error())
 	} else if !st.IsDir() {
 		return fmt.Errorf("data root is not a directory: %s", dir)
+	} else if err := me.settings.Validate(); err != nil {
+		return err
 	} else {
 		me.logVerbose("Recorder opened.")
 	}
@@ -163,79 +310,273 @@ func (me *Recorder) Open() error {
 	return nil
 }
 
+func (me *Recorder) timestamp(t time.Time) string {
+	decimals := -1
+	if me.settings.TimestampDecimals != nil {
+		decimals = int(*me.settings.TimestampDecimals)
+	}
+	return timefmt.Format(t, me.settings.TimestampFormat, decimals)
+}
+
 func (me *Recorder) Close() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
 	me.isopen = false
 	me.cache = make(map[string]Record)
+	me.written = make(map[string]Record)
+	me.lastWritten = make(map[string]time.Time)
+	me.lastSeen = make(map[string]time.Time)
+	me.groups = make(map[string]*groupFile)
+	me.flushRollups()
+	me.flushIndexes()
+	me.indexes = make(map[string]*fileIndex)
 }
 
-func (me *Recorder) Write(data Record) error {
-	if !me.isopen {
-		panic("Recorder not initialized")
+// Writes the open rollup buckets periodically, called by the service loop.
+func (me *Recorder) Flush() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.isopen {
+		me.writeRollups(rollupFlushInterval)
+	}
+}
+
+// Applies changed settings at runtime. The latest values are kept, file
+// related states (indexes, group values, rollup buckets) are flushed and
+// reloaded on demand.
+func (me *Recorder) Reconfigure(settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	} else if st, err := os.Stat(settings.RootDirectory); err != nil || !st.IsDir() {
+		return fmt.Errorf("data root directory does not exist or is not a directory: %s", settings.RootDirectory)
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	settings.Verbose = me.settings.Verbose
+	if !settings.Sparkplug {
+		me.sparkplug = nil
+	} else if me.sparkplug == nil {
+		me.sparkplug = sparkplug.NewDecoder()
+	}
+	me.flushRollups()
+	me.flushIndexes()
+	me.settings = settings
+	me.lastWritten = make(map[string]time.Time)
+	me.filters, _ = newTopicFilter(settings.TopicFilters, settings.FilterMode)
+	me.policies = newPolicies(settings.Policies)
+	me.transforms = newTransforms(settings.Transforms)
+	me.scripts = newScripts(settings.Scripts)
+	me.derived = newDerivedSeries(settings.Derived)
+	me.rollups = newRollups(settings.Rollups)
+	me.groups = make(map[string]*groupFile)
+	me.indexes = make(map[string]*fileIndex)
+	me.numRotateErrors.Store(0)
+	me.logVerbose("Recorder reconfigured.")
+	return nil
+}
+
+func (me *Recorder) RootDirectory() string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.settings.RootDirectory
+}
+
+// Composes a timestamp in the configured format.
+func (me *Recorder) Timestamp(t time.Time) string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.timestamp(t)
+}
+
+// Receive times of the last messages of all recorded topics.
+func (me *Recorder) LastSeen() map[string]time.Time {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return maps.Clone(me.lastSeen)
+}
+
+// Returns the last received record of a topic.
+func (me *Recorder) Latest(topic string) (Record, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	rec, ok := me.cache[strings.Trim(topic, "/.")]
+	return rec, ok
+}
+
+// Returns the last received records of all topics matching the fnmatch pattern.
+func (me *Recorder) LatestMatching(pattern string) map[string]Record {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	recs := make(map[string]Record)
+	for topic, rec := range me.cache {
+		if fnmatch.Match(pattern, topic, fnmatch.FNM_NOESCAPE) {
+			recs[topic] = rec
+		}
+	}
+	return recs
+}
+
+func (me *Recorder) Stats() Stats {
+	return Stats{
+		RotateErrors: uint64(me.numRotateErrors.Load()),
+		OutOfOrder:   me.numOutOfOrder.Load(),
+		Rejected:     me.numRejected.Load(),
 	}
+}
 
-	topic := strings.Trim(data.Topic(), "/.")
+func sanitizeTopic(topic string) (string, error) {
+	topic = strings.Trim(topic, "/.")
 	if topic == "" || strings.Contains(topic, "..") || strings.ContainsFunc(topic, func(ch rune) bool {
 		return !unicode.IsPrint(ch) || unicode.IsControl(ch)
 	}) {
-		return fmt.Errorf("invalid topic path: '%s'", topic)
+		return topic, fmt.Errorf("invalid topic path: '%s'", topic)
+	}
+	return topic, nil
+}
+
+func (me *Recorder) Write(data Record) error {
+	if !me.isopen {
+		panic("Recorder not initialized")
 	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	topic, err := sanitizeTopic(data.Topic())
+	if err == nil && me.isMirrorTopic(topic) {
+		me.logVerbose("Mirror topic ignored: ", topic)
+		return nil
+	} else if err == nil {
+		if me.sparkplug != nil && sparkplug.IsTopic(topic) {
+			err = me.writeSparkplug(topic, data)
+		} else if s := me.script(topic); s != nil {
+			err = me.writeScripted(s, topic, data)
+		} else {
+			err = me.write(topic, data)
+		}
+	}
+	if err != nil {
+		metricWriteErrors.Inc()
+	}
+	return err
+}
 
+func (me *Recorder) writeSparkplug(topic string, data Record) error {
+	samples, err := me.sparkplug.Decode(topic, data.Data(), data.Time())
+	for _, sample := range samples {
+		mtopic, merr := sanitizeTopic(sample.Topic)
+		if merr == nil {
+			merr = me.write(mtopic, NewRecord(sample.Time, mtopic, sample.Value))
+		}
+		if merr != nil {
+			err = errors.Join(err, merr)
+		}
+	}
+	return err
+}
+
+func (me *Recorder) write(topic string, data Record) error {
 	if !me.filter(topic) {
 		me.logVerbose("Topic filtered out: ", topic)
+		metricFiltered.Inc()
 		return nil
 	}
+	me.lastSeen[topic] = data.Time()
+
+	tsrule := me.timestampRule(topic)
+	if tsrule != nil {
+		data = NewRecord(me.deviceTime(tsrule, data), data.Topic(), data.Data())
+	}
+
+	data, raw := me.transform(topic, data)
+	me.derive(topic, data)
+
+	pol := me.policy(topic)
+	if !pol.enabled {
+		me.logVerbose("Topic disabled by policy: ", topic)
+		metricFiltered.Inc()
+		return nil
+	}
+
+	filePath := path.Join(me.settings.RootDirectory, topic)
+	rule, file, column := me.group(topic)
+	grouped := rule != nil && !rule.KeepTopicFiles
+	rejected := tsrule != nil && tsrule.OutOfOrder == OutOfOrderReject && data.Time().Before(me.lastWriteTime(topic, filePath))
+	if !grouped && !rejected {
+		me.rollup(topic, filePath, data) // Also unchanged values
+	}
 
 	ct := me.cache[topic]
-	unchanged := ct != nil && bytes.Equal(ct.Data(), data.Data())
 	me.cache[topic] = data
-	if unchanged {
-		// Todo: Minimal interval to log also same values.
-		// Todo: Maybe floating point compare with threshold?
+	if pol.unchanged(me.written[topic], data) {
 		me.logVerbose("Topic unchanged: " + topic)
+		metricUnchanged.Inc()
 		return nil
 	}
 
-	filePath := path.Join(me.settings.RootDirectory, topic)
+	if rule != nil {
+		err := me.writeGroup(rule, file, column, data)
+		if !rule.KeepTopicFiles {
+			if err == nil {
+				me.written[topic] = data
+				me.mirror(topic, data, path.Join(me.settings.RootDirectory, file))
+			}
+			return err
+		} else if err != nil {
+			log.Print(err.Error())
+		}
+	}
+
 	dir := path.Dir(filePath)
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create topic directory '%s': %s", dir, err.Error())
 	}
 
+	if data.Time().Before(me.lastWriteTime(topic, filePath)) {
+		me.numOutOfOrder.Add(1)
+		metricOutOfOrder.Inc()
+		if tsrule != nil && tsrule.OutOfOrder == OutOfOrderReject {
+			me.numRejected.Add(1)
+			metricRejected.Inc()
+			me.cache[topic] = ct
+			me.logVerbose("Out-of-order record rejected: ", topic)
+			return nil
+		}
+		me.logVerbose("Out-of-order record appended: ", topic)
+	}
+
 	if err := me.rotate(filePath); err != nil {
 		log.Print(err.Error())
 	}
 
+	start := time.Now()
+	idx := me.index(filePath)
 	fos, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return fmt.Errorf("failed write topic file '%s': %s", filePath, err.Error())
 	}
 	defer fos.Close()
 
-	ts := float64(data.Time().UnixMilli()) * 1e-3
-	da := data.Data()
-	if bytes.ContainsAny(da, "\n") {
-		// Todo: There must be a better way for this, something like array.map() with insert option,
-		// -> slices.Whatever()?
-		me.logVerbose("Topic data need newline escaping: " + topic)
-		dac := make([]byte, 0, len(da)*2)
-		for _, v := range da {
-			if v != '\n' {
-				dac = append(dac, v)
-			} else {
-				dac = append(dac, '\\')
-				dac = append(dac, 'n')
-			}
-		}
-		da = dac
+	offset := int64(0)
+	if st, err := fos.Stat(); err == nil {
+		offset = st.Size()
 	}
-
-	s := fmt.Sprintf("%13.2f,%s\n", ts, da)
-	if n, err := fos.WriteString(s); err != nil {
+	line := codec.Encode(pol.encoding, me.timestamp(data.Time()), data.Data())
+	if raw != nil {
+		line = codec.EncodeRaw(pol.encoding, me.timestamp(data.Time()), data.Data(), raw)
+	}
+	if n, err := fos.Write(line); err != nil {
 		return fmt.Errorf("failed to write topic file '%s', %s", topic, err.Error())
-	} else if n != len(s) {
+	} else if n != len(line) {
 		return fmt.Errorf("failed to write all bytes of topic file '%s'", topic)
 	}
+	me.indexWrite(filePath, idx, data.Time(), offset, int64(len(line)))
+	metricWriteDurations.Observe(time.Since(start).Seconds())
+	metricLinesWritten.Inc()
+	metricBytesWritten.Add(uint64(len(line)))
+	me.mirror(topic, data, filePath)
 
+	me.lastWritten[topic] = data.Time()
+	me.written[topic] = data
 	return nil
 }
@@ -1,13 +1,22 @@
 package recorder
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"math"
 	"math/rand/v2"
+	"mqttrack/archive"
+	"mqttrack/codec"
+	"mqttrack/fnmatch"
+	"mqttrack/metrics"
+	"mqttrack/timefmt"
 	"os"
 	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
@@ -389,4 +398,1085 @@ func TestRotate(t *testing.T) {
 	}
 }
 
+func TestTimestampFormats(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	decimals := func(n uint) *uint { return &n }
+	tests := []struct {
+		format   string
+		decimals *uint
+		expected string
+	}{
+		{"", nil, "1577840400.12"},
+		{"unix_ms", decimals(3), "1577840400123.457"},
+		{"rfc3339nano", decimals(3), "2020-01-01T01:00:00.123Z"},
+	}
+	trec := time.Date(2020, time.January, 1, 1, 0, 0, 123456789, time.UTC)
+
+	for i, test := range tests {
+		rec := New(Settings{
+			RootDirectory:     root,
+			TimestampFormat:   test.format,
+			TimestampDecimals: test.decimals,
+		})
+		if err := rec.Open(); err != nil {
+			t.Fatal("Recorder open failed (unexpected): ", err)
+		}
+		topic := fmt.Sprintf("ts-format-%d", i)
+		if err := rec.Write(TestRecord{TimeVal: trec, TopicVal: topic, DataVal: []byte("1")}); err != nil {
+			t.Errorf("Unexpected write fail: %v\n", err)
+			continue
+		}
+		txt, _ := os.ReadFile(path.Join(root, topic))
+		lines := strings.Split(strings.TrimRight(string(txt), "\n"), "\n")
+		if len(lines) != 1 || !strings.HasSuffix(lines[0], ",1") {
+			t.Errorf("Expected one 'timestamp,1' line in '%s', got '%s'", topic, txt)
+			continue
+		}
+		if ts := strings.TrimSuffix(lines[0], ",1"); ts != test.expected {
+			t.Errorf("Timestamp format '%s' mismatch: '%s', expected '%s'", test.format, ts, test.expected)
+		}
+		rec.Close()
+	}
+
+	// Invalid format
+	rec := New(Settings{RootDirectory: root, TimestampFormat: "fortnights"})
+	if err := rec.Open(); err == nil {
+		t.Errorf("Expected error for invalid timestamp format")
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	rec := New(Settings{
+		RootDirectory: root,
+		Verbose:       true,
+		Encodings: []EncodingRule{
+			{Pattern: "json/*", Encoding: codec.JSONL},
+			{Pattern: "b64/*", Encoding: codec.Base64},
+			{Pattern: "hex/*", Encoding: codec.Hex},
+		},
+	})
+	if err := rec.Open(); err != nil {
+		t.Fatal("Recorder open failed (unexpected): ", err)
+	}
+	defer rec.Close()
+
+	tests := []struct {
+		topic    string
+		data     string
+		expected string // Data part of the line
+	}{
+		{"csv/text", "a,b\nc", "a,b\\nc"},
+		{"csv/binary", "\x00\xff\x01", "b64:AP8B"},
+		{"csv/ambiguous", "hex:01", "b64:aGV4OjAx"},
+		{"json/object", "{ \"a\": [1, 2] }", `"v":{"a":[1,2]}}`},
+		{"json/number", "12.50", `"v":12.50}`},
+		{"json/string", `"quoted"`, `"v":"\"quoted\""}`},
+		{"json/text", "ON", `"v":"ON"}`},
+		{"json/binary", "\xff\xfe", `"b64":"//4="}`},
+		{"b64/text", "ON", "b64:T04="},
+		{"hex/text", "ON", "hex:4f4e"},
+	}
+
+	for _, test := range tests {
+		if err := rec.Write(mkrecord(test.topic, test.data)); err != nil {
+			t.Errorf("Unexpected write fail: %v\n", err)
+			continue
+		}
+		txt, err := os.ReadFile(path.Join(root, test.topic))
+		if err != nil {
+			t.Errorf("Failed to read back '%s': %s", test.topic, err.Error())
+			continue
+		}
+		if !strings.HasSuffix(string(txt), test.expected+"\n") {
+			t.Errorf("Unexpected encoding of '%s': '%s', expected suffix '%s'", test.topic, txt, test.expected)
+		}
+		if line, err := codec.Decode(txt); err != nil {
+			t.Errorf("Failed to decode '%s': %s", txt, err.Error())
+		} else if string(line.Value) != test.data && !(test.topic == "json/object" || test.topic == "json/number") {
+			t.Errorf("Decoded value mismatch for '%s': '%s', expected '%s'", test.topic, line.Value, test.data)
+		} else if tp := parsetime(line.Time); !tp.Equal(mktime(false).Truncate(10 * time.Millisecond)) {
+			t.Errorf("Decoded time mismatch for '%s': '%s'", test.topic, line.Time)
+		}
+	}
+
+	rec.settings.Encoding = "xml"
+	if err := rec.settings.Validate(); err == nil {
+		t.Errorf("Expected error for invalid encoding")
+	}
+}
+
+// Minimal protobuf encoding for Sparkplug test payloads.
+func pbvarint(field uint64, v uint64) []byte {
+	b := binary.AppendUvarint(nil, field<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func pbbytes(field uint64, v []byte) []byte {
+	b := binary.AppendUvarint(nil, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func pbdouble(field uint64, v float64) []byte {
+	b := binary.AppendUvarint(nil, field<<3|1)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func pbpayload(ts uint64, metrics ...[]byte) []byte {
+	b := pbvarint(1, ts)
+	for _, m := range metrics {
+		b = append(b, pbbytes(2, m)...)
+	}
+	return b
+}
+
+func pbmetric(fields ...[]byte) []byte {
+	b := []byte{}
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return b
+}
+
+func TestSparkplug(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	rec := New(Settings{
+		RootDirectory: root,
+		Sparkplug:     true,
+		Verbose:       true,
+	})
+	if err := rec.Open(); err != nil {
+		t.Fatal("Recorder open failed (unexpected): ", err)
+	}
+	defer rec.Close()
+
+	tbirth := uint64(1577840400000)
+	tdata := tbirth + 1500
+	trecv := time.UnixMilli(int64(tbirth + 60000))
+	write := func(topic string, payload []byte) {
+		if err := rec.Write(TestRecord{TimeVal: trecv, TopicVal: topic, DataVal: payload}); err != nil {
+			t.Errorf("Unexpected write fail of '%s': %v", topic, err)
+		}
+	}
+	expect := func(topic string, ts uint64, value string) {
+		txt, err := os.ReadFile(path.Join(root, topic))
+		if err != nil {
+			t.Errorf("Expected metric file '%s': %s", topic, err.Error())
+			return
+		}
+		lines := strings.Split(strings.TrimRight(string(txt), "\n"), "\n")
+		line, err := codec.Decode([]byte(lines[len(lines)-1]))
+		if err != nil {
+			t.Errorf("Failed to decode '%s': %s", topic, err.Error())
+		} else if string(line.Value) != value {
+			t.Errorf("Metric '%s' value mismatch: '%s', expected '%s'", topic, line.Value, value)
+		} else if tp, _ := timefmt.Parse(line.Time, timefmt.Unix); tp.UnixMilli() != int64(ts) {
+			t.Errorf("Metric '%s' time mismatch: '%s', expected %d", topic, line.Time, ts)
+		}
+	}
+
+	// Data before birth: aliases cannot be resolved.
+	if err := rec.Write(mkrecord("spBv1.0/plant/NDATA/plc1", string(pbpayload(tdata, pbmetric(pbvarint(2, 1), pbdouble(13, 1)))))); err == nil {
+		t.Errorf("Expected error for unresolved alias before NBIRTH")
+	}
+
+	write("spBv1.0/plant/NBIRTH/plc1", pbpayload(tbirth,
+		pbmetric(pbbytes(1, []byte("temperature")), pbvarint(2, 1), pbvarint(4, 10), pbdouble(13, 21.5)),
+		pbmetric(pbbytes(1, []byte("line/count")), pbvarint(2, 2), pbvarint(4, 3), pbvarint(10, uint64(uint32(0xfffffffb)))),
+	))
+	expect("spBv1.0/plant/plc1/temperature", tbirth, "21.5")
+	expect("spBv1.0/plant/plc1/line/count", tbirth, "-5")
+
+	write("spBv1.0/plant/NDATA/plc1", pbpayload(tbirth+100000,
+		pbmetric(pbvarint(2, 1), pbvarint(3, tdata), pbdouble(13, 22.25)),
+		pbmetric(pbvarint(2, 2), pbvarint(10, 7)),
+	))
+	expect("spBv1.0/plant/plc1/temperature", tdata, "22.25")
+	expect("spBv1.0/plant/plc1/line/count", tbirth+100000, "7")
+
+	write("spBv1.0/plant/DBIRTH/plc1/valve", pbpayload(tbirth,
+		pbmetric(pbbytes(1, []byte("open")), pbvarint(2, 10), pbvarint(4, 11), pbvarint(14, 0)),
+	))
+	write("spBv1.0/plant/DDATA/plc1/valve", pbpayload(tdata, pbmetric(pbvarint(2, 10), pbvarint(14, 1))))
+	expect("spBv1.0/plant/plc1/valve/open", tdata, "true")
+
+	// Death certificates are not recorded, non-namespace topics unchanged.
+	write("spBv1.0/plant/NDEATH/plc1", pbpayload(tdata))
+	if isfile(path.Join(root, "spBv1.0/plant/NDEATH/plc1")) {
+		t.Errorf("Unexpected record file for NDEATH")
+	}
+	write("spBv1.0/plant/other", []byte("plain"))
+	expect("spBv1.0/plant/other", uint64(trecv.UnixMilli()), "plain")
+}
+
+func TestDeviceTimestamps(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	rec := New(Settings{
+		RootDirectory:   root,
+		TimestampFormat: timefmt.UnixMilli,
+		Verbose:         true,
+		TimestampRules: []TimestampRule{
+			{Pattern: "dev/*", Field: "ts", Format: "ms"},
+			{Pattern: "iso/*", Field: "meta.time", Format: "iso8601"},
+			{Pattern: "strict/*", Field: "ts", OutOfOrder: OutOfOrderReject},
+		},
+	})
+	if err := rec.Open(); err != nil {
+		t.Fatal("Recorder open failed (unexpected): ", err)
+	}
+	defer rec.Close()
+
+	lastts := func(topic string) string {
+		lines := readback_csv(t, root, topic)
+		if len(lines) == 0 {
+			return ""
+		}
+		return strings.SplitN(lines[len(lines)-1], ",", 2)[0]
+	}
+
+	rec.Write(mkrecord("dev/a", `{"ts": 1577840400123, "v": 1}`))
+	if ts := lastts("dev/a"); ts != "1577840400123" {
+		t.Errorf("Expected device timestamp, got '%s'", ts)
+	}
+	rec.Write(mkrecord("iso/a", `{"meta": {"time": "2020-01-01T01:00:00.5+01:00"}}`))
+	if ts := lastts("iso/a"); ts != "1577836800500" {
+		t.Errorf("Expected device ISO timestamp, got '%s'", ts)
+	}
+	r := mkrecord("dev/b", `{"v": 1}`)
+	rec.Write(r)
+	if ts := lastts("dev/b"); ts != fmt.Sprint(r.TimeVal.UnixMilli()) {
+		t.Errorf("Expected receive time fallback, got '%s'", ts)
+	}
+
+	// Out-of-order appended (default) and counted.
+	rec.Write(mkrecord("dev/a", `{"ts": 1577840400000, "v": 2}`))
+	if ts := lastts("dev/a"); ts != "1577840400000" {
+		t.Errorf("Expected out-of-order line appended, got '%s'", ts)
+	} else if st := rec.Stats(); st.OutOfOrder != 1 || st.Rejected != 0 {
+		t.Errorf("Unexpected out-of-order counters: %+v", st)
+	}
+
+	// Out-of-order rejected, also after restart (last time read from file).
+	rec.Write(mkrecord("strict/a", `{"ts": 1577840400.5, "v": 1}`))
+	rec.Close()
+	rec.Open()
+	rec.Write(mkrecord("strict/a", `{"ts": 1577840400.4, "v": 2}`))
+	if lines := readback_csv(t, root, "strict/a"); len(lines) != 1 {
+		t.Errorf("Expected out-of-order line rejected, got %v", lines)
+	} else if st := rec.Stats(); st.OutOfOrder != 2 || st.Rejected != 1 {
+		t.Errorf("Unexpected out-of-order counters: %+v", st)
+	}
+	rec.Write(mkrecord("strict/a", `{"ts": 1577840400.6, "v": 2}`))
+	if lines := readback_csv(t, root, "strict/a"); len(lines) != 2 {
+		t.Errorf("Expected in-order line written, got %v", lines)
+	}
+
+	rec.settings.TimestampRules = []TimestampRule{{Pattern: "x", Field: "ts", OutOfOrder: "sort"}}
+	if err := rec.settings.Validate(); err == nil {
+		t.Errorf("Expected error for invalid out_of_order setting")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	rec := New(Settings{
+		RootDirectory:   root,
+		TimestampFormat: timefmt.UnixMilli,
+		Verbose:         true,
+		Groups: []GroupRule{
+			{Pattern: "plug?/*", File: "plugs/{1}.csv", Columns: []string{"power", "current", "voltage"}},
+			{Pattern: "room/*/sensor/*", File: "rooms.csv", Column: "{1}_{2}", Columns: []string{"kitchen_temp"}, KeepTopicFiles: true},
+		},
+	})
+	if err := rec.Open(); err != nil {
+		t.Fatal("Recorder open failed (unexpected): ", err)
+	}
+	defer rec.Close()
+
+	rows := func(file string) []string {
+		txt, _ := os.ReadFile(path.Join(root, file))
+		return strings.Split(strings.TrimRight(string(txt), "\n"), "\n")
+	}
+	expect := func(file string, expected ...string) {
+		lines := rows(file)
+		if len(lines) != len(expected) {
+			t.Errorf("Group file '%s' lines mismatch: %v, expected %v", file, lines, expected)
+			return
+		}
+		for i, line := range lines {
+			if i > 0 {
+				line = line[strings.Index(line, ","):] // Without time
+			}
+			if line != expected[i] {
+				t.Errorf("Group file '%s' line %d mismatch: '%s', expected '%s'", file, i, line, expected[i])
+			}
+		}
+	}
+
+	rec.Write(mkrecord("plug1/power", "10"))
+	rec.Write(mkrecord("plug1/current", "0.5"))
+	rec.Write(mkrecord("plug1/power", "10")) // Unchanged
+	rec.Write(mkrecord("plug1/other", "x"))  // Not a group column
+	rec.Write(mkrecord("plug2/power", "a,b"))
+	expect("plugs/plug1.csv", "time,power,current,voltage", ",10,,", ",10,0.5,")
+	expect("plugs/plug2.csv", "time,power,current,voltage", `,"a,b",,`)
+	if isfile(path.Join(root, "plug1/power")) {
+		t.Errorf("Unexpected topic file for grouped topic")
+	} else if !isfile(path.Join(root, "plug1/other")) {
+		t.Errorf("Expected topic file for not grouped topic")
+	}
+
+	// Values carried forward after restart.
+	rec.Close()
+	rec.Open()
+	rec.Write(mkrecord("plug1/voltage", "230"))
+	expect("plugs/plug1.csv", "time,power,current,voltage", ",10,,", ",10,0.5,", ",10,0.5,230")
+
+	// Column template, topic files kept.
+	rec.Write(mkrecord("room/kitchen/sensor/temp", "21"))
+	expect("rooms.csv", "time,kitchen_temp", ",21")
+	if !isfile(path.Join(root, "room/kitchen/sensor/temp")) {
+		t.Errorf("Expected topic file for group with keep_topic_files")
+	}
+
+	// Existing file with different columns is not modified.
+	os.WriteFile(path.Join(root, "plugs/plug3.csv"), []byte("time,power\n1,2\n"), 0644)
+	if err := rec.Write(mkrecord("plug3/power", "1")); err == nil {
+		t.Errorf("Expected error for group file header mismatch")
+	}
+	expect("plugs/plug3.csv", "time,power", ",2")
+
+	rec.settings.Groups = []GroupRule{{Pattern: "x/*", File: "x.csv", Columns: []string{"a", "a"}}}
+	if err := rec.settings.Validate(); err == nil {
+		t.Errorf("Expected error for duplicate group columns")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	rec := New(Settings{
+		RootDirectory:    root,
+		RotationFileSize: 1,
+		Verbose:          true,
+	})
+	rec.Open()
+	defer rec.Close()
+
+	readrange := func(topic string, from time.Time, to time.Time) []string {
+		rd, err := archive.Open(root, topic, from, to)
+		if err != nil {
+			t.Fatalf("Unexpected archive open error: %s", err.Error())
+		}
+		defer rd.Close()
+		values := []string{}
+		for e, err := rd.Next(); err == nil; e, err = rd.Next() {
+			values = append(values, string(e.Value[:1]))
+		}
+		return values
+	}
+
+	// Rotated file ranges
+	times := []time.Time{}
+	for i := 1; i <= 3; i++ {
+		r := mkrecord("rotated", fmt.Sprint(i)+strings.Repeat("x", 1100))
+		times = append(times, r.TimeVal)
+		if err := rec.Write(r); err != nil {
+			t.Fatalf("Unexpected write fail: %v", err)
+		}
+	}
+	idx, err := archive.LoadIndex(path.Join(root, "rotated"))
+	if err != nil {
+		t.Fatalf("Unexpected index load fail: %v", err)
+	} else if len(idx.Rotated) != 2 || idx.Rotated[1].Index != 2 || idx.Rotated[1].First != times[1].UnixMilli() || idx.Rotated[1].Lines != 1 {
+		t.Errorf("Unexpected rotated index: %+v", idx.Rotated)
+	} else if idx.Live.First != times[2].UnixMilli() || idx.Live.Lines != 1 {
+		t.Errorf("Unexpected live index: %+v", idx.Live)
+	}
+	if v := fmt.Sprint(readrange("rotated", times[2], time.Time{})); v != "[3]" {
+		t.Errorf("Expected only the live file read, got %s", v)
+	}
+	if v := fmt.Sprint(readrange("rotated", times[1], times[2])); v != "[2]" {
+		t.Errorf("Expected only the second rotated file read, got %s", v)
+	}
+
+	// Sparse offsets of the live file
+	rec.settings.RotationFileSize = 0
+	times = times[:0]
+	for i := 0; i < 300; i++ {
+		r := mkrecord("sparse", fmt.Sprintf("%d%s", i%10, strings.Repeat("y", 1000)))
+		times = append(times, r.TimeVal)
+		rec.Write(r)
+	}
+	rec.Close() // Saves the index
+	idx, _ = archive.LoadIndex(path.Join(root, "sparse"))
+	if len(idx.Live.Offsets) < 4 || idx.Live.Lines != 300 {
+		t.Errorf("Expected sparse offsets in the live index, got %d offsets, %d lines", len(idx.Live.Offsets), idx.Live.Lines)
+	}
+	if v := readrange("sparse", times[250], time.Time{}); len(v) != 50 || v[0] != "0" {
+		t.Errorf("Unexpected values after seek: %d, first %v", len(v), v[:1])
+	}
+
+	// Index rebuilt if not matching the file
+	os.WriteFile(archive.IndexPath(path.Join(root, "sparse")), []byte("{}"), 0644)
+	idx, _ = archive.LoadIndex(path.Join(root, "sparse"))
+	if idx.Live.Lines != 300 || idx.Live.First != times[0].UnixMilli() || idx.Live.Last != times[299].UnixMilli() {
+		t.Errorf("Expected rebuilt live index, got %+v", idx.Live.IndexRange)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	rec := New(Settings{
+		RootDirectory: root,
+		TopicFilters:  []string{"metrics/*"},
+	})
+	rec.Open()
+	defer rec.Close()
+
+	lines, bytes := metricLinesWritten.Value(), metricBytesWritten.Value()
+	filtered, unchanged := metricFiltered.Value(), metricUnchanged.Value()
+	durations := metricWriteDurations.Count()
+	for _, r := range []TestRecord{mkrecord("metrics/a", "1"), mkrecord("metrics/a", "1"), mkrecord("metrics/a", "2"), mkrecord("other", "1")} {
+		if err := rec.Write(r); err != nil {
+			t.Fatalf("Unexpected write fail: %v", err)
+		}
+	}
+	if n := metricLinesWritten.Value() - lines; n != 2 {
+		t.Errorf("Expected 2 lines written, got %d", n)
+	}
+	if st, err := os.Stat(path.Join(root, "metrics/a")); err != nil || uint64(st.Size()) != metricBytesWritten.Value()-bytes {
+		t.Errorf("Expected bytes written to match the file size")
+	}
+	if metricFiltered.Value()-filtered != 1 || metricUnchanged.Value()-unchanged != 1 || metricWriteDurations.Count()-durations != 2 {
+		t.Errorf("Unexpected filtered/unchanged/duration counts")
+	}
+
+	text := strings.Builder{}
+	metrics.Default.WriteText(&text)
+	for _, expect := range []string{
+		"# TYPE mqttrack_lines_written_total counter\n",
+		fmt.Sprintf("mqttrack_lines_written_total %d\n", metricLinesWritten.Value()),
+		"# TYPE mqttrack_write_duration_seconds histogram\n",
+		fmt.Sprintf("mqttrack_write_duration_seconds_bucket{le=\"+Inf\"} %d\n", metricWriteDurations.Count()),
+	} {
+		if !strings.Contains(text.String(), expect) {
+			t.Errorf("Missing in metrics text: %q", expect)
+		}
+	}
+}
+
+type TestPublisher struct {
+	messages map[string]string
+}
+
+func (me *TestPublisher) Publish(topic string, data []byte, qos byte, retain bool) error {
+	if !retain {
+		return fmt.Errorf("mirror messages must be retained")
+	}
+	me.messages[topic] = string(data)
+	return nil
+}
+
+func TestMirror(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	rec := New(Settings{
+		RootDirectory:   root,
+		TimestampFormat: timefmt.UnixMilli,
+		MirrorTopic:     "mqttrack/last",
+	})
+	rec.Open()
+	defer rec.Close()
+	pub := &TestPublisher{messages: make(map[string]string)}
+	rec.SetPublisher(pub)
+
+	r := mkrecord("home/temp", "21.5")
+	rec.Write(r)
+	rec.Write(mkrecord("home/temp", "21.5"))
+	rec.Write(mkrecord("mqttrack/last/home/temp", "loop"))
+	expect := fmt.Sprintf(`{"t":%d,"v":21.5,"file":%q}`, r.TimeVal.UnixMilli(), path.Join(root, "home/temp"))
+	if len(pub.messages) != 1 || pub.messages["mqttrack/last/home/temp"] != expect {
+		t.Errorf("Unexpected mirror messages: %v", pub.messages)
+	}
+	if isfile(path.Join(root, "mqttrack/last/home/temp")) {
+		t.Errorf("Mirror topic must not be recorded")
+	}
+
+	bad := Settings{RootDirectory: root, MirrorTopic: "mqttrack/#"}
+	if bad.Validate() == nil {
+		t.Errorf("Expected invalid mirror topic error")
+	}
+}
+
+func TestExcludeFilters(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	topics := []string{"home/a/power", "home/a/linkquality", "home/b/rssi", "home/b/rssi/raw", "garden/temp"}
+	recorded := func(settings Settings) []string {
+		rec := New(settings)
+		rec.Open()
+		defer rec.Close()
+		out := []string{}
+		for _, topic := range topics {
+			if rec.filter(topic) {
+				out = append(out, topic)
+			}
+		}
+		return out
+	}
+	for _, c := range []struct {
+		mode    string
+		filters []string
+		expect  string
+	}{
+		{"", []string{"home/**", "!home/**/linkquality", "!home/**/rssi"}, "home/a/power home/b/rssi/raw"},
+		{FilterExcludeWins, []string{"home/**", "!home/*/rssi*"}, "home/a/power home/a/linkquality"},
+		{FilterFirstMatch, []string{"home/*/rssi/raw", "!home/*/rssi*", "home/**"}, "home/a/power home/a/linkquality home/b/rssi/raw"},
+		{FilterFirstMatch, []string{"!garden/*"}, "home/a/power home/a/linkquality home/b/rssi home/b/rssi/raw"},
+		{"", []string{"home/+/power", "re:^home/b/", "!mqtt:home/b/rssi"}, "home/a/power home/b/rssi/raw"},
+	} {
+		got := strings.Join(recorded(Settings{RootDirectory: root, TopicFilters: c.filters, FilterMode: c.mode}), " ")
+		if got != c.expect {
+			t.Errorf("Filters %v (%s): expected '%s', got '%s'", c.filters, c.mode, c.expect, got)
+		}
+	}
+
+	rec := New(Settings{RootDirectory: root, TopicFilters: []string{"home/**", "!home/**/rssi", "garden/*"}})
+	rec.Open()
+	defer rec.Close()
+	for _, topic := range append(topics, topics...) {
+		rec.Write(mkrecord(topic, "1"))
+	}
+	stats := rec.FilterStats()
+	if len(stats) != 3 || stats[0].Topics != 4 || stats[1].Topics != 1 || stats[2].Topics != 1 || stats[1].Pattern != "!home/**/rssi" {
+		t.Errorf("Unexpected filter stats: %+v", stats)
+	}
+	for _, settings := range []Settings{{TopicFilters: []string{"!"}}, {FilterMode: "last_match"}, {TopicFilters: []string{"re:("}}} {
+		if settings.Validate() == nil {
+			t.Errorf("Expected filter validation error for %+v", settings)
+		}
+	}
+}
+
+// 400 fnmatch filter patterns and 2000 topics, as with a larger installation.
+func benchfilters() ([]string, []string) {
+	patterns, topics := []string{}, []string{}
+	for site := range 100 {
+		patterns = append(patterns,
+			fmt.Sprintf("site%d/*/power", site),
+			fmt.Sprintf("site%d/room?/energy", site),
+			fmt.Sprintf("site%d/room%d/temperature", site, site%5),
+			fmt.Sprintf("!site%d/**/rssi", site),
+		)
+		for room := range 5 {
+			for _, name := range []string{"power", "energy", "temperature", "rssi"} {
+				topics = append(topics, fmt.Sprintf("site%d/room%d/%s", site, room, name))
+			}
+		}
+	}
+	return patterns, topics
+}
+
+// Previous implementation: linear scan over all patterns for each message.
+func BenchmarkFilterLinear(b *testing.B) {
+	patterns, topics := benchfilters()
+	n := 0
+	for i := 0; b.Loop(); i++ {
+		topic := topics[i%len(topics)]
+		for _, pattern := range patterns {
+			if pattern[0] != '!' && fnmatch.Match(pattern, topic, fnmatch.FNM_NOESCAPE) {
+				n++
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkFilterCompiled(b *testing.B) {
+	patterns, topics := benchfilters()
+	filters, _ := newTopicFilter(patterns, "")
+	matches := []int{}
+	for i := 0; b.Loop(); i++ {
+		matches = filters.set.Matches(topics[i%len(topics)], matches[:0])
+		filters.decide(matches)
+	}
+}
+
+func BenchmarkFilterCached(b *testing.B) {
+	patterns, topics := benchfilters()
+	filters, _ := newTopicFilter(patterns, "")
+	for i := 0; b.Loop(); i++ {
+		filters.accept(topics[i%len(topics)])
+	}
+}
+
+func TestCompiledFilters(t *testing.T) {
+	patterns, topics := benchfilters()
+	filters, err := newTopicFilter(patterns, "")
+	if err != nil {
+		t.Fatalf("Unexpected filter error: %v", err)
+	}
+	for _, topic := range topics {
+		expect := false
+		for _, pattern := range patterns {
+			if fnmatch.Match(strings.TrimPrefix(pattern, "!"), topic, fnmatch.FNM_NOESCAPE) {
+				if pattern[0] == '!' {
+					expect = false
+					break
+				}
+				expect = true
+			}
+		}
+		if filters.accept(topic) != expect || filters.accept(topic) != expect {
+			t.Errorf("Unexpected filter decision for '%s'", topic)
+		}
+	}
+	if len(filters.cache) != len(topics) {
+		t.Errorf("Expected %d cached decisions, got %d", len(topics), len(filters.cache))
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	deadband, disabled, nogzip, rotate, jsonl := 0.5, false, false, uint(1), codec.JSONL
+	heartbeat, retention := timefmt.Duration(time.Minute), timefmt.Duration(time.Hour)
+	rec := New(Settings{
+		RootDirectory:    root,
+		RotationFileSize: 1024,
+		GZipRotated:      true,
+		Policies: []Policy{
+			{Pattern: "sensors/#", Deadband: &deadband, Heartbeat: &heartbeat},
+			{Pattern: "events/**", RotationFileSize: &rotate, GZipRotated: &nogzip, Encoding: &jsonl},
+			{Pattern: "events/old", Retention: &retention},
+			{Pattern: "re:^debug/", Enabled: &disabled},
+		},
+	})
+	if err := rec.Open(); err != nil {
+		t.Fatalf("Unexpected open error: %v", err)
+	}
+	defer rec.Close()
+
+	t0 := time.Now().Truncate(time.Second)
+	write := func(topic string, value string, dt time.Duration) {
+		if err := rec.Write(TestRecord{TimeVal: t0.Add(dt), TopicVal: topic, DataVal: []byte(value)}); err != nil {
+			t.Fatalf("Unexpected write fail: %v", err)
+		}
+	}
+	lines := func(topic string) []string {
+		text, _ := os.ReadFile(path.Join(root, topic))
+		return strings.Split(strings.TrimSpace(string(text)), "\n")
+	}
+
+	// Deadband relative to the last written value, heartbeat
+	for i, v := range []string{"20.0", "20.3", "19.7", "19.4", "19.8", "19.8", "x", "x"} {
+		write("sensors/temp", v, time.Duration(i)*time.Second)
+	}
+	write("sensors/temp", "x", 2*time.Minute)
+	if l := lines("sensors/temp"); len(l) != 4 || !strings.HasSuffix(l[1], ",19.4") || !strings.HasSuffix(l[2], ",x") || !strings.HasSuffix(l[3], ",x") {
+		t.Errorf("Unexpected deadband/heartbeat lines: %v", l)
+	}
+
+	// Enabled, encoding, rotation without compression
+	write("debug/trace", "1", 0)
+	if isfile(path.Join(root, "debug/trace")) {
+		t.Errorf("Disabled topic must not be recorded")
+	}
+	for i := range 3 {
+		write("events/door", fmt.Sprint(i)+strings.Repeat("x", 1100), time.Duration(i)*time.Second)
+	}
+	if l := lines("events/door"); len(l) != 1 || !strings.HasPrefix(l[0], `{"t":`) {
+		t.Errorf("Expected jsonl encoded events, got %v", l)
+	} else if !isfile(path.Join(root, "events/door.1")) || !isfile(path.Join(root, "events/door.2")) {
+		t.Errorf("Expected uncompressed rotated files")
+	}
+
+	// Retention
+	write("events/old", strings.Repeat("x", 1100), 0)
+	old := path.Join(root, "events/old.1")
+	os.WriteFile(old, []byte("1,x\n"), 0644)
+	os.Chtimes(old, t0.Add(-2*time.Hour), t0.Add(-2*time.Hour))
+	write("events/old", "y", time.Second)
+	if isfile(old) || !isfile(path.Join(root, "events/old.2")) {
+		t.Errorf("Expected expired file removed, and the new rotated file kept")
+	}
+
+	negative, invalid, zero := -1.0, "xml", timefmt.Duration(0)
+	for _, p := range []Policy{{Pattern: "re:("}, {Pattern: "a", Deadband: &negative}, {Pattern: "a", Encoding: &invalid}, {Pattern: "a", Retention: &zero}} {
+		if p.Validate() == nil {
+			t.Errorf("Expected policy validation error for %+v", p)
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	scale, offset, round := 0.1, -1.0, 1
+	rec := New(Settings{
+		RootDirectory: root,
+		Transforms: []Transform{
+			{Pattern: "meter/energy", Steps: []TransformStep{{Trim: true}, {Extract: `^([0-9.]+) Wh$`}, {Scale: &scale}, {Offset: &offset}, {Round: &round}}, KeepRaw: true},
+			{Pattern: "switch/+/state", Steps: []TransformStep{{Map: map[string]string{"ON": "1", "OFF": "0", "*": "-1"}}}},
+			{Pattern: "switch/#", Steps: []TransformStep{{Trim: true}}},
+		},
+	})
+	if err := rec.Open(); err != nil {
+		t.Fatalf("Unexpected open error: %v", err)
+	}
+	defer rec.Close()
+
+	t0 := time.Now().Truncate(time.Second)
+	write := func(topic string, value string, dt time.Duration) {
+		if err := rec.Write(TestRecord{TimeVal: t0.Add(dt), TopicVal: topic, DataVal: []byte(value)}); err != nil {
+			t.Fatalf("Unexpected write fail: %v", err)
+		}
+	}
+	values := func(topic string) ([]string, []string) {
+		text, _ := os.ReadFile(path.Join(root, topic))
+		vals, raws := []string{}, []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(text)), "\n") {
+			if l, err := codec.Decode([]byte(line)); err != nil {
+				t.Errorf("Failed to decode '%s': %v", line, err)
+			} else {
+				vals, raws = append(vals, string(l.Value)), append(raws, string(l.Raw))
+			}
+		}
+		return vals, raws
+	}
+
+	// Change detection on the transformed values, failed transforms keep the payload.
+	write("meter/energy", " 1234 Wh", 0)
+	write("meter/energy", "1234 Wh ", time.Second)
+	write("meter/energy", "1235.5 Wh", 2*time.Second)
+	write("meter/energy", "error", 3*time.Second)
+	if v, r := values("meter/energy"); !slices.Equal(v, []string{"122.4", "122.6", "error"}) || !slices.Equal(r, []string{" 1234 Wh", "1235.5 Wh", ""}) {
+		t.Errorf("Unexpected transformed values %v, raw %v", v, r)
+	}
+	for _, v := range []string{"ON", "ON", "OFF", "??"} {
+		write("switch/a/state", v, 0)
+	}
+	write("switch/a/name", " a ", 0)
+	if v, r := values("switch/a/state"); !slices.Equal(v, []string{"1", "0", "-1"}) || r[0] != "" {
+		t.Errorf("Unexpected mapped values %v, raw %v", v, r)
+	} else if v, _ := values("switch/a/name"); !slices.Equal(v, []string{"a"}) {
+		t.Errorf("Unexpected trimmed values %v", v)
+	}
+
+	for _, tr := range []Transform{{Pattern: "a"}, {Pattern: "a", Steps: []TransformStep{{}}}, {Pattern: "a", Steps: []TransformStep{{Trim: true, Scale: &scale}}}, {Pattern: "a", Steps: []TransformStep{{Extract: "("}}}} {
+		if tr.Validate() == nil {
+			t.Errorf("Expected transform validation error for %+v", tr)
+		}
+	}
+}
+
+func TestScripts(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	file := path.Join(root, ".decode.script")
+	os.WriteFile(file, []byte("v = json(data)\nfor k, x in v { emit(topic + \"/\" + k, x * 2) }\n"), 0644)
+	rec := New(Settings{
+		RootDirectory: root,
+		Scripts: []ScriptRule{
+			{Pattern: "vendor/+", File: file},
+			{Pattern: "loop/#", Source: "for x in split(data, \"\") { for y in split(data, \"\") { z = 1 } }", MaxSteps: 100},
+		},
+	})
+	if err := rec.Open(); err != nil {
+		t.Fatalf("Unexpected open error: %v", err)
+	}
+	defer rec.Close()
+
+	t0 := time.Now().Truncate(time.Second)
+	write := func(topic string, value string) {
+		rec.Write(TestRecord{TimeVal: t0, TopicVal: topic, DataVal: []byte(value)})
+	}
+	contents := func(topic string) string {
+		text, _ := os.ReadFile(path.Join(root, topic))
+		return strings.TrimSpace(string(text))
+	}
+
+	write("vendor/dev1", `{"a":1,"b":2.5}`)
+	if contents("vendor/dev1/a") != rec.Timestamp(t0)+",2" || contents("vendor/dev1/b") != rec.Timestamp(t0)+",5" {
+		t.Errorf("Unexpected script output: a='%s', b='%s'", contents("vendor/dev1/a"), contents("vendor/dev1/b"))
+	}
+
+	// Failing scripts record the message unchanged
+	write("loop/x", strings.Repeat("x", 20))
+	if contents("loop/x") != rec.Timestamp(t0)+","+strings.Repeat("x", 20) {
+		t.Errorf("Expected unchanged record on script failure, got '%s'", contents("loop/x"))
+	}
+
+	// Reload after editing the script file
+	os.WriteFile(file, []byte("emit(topic + \"/raw\", data)"), 0644)
+	rec.ReloadScripts()
+	write("vendor/dev2", "1")
+	if contents("vendor/dev2/raw") != rec.Timestamp(t0)+",1" {
+		t.Errorf("Expected reloaded script output, got '%s'", contents("vendor/dev2/raw"))
+	}
+
+	for _, rule := range []ScriptRule{{Pattern: "a"}, {Pattern: "a", Source: "x", File: file}, {Pattern: "a", Source: "emit("}, {Pattern: "a", File: path.Join(root, "none")}} {
+		if rule.Validate() == nil {
+			t.Errorf("Expected script validation error for %+v", rule)
+		}
+	}
+}
+
+func TestDerived(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	hourly, decimals := timefmt.Duration(time.Hour), uint(1)
+	settings := Settings{
+		RootDirectory: root,
+		Derived: []DerivedRule{
+			{Pattern: "plug?/energy", Topic: "{topic}_delta", Kind: DerivedDelta},
+			{Pattern: "plug?/energy", Topic: "{topic}_rate", Kind: DerivedRate, Per: hourly, Interval: timefmt.Duration(20 * time.Second)},
+			{Pattern: "plug?/power", Topic: "derived/{1}/energy", Kind: DerivedIntegral, Per: hourly, MaxGap: hourly, Decimals: &decimals},
+			{Pattern: "plug?/state", Topic: "{topic}_x", Kind: DerivedIntegral, Field: "power"},
+		},
+	}
+	t0 := time.Now().Truncate(time.Second)
+	values := func(topic string) []string {
+		text, _ := os.ReadFile(path.Join(root, topic))
+		vals := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(text)), "\n") {
+			if l, err := codec.Decode([]byte(line)); err == nil {
+				vals = append(vals, string(l.Value))
+			}
+		}
+		return vals
+	}
+	run := func(samples []string) {
+		rec := New(settings)
+		if err := rec.Open(); err != nil {
+			t.Fatalf("Unexpected open error: %v", err)
+		}
+		defer rec.Close()
+		for _, sample := range samples {
+			f := strings.Split(sample, ",")
+			dt, _ := strconv.Atoi(f[1])
+			rec.Write(TestRecord{TimeVal: t0.Add(time.Duration(dt) * time.Second), TopicVal: f[0], DataVal: []byte(f[2])})
+		}
+	}
+
+	run([]string{
+		"plug1/energy,0,100", "plug1/energy,10,105", "plug1/energy,20,115", "plug1/energy,30,3", "plug1/energy,40,10",
+		"plug1/power,0,100", "plug1/power,1800,100", "plug1/power,3600,300", "plug1/power,10800,300",
+		"plug1/state,0,{\"power\":1}", "plug1/state,2,{\"power\":3}", "plug1/state,3,invalid",
+	})
+	if v := values("plug1/energy_delta"); !slices.Equal(v, []string{"5", "10", "3", "7"}) {
+		t.Errorf("Unexpected deltas: %v", v)
+	}
+	if v := values("plug1/energy_rate"); !slices.Equal(v, []string{"2700", "1800"}) {
+		t.Errorf("Unexpected rates: %v", v)
+	}
+	if v := values("plug1/state_x"); !slices.Equal(v, []string{"4"}) {
+		t.Errorf("Unexpected field integral: %v", v)
+	}
+	if v := values("plug1/state"); len(v) != 3 {
+		t.Errorf("Expected source topic recorded, got %v", v)
+	}
+
+	// Integrals continue from the last recorded value after restarts.
+	run([]string{"plug1/power,14400,200", "plug1/power,16200,200"})
+	if v := values("derived/plug1/energy"); !slices.Equal(v, []string{"50.0", "150.0", "250.0"}) {
+		t.Errorf("Unexpected integrals: %v", v)
+	}
+
+	for _, rule := range []DerivedRule{{Pattern: "a", Kind: DerivedRate}, {Pattern: "a", Topic: "b", Kind: "sum"}, {Pattern: "a", Topic: "b", Kind: DerivedDelta, Interval: -1}} {
+		if rule.Validate() == nil {
+			t.Errorf("Expected derived rule validation error for %+v", rule)
+		}
+	}
+}
+
+func TestRollups(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	settings := Settings{
+		RootDirectory: root,
+		Rollups:       []RollupRule{{Pattern: "sensors/#", Intervals: []timefmt.Duration{timefmt.Duration(time.Minute), timefmt.Duration(time.Hour)}}},
+	}
+	t0 := time.Unix(1750280400, 0)
+	runTopic := func(topic string, samples map[int]string) {
+		rec := New(settings)
+		if err := rec.Open(); err != nil {
+			t.Fatalf("Unexpected open error: %v", err)
+		}
+		defer rec.Close()
+		dts := slices.Sorted(maps.Keys(samples))
+		for _, dt := range dts {
+			rec.Write(TestRecord{TimeVal: t0.Add(time.Duration(dt) * time.Second), TopicVal: topic, DataVal: []byte(samples[dt])})
+		}
+	}
+	run := func(samples map[int]string) { runTopic("sensors/t", samples) }
+	contents := func(file string) string {
+		text, _ := os.ReadFile(path.Join(root, file))
+		return string(text)
+	}
+
+	run(map[int]string{0: "1", 30: "3", 45: "x", 60: "2", 90: "5", 3600: "4"})
+	if c := contents("sensors/t@1m"); c != "1750280400.00,2,1,3,2,3\n1750280460.00,2,2,5,3.5,5\n1750284000.00,1,4,4,4,4\n" {
+		t.Errorf("Unexpected 1m rollup: %s", c)
+	}
+	if c := contents("sensors/t@1h"); c != "1750280400.00,4,1,5,2.75,5\n1750284000.00,1,4,4,4,4\n" {
+		t.Errorf("Unexpected 1h rollup: %s", c)
+	}
+
+	// Incomplete buckets continue after restarts.
+	run(map[int]string{3610: "6", 3700: "7"})
+	if c := contents("sensors/t@1m"); !strings.HasSuffix(c, "\n1750284000.00,2,4,6,5,6\n1750284060.00,1,7,7,7,7\n") || strings.Count(c, "\n") != 4 {
+		t.Errorf("Unexpected continued 1m rollup: %s", c)
+	}
+	incremental := contents("sensors/t@1m") + contents("sensors/t@1h")
+
+	// Rebuild from the record files
+	os.Remove(path.Join(root, "sensors/t@1h"))
+	if written, err := RebuildRollups(settings, "sensors/t"); err != nil || len(written) != 2 {
+		t.Errorf("Unexpected rebuild result: %v, %v", written, err)
+	} else if rebuilt := contents("sensors/t@1m") + contents("sensors/t@1h"); rebuilt != incremental {
+		t.Errorf("Rebuilt rollups differ:\n%s\nexpected:\n%s", rebuilt, incremental)
+	}
+
+	// The open bucket is written periodically, and continued afterwards.
+	rec := New(settings)
+	if err := rec.Open(); err != nil {
+		t.Fatalf("Unexpected open error: %v", err)
+	}
+	rec.Write(TestRecord{TimeVal: t0, TopicVal: "sensors/u", DataVal: []byte("1")})
+	if rec.Flush(); contents("sensors/u@1m") != "" {
+		t.Errorf("Unexpected rollup write before the flush interval: %s", contents("sensors/u@1m"))
+	}
+	for _, b := range rec.rollups.buckets {
+		b.written = b.written.Add(-rollupFlushInterval)
+	}
+	if rec.Flush(); contents("sensors/u@1m") != "1750280400.00,1,1,1,1,1\n" {
+		t.Errorf("Unexpected flushed rollup: %s", contents("sensors/u@1m"))
+	}
+	rec.Write(TestRecord{TimeVal: t0.Add(time.Second), TopicVal: "sensors/u", DataVal: []byte("3")})
+	if rec.Close(); contents("sensors/u@1m") != "1750280400.00,2,1,3,2,3\n" {
+		t.Errorf("Unexpected continued rollup after flush: %s", contents("sensors/u@1m"))
+	}
+
+	// Unchanged values (not recorded) are included in count and mean.
+	runTopic("sensors/v", map[int]string{0: "0", 10: "0", 20: "0", 30: "100"})
+	if c := contents("sensors/v@1m"); c != "1750280400.00,4,0,100,25,100\n" || strings.Count(contents("sensors/v"), "\n") != 2 {
+		t.Errorf("Unexpected rollup of repeated values: %s", c)
+	}
+
+	// An incomplete last line (e.g. power loss) is not continued.
+	os.WriteFile(path.Join(root, "sensors/w@1m"), []byte("1750280340.00,2,1,3,2,3\n1750280400.00,1,5,5,5,5"), 0644)
+	runTopic("sensors/w", map[int]string{1: "7"})
+	if c := contents("sensors/w@1m"); c != "1750280340.00,2,1,3,2,3\n1750280400.00,1,5,5,5,5\n1750280400.00,1,7,7,7,7\n" {
+		t.Errorf("Unexpected rollup after incomplete line: %q", c)
+	}
+
+	if !IsRollup("sensors/t@15m") || IsRollup("sensors/t") || rollupSuffix(90*time.Minute) != "@90m" || rollupSuffix(14*24*time.Hour) != "@2w" {
+		t.Errorf("Unexpected rollup file names")
+	}
+	for _, rule := range []RollupRule{{Pattern: "a"}, {Pattern: "a", Intervals: []timefmt.Duration{timefmt.Duration(1500 * time.Millisecond)}}} {
+		if rule.Validate() == nil {
+			t.Errorf("Expected rollup rule validation error for %+v", rule)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	root, cleaner := mktestroot()
+	defer cleaner()
+
+	deadband := 0.5
+	rec := New(Settings{
+		RootDirectory:    root,
+		RotationFileSize: 1,
+		GZipRotated:      true,
+		Policies: []Policy{
+			{Pattern: "s/#", Deadband: &deadband},
+			{Pattern: "s/t", RotationFileSize: new(uint)},
+		},
+	})
+	os.MkdirAll(path.Join(root, "s"), 0755)
+	os.WriteFile(path.Join(root, "s/t.1"), []byte("100.00,1\n101.00,1\n102.00,2\n"), 0644)
+	os.WriteFile(path.Join(root, "s/t.2"), []byte("103.00,2\n104.00,2.1\n"), 0644)
+	os.WriteFile(path.Join(root, "s/t"), []byte("105,3\n106,3\n107.00,4,raw:b64:eA==\n"), 0644)
+	os.WriteFile(path.Join(root, "s/bad"), []byte("100.00,1\ngarbage\n"), 0644)
+	if err := gzipFile(path.Join(root, "s/t.1")); err != nil {
+		t.Fatalf("Failed to gzip: %v", err)
+	}
+	contents := func(file string) string {
+		text, _ := os.ReadFile(path.Join(root, file))
+		return string(text)
+	}
+
+	// Dry run
+	report, err := rec.Compact("s/t", true)
+	if err != nil || report.FilesBefore != 3 || report.FilesAfter != 1 || report.LinesBefore != 8 || report.LinesAfter != 4 || report.Unchanged != 4 {
+		t.Errorf("Unexpected dry run result: %v, %v", report, err)
+	} else if !isfile(path.Join(root, "s/t.1.gz")) || contents("s/t") != "105,3\n106,3\n107.00,4,raw:b64:eA==\n" {
+		t.Errorf("Dry run must not change files")
+	}
+
+	// Dedupe, deadband, re-encoding, merging
+	if _, err := rec.Compact("s/t", false); err != nil {
+		t.Errorf("Unexpected compact error: %v", err)
+	} else if c := contents("s/t"); c != "100.00,1\n102.00,2\n105.00,3\n107.00,4,raw:b64:eA==\n" {
+		t.Errorf("Unexpected compacted file: %s", c)
+	} else if isfile(path.Join(root, "s/t.1.gz")) || isfile(path.Join(root, "s/t.2")) || !isfile(archive.IndexPath(path.Join(root, "s/t"))) {
+		t.Errorf("Expected merged files with index")
+	}
+	if ls, _ := os.ReadDir(path.Join(root, "s")); len(ls) != 3 {
+		t.Errorf("Unexpected files after compaction: %v", ls)
+	}
+
+	// Invalid lines: not compacted
+	if _, err := rec.Compact("s/bad", false); err == nil || contents("s/bad") != "100.00,1\ngarbage\n" {
+		t.Errorf("Expected files with invalid lines unchanged, got error %v", err)
+	}
+
+	// Splitting into rotated files
+	os.MkdirAll(path.Join(root, "r"), 0755)
+	lines := []string{}
+	for i := range 300 {
+		lines = append(lines, fmt.Sprintf("%d.00,%d", 1000+i, i))
+	}
+	os.WriteFile(path.Join(root, "r/t"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if report, err := rec.Compact("r/t", false); err != nil || report.FilesAfter != 4 {
+		t.Errorf("Unexpected compact result: %v, %v", report, err)
+	} else if !isfile(path.Join(root, "r/t.1.gz")) || !isfile(path.Join(root, "r/t.2.gz")) || !isfile(path.Join(root, "r/t.3")) {
+		t.Errorf("Expected rotated files")
+	}
+	rd, _ := archive.Open(root, "r/t", time.Unix(1250, 0), time.Time{})
+	defer rd.Close()
+	for i := 250; i <= 300; i++ {
+		if e, err := rd.Next(); i == 300 && err != io.EOF {
+			t.Errorf("Expected end of records, got %v", e)
+		} else if i < 300 && (err != nil || e.Time.Unix() != int64(1000+i) || string(e.Value) != strconv.Itoa(i)) {
+			t.Errorf("Unexpected entry %v, %v", e, err)
+			break
+		}
+	}
+}
+
 //------------------------------------------------------------------------
@@ -0,0 +1,301 @@
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mqttrack/archive"
+	"mqttrack/codec"
+	"mqttrack/timefmt"
+	"mqttrack/topicfilter"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Downsampled files of numeric topics, e.g. pattern "plug?/power", intervals
+// ["1m", "1h"] maintains `plug1/power@1m` and `plug1/power@1h` with the lines
+// `<bucket start>,<count>,<min>,<max>,<mean>,<last>`. The first matching rule wins.
+type RollupRule struct {
+	Pattern   string             `json:"pattern"`   // fnmatch, MQTT or `re:` pattern
+	Intervals []timefmt.Duration `json:"intervals"` // Bucket sizes, whole seconds, aligned to UTC
+}
+
+func (me *RollupRule) Validate() error {
+	if _, err := topicfilter.Compile(me.Pattern); err != nil {
+		return fmt.Errorf("rollup rule for '%s': %s", me.Pattern, err.Error())
+	} else if len(me.Intervals) == 0 {
+		return fmt.Errorf("rollup rule for '%s': no intervals", me.Pattern)
+	}
+	for _, interval := range me.Intervals {
+		if interval < timefmt.Duration(time.Second) || interval.D()%time.Second != 0 {
+			return fmt.Errorf("rollup rule for '%s': invalid interval '%s', must be whole seconds", me.Pattern, interval.D())
+		}
+	}
+	return nil
+}
+
+// Returns if a topic (file path) is a rollup file.
+func IsRollup(topic string) bool {
+	return archive.IsRollup(topic)
+}
+
+// Rollup file suffix of an interval, e.g. "@15m", "@1d".
+func rollupSuffix(interval time.Duration) string {
+	for _, unit := range []struct {
+		d    time.Duration
+		name string
+	}{{7 * 24 * time.Hour, "w"}, {24 * time.Hour, "d"}, {time.Hour, "h"}, {time.Minute, "m"}} {
+		if interval%unit.d == 0 {
+			return "@" + strconv.FormatInt(int64(interval/unit.d), 10) + unit.name
+		}
+	}
+	return "@" + strconv.FormatInt(int64(interval/time.Second), 10) + "s"
+}
+
+type rollupBucket struct {
+	start   time.Time
+	count   uint64
+	min     float64
+	max     float64
+	sum     float64
+	last    float64
+	offset  int64     // File offset of the already written line of this bucket, -1 if none
+	dirty   bool      // Not written since the last sample
+	written time.Time // Last write of the line (or creation)
+}
+
+// Interval of writing the open buckets (Flush), so that the last line of a
+// rollup file is at most this old.
+const rollupFlushInterval = 10 * time.Second
+
+func (me *rollupBucket) add(v float64) {
+	if me.count == 0 || v < me.min {
+		me.min = v
+	}
+	if me.count == 0 || v > me.max {
+		me.max = v
+	}
+	me.count++
+	me.sum += v
+	me.last = v
+	me.dirty = true
+}
+
+func (me *rollupBucket) line(timestamp string) []byte {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return []byte(strings.Join([]string{timestamp, strconv.FormatUint(me.count, 10), f(me.min), f(me.max), f(me.sum / float64(me.count)), f(me.last)}, ",") + "\n")
+}
+
+// Restores the bucket from the last line of a rollup file, nil if there is
+// none, or if the line is incomplete (not continued, e.g. after a power loss).
+func loadRollupBucket(filePath string) *rollupBucket {
+	line, offset, terminated := lastLineAt(filePath)
+	if line == nil || !terminated {
+		return nil
+	}
+	rec, err := codec.Decode(line)
+	if err != nil {
+		return nil
+	}
+	t, err := timefmt.Parse(rec.Time, timefmt.Auto)
+	fields := strings.Split(string(rec.Value), ",")
+	if err != nil || len(fields) != 5 {
+		return nil
+	}
+	b := &rollupBucket{start: t, offset: offset, written: time.Now()}
+	values := make([]float64, 5)
+	for i, field := range fields {
+		if values[i], err = strconv.ParseFloat(field, 64); err != nil {
+			return nil
+		}
+	}
+	b.count, b.min, b.max, b.sum, b.last = uint64(values[0]), values[1], values[2], values[0]*values[3], values[4]
+	return b
+}
+
+// Writes the bucket line, replacing the line of the same bucket if already written.
+func writeRollupBucket(filePath string, b *rollupBucket, timestamp string) error {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write rollup file '%s': %s", filePath, err.Error())
+	}
+	defer f.Close()
+	offset, line := b.offset, b.line(timestamp)
+	if offset >= 0 {
+		err = f.Truncate(offset)
+	} else if offset, err = f.Seek(0, io.SeekEnd); err == nil && offset > 0 {
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, offset-1); err == nil && last[0] != '\n' {
+			_, err = f.WriteAt([]byte("\n"), offset) // Incomplete last line
+			offset++
+		}
+	}
+	if err == nil {
+		_, err = f.WriteAt(line, offset)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write rollup file '%s': %s", filePath, err.Error())
+	}
+	b.offset, b.dirty, b.written = offset, false, time.Now()
+	return nil
+}
+
+type compiledRollup struct {
+	pattern   *topicfilter.Pattern
+	intervals []time.Duration
+}
+
+type rollups struct {
+	rules   []compiledRollup
+	buckets map[string]*rollupBucket // Current bucket per rollup file path
+}
+
+// Compiled rollup rules, invalid ones (reported by Validate()) are skipped.
+func newRollups(rules []RollupRule) *rollups {
+	r := &rollups{buckets: make(map[string]*rollupBucket)}
+	for _, rule := range rules {
+		if rule.Validate() != nil {
+			continue
+		}
+		cr := compiledRollup{}
+		cr.pattern, _ = topicfilter.Compile(rule.Pattern)
+		for _, interval := range rule.Intervals {
+			cr.intervals = append(cr.intervals, interval.D())
+		}
+		r.rules = append(r.rules, cr)
+	}
+	return r
+}
+
+func (me *rollups) intervals(topic string) []time.Duration {
+	if IsRollup(topic) {
+		return nil
+	}
+	for _, rule := range me.rules {
+		if rule.pattern.Match(topic) {
+			return rule.intervals
+		}
+	}
+	return nil
+}
+
+// Adds a received numeric value to the rollup buckets of the topic, also if
+// not recorded because unchanged. Completed buckets are written.
+func (me *Recorder) rollup(topic string, filePath string, data Record) {
+	intervals := me.rollups.intervals(topic)
+	if len(intervals) == 0 {
+		return
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(data.Data())), 64)
+	if err != nil {
+		return
+	}
+	for _, interval := range intervals {
+		rpath := filePath + rollupSuffix(interval)
+		start := data.Time().Truncate(interval)
+		b, ok := me.rollups.buckets[rpath]
+		if !ok {
+			b = loadRollupBucket(rpath)
+		}
+		if b != nil && start.Before(b.start) {
+			continue // Out-of-order
+		} else if b == nil || start.After(b.start) {
+			if b != nil && b.dirty {
+				if err := writeRollupBucket(rpath, b, me.timestamp(b.start)); err != nil {
+					metricWriteErrors.Inc()
+					me.logVerbose(err.Error())
+				}
+			}
+			b = &rollupBucket{start: start, offset: -1, written: time.Now()}
+		}
+		b.add(v)
+		me.rollups.buckets[rpath] = b
+	}
+}
+
+// Writes the incomplete buckets not written for `age`, they are continued
+// when the next values of the same bucket are recorded.
+func (me *Recorder) writeRollups(age time.Duration) {
+	for rpath, b := range me.rollups.buckets {
+		if b.dirty && time.Since(b.written) >= age {
+			if err := writeRollupBucket(rpath, b, me.timestamp(b.start)); err != nil {
+				metricWriteErrors.Inc()
+				me.logVerbose(err.Error())
+			}
+		}
+	}
+}
+
+func (me *Recorder) flushRollups() {
+	me.writeRollups(0)
+	me.rollups.buckets = make(map[string]*rollupBucket)
+}
+
+// Recreates the rollup files of a topic from its record files (the recorder
+// should not be running). Returns the paths of the written files.
+func RebuildRollups(settings Settings, topic string) ([]string, error) {
+	intervals := newRollups(settings.Rollups).intervals(topic)
+	if len(intervals) == 0 {
+		return nil, nil
+	}
+	decimals := -1
+	if settings.TimestampDecimals != nil {
+		decimals = int(*settings.TimestampDecimals)
+	}
+	timestamp := func(t time.Time) string { return timefmt.Format(t, settings.TimestampFormat, decimals) }
+
+	rd, err := archive.Open(settings.RootDirectory, topic, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	filePath := path.Join(settings.RootDirectory, topic)
+	outs := make([]bytes.Buffer, len(intervals))
+	buckets := make([]*rollupBucket, len(intervals))
+	for {
+		entry, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(entry.Value)), 64)
+		if err != nil {
+			continue
+		}
+		for i, interval := range intervals {
+			start := entry.Time.Truncate(interval)
+			if b := buckets[i]; b != nil && start.Before(b.start) {
+				continue
+			} else if b == nil || start.After(b.start) {
+				if b != nil {
+					outs[i].Write(b.line(timestamp(b.start)))
+				}
+				buckets[i] = &rollupBucket{start: start, offset: -1}
+			}
+			buckets[i].add(v)
+		}
+	}
+	written := []string{}
+	var errs error
+	for i, interval := range intervals {
+		if buckets[i] != nil {
+			outs[i].Write(buckets[i].line(timestamp(buckets[i].start)))
+		}
+		rpath := filePath + rollupSuffix(interval)
+		tmp := path.Join(path.Dir(rpath), "."+path.Base(rpath)+".tmp")
+		if err := os.WriteFile(tmp, outs[i].Bytes(), 0644); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed to write rollup file '%s': %s", rpath, err.Error()))
+		} else if err := os.Rename(tmp, rpath); err != nil {
+			os.Remove(tmp)
+			errs = errors.Join(errs, fmt.Errorf("failed to replace rollup file '%s': %s", rpath, err.Error()))
+		} else {
+			written = append(written, rpath)
+		}
+	}
+	return written, errs
+}
@@ -0,0 +1,115 @@
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mqttrack/metrics"
+	"mqttrack/script"
+	"mqttrack/timefmt"
+	"mqttrack/topicfilter"
+	"os"
+)
+
+// Decoding script for matching topics. The script replaces the message with
+// the records it emits, the first matching rule wins.
+type ScriptRule struct {
+	Pattern  string           `json:"pattern"`             // fnmatch, MQTT or `re:` pattern
+	File     string           `json:"file,omitempty"`      // Script file path
+	Source   string           `json:"source,omitempty"`    // Inline script, alternative to `file`
+	Timeout  timefmt.Duration `json:"timeout,omitempty"`   // Execution time limit, default 50ms
+	MaxSteps int              `json:"max_steps,omitempty"` // Execution step limit, default 100000
+}
+
+var metricScriptErrors = metrics.NewCounter("mqttrack_script_errors_total", "Messages recorded unchanged because the decoding script failed.")
+
+func (me *ScriptRule) Validate() error {
+	_, err := me.compile()
+	return err
+}
+
+// Loads the script file (or inline source) and compiles it.
+func (me *ScriptRule) compile() (*script.Program, error) {
+	if _, err := topicfilter.Compile(me.Pattern); err != nil {
+		return nil, fmt.Errorf("script for '%s': %s", me.Pattern, err.Error())
+	} else if (me.File == "") == (me.Source == "") {
+		return nil, fmt.Errorf("script for '%s': either file or source must be set", me.Pattern)
+	} else if me.Timeout < 0 || me.MaxSteps < 0 {
+		return nil, fmt.Errorf("script for '%s': limits must not be negative", me.Pattern)
+	}
+	name, source := me.File, me.Source
+	if name == "" {
+		name = me.Pattern
+	} else if text, err := os.ReadFile(me.File); err != nil {
+		return nil, fmt.Errorf("script for '%s': %s", me.Pattern, err.Error())
+	} else {
+		source = string(text)
+	}
+	prog, err := script.Compile(name, source)
+	if err != nil {
+		return nil, fmt.Errorf("script for '%s': %s", me.Pattern, err.Error())
+	}
+	return prog, nil
+}
+
+type compiledScript struct {
+	pattern *topicfilter.Pattern
+	program *script.Program
+	limits  script.Limits
+}
+
+// Compiled scripts, failing ones are logged and skipped.
+func newScripts(rules []ScriptRule) []compiledScript {
+	scripts := []compiledScript{}
+	for _, rule := range rules {
+		prog, err := rule.compile()
+		if err != nil {
+			log.Print("Script disabled: ", err.Error())
+			continue
+		}
+		pattern, _ := topicfilter.Compile(rule.Pattern)
+		scripts = append(scripts, compiledScript{
+			pattern: pattern,
+			program: prog,
+			limits:  script.Limits{MaxSteps: rule.MaxSteps, Timeout: rule.Timeout.D()},
+		})
+	}
+	return scripts
+}
+
+// Re-reads the script files, e.g. after they were edited.
+func (me *Recorder) ReloadScripts() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.scripts = newScripts(me.settings.Scripts)
+}
+
+func (me *Recorder) script(topic string) *compiledScript {
+	for i := range me.scripts {
+		if me.scripts[i].pattern.Match(topic) {
+			return &me.scripts[i]
+		}
+	}
+	return nil
+}
+
+func (me *Recorder) writeScripted(s *compiledScript, topic string, data Record) error {
+	records, err := s.program.Run(topic, data.Time(), data.Data(), s.limits)
+	if err != nil {
+		metricScriptErrors.Inc()
+		me.logVerbose("Script failed, recording unchanged: ", err.Error())
+		return me.write(topic, data)
+	}
+	for _, r := range records {
+		stopic, serr := sanitizeTopic(r.Topic)
+		if serr == nil && me.isMirrorTopic(stopic) {
+			serr = fmt.Errorf("script must not write mirror topic '%s'", stopic)
+		} else if serr == nil {
+			serr = me.write(stopic, NewRecord(r.Time, stopic, r.Value))
+		}
+		if serr != nil {
+			err = errors.Join(err, serr)
+		}
+	}
+	return err
+}
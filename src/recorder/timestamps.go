@@ -0,0 +1,117 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mqttrack/codec"
+	"mqttrack/fnmatch"
+	"mqttrack/timefmt"
+	"os"
+	"time"
+)
+
+const (
+	OutOfOrderAppend = "append" // Default: write lines with older timestamps anyway (counted).
+	OutOfOrderReject = "reject" // Drop lines older than the last line in the record file (counted).
+)
+
+// Timestamp taken from a JSON field of the payload instead of the receive time.
+type TimestampRule struct {
+	Pattern    string `json:"pattern"`
+	Field      string `json:"field"`        // Dot separated path, e.g. "ts" or "meta.time"
+	Format     string `json:"format"`       // auto|unix|ms|us|iso8601 (and other timestamp formats)
+	OutOfOrder string `json:"out_of_order"` // append|reject
+}
+
+func (me *TimestampRule) Validate() error {
+	if me.Field == "" {
+		return fmt.Errorf("timestamp rule for '%s': missing field", me.Pattern)
+	}
+	if me.Format != "" && me.Format != timefmt.Auto && !timefmt.Valid(me.Format) {
+		return fmt.Errorf("timestamp rule for '%s': invalid format '%s'", me.Pattern, me.Format)
+	}
+	switch me.OutOfOrder {
+	case "", OutOfOrderAppend, OutOfOrderReject:
+		return nil
+	default:
+		return fmt.Errorf("timestamp rule for '%s': invalid out_of_order setting '%s', allowed are '%s', '%s'", me.Pattern, me.OutOfOrder, OutOfOrderAppend, OutOfOrderReject)
+	}
+}
+
+func (me *Recorder) timestampRule(topic string) *TimestampRule {
+	for i := range me.settings.TimestampRules {
+		if fnmatch.Match(me.settings.TimestampRules[i].Pattern, topic, fnmatch.FNM_NOESCAPE) {
+			return &me.settings.TimestampRules[i]
+		}
+	}
+	return nil
+}
+
+// Returns the timestamp from the payload field of the rule, or the record time
+// if the field is missing or invalid.
+func (me *Recorder) deviceTime(rule *TimestampRule, data Record) time.Time {
+	text, err := codec.JSONField(data.Data(), rule.Field)
+	if err == nil {
+		var t time.Time
+		if t, err = timefmt.Parse(text, rule.Format); err == nil {
+			return t
+		}
+	}
+	me.logVerbose("Using receive time for ", data.Topic(), ": ", err.Error())
+	return data.Time()
+}
+
+// Time of the last line written to the record file. Read from the file once
+// per topic, afterwards tracked in memory.
+func (me *Recorder) lastWriteTime(topic string, filePath string) time.Time {
+	if t, ok := me.lastWritten[topic]; ok {
+		return t
+	}
+	t := time.Time{}
+	if line := lastLine(filePath); line != nil {
+		if rec, err := codec.Decode(line); err == nil {
+			if tp, err := timefmt.Parse(rec.Time, timefmt.Auto); err == nil {
+				t = tp
+			}
+		}
+	}
+	me.lastWritten[topic] = t
+	return t
+}
+
+// Returns the last line of a file, nil if empty or not readable.
+func lastLine(filePath string) []byte {
+	line, _, _ := lastLineAt(filePath)
+	return line
+}
+
+// Last line of a file with its offset, and if it is terminated by a newline.
+func lastLineAt(filePath string) ([]byte, int64, bool) {
+	const tailSize int64 = 64 * 1024
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, false
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		return nil, 0, false
+	}
+	offset := max(st.Size()-tailSize, 0)
+	buf := make([]byte, st.Size()-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, 0, false
+	}
+	terminated := bytes.HasSuffix(buf, []byte("\n"))
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return nil, 0, false
+	}
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		return buf[i+1:], offset + int64(i) + 1, terminated
+	} else if offset > 0 {
+		return nil, 0, false // Line longer than the tail
+	}
+	return buf, offset, terminated
+}
@@ -0,0 +1,144 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"mqttrack/metrics"
+	"mqttrack/topicfilter"
+	"regexp"
+	"strconv"
+)
+
+// One operation of a transform chain, exactly one field is set.
+type TransformStep struct {
+	Trim    bool              `json:"trim,omitempty"`    // Remove leading/trailing whitespace
+	Extract string            `json:"extract,omitempty"` // Regular expression, first group (or whole match)
+	Map     map[string]string `json:"map,omitempty"`     // Value mapping, `*` is the default for unmapped values
+	Scale   *float64          `json:"scale,omitempty"`   // Numeric factor
+	Offset  *float64          `json:"offset,omitempty"`  // Numeric summand
+	Round   *int              `json:"round,omitempty"`   // Numeric, number of decimals
+}
+
+// Payload transformation of matching topics, applied before change detection
+// and writing. The first matching transform wins.
+type Transform struct {
+	Pattern string          `json:"pattern"`            // fnmatch, MQTT or `re:` pattern
+	Steps   []TransformStep `json:"steps"`              // Applied in order
+	KeepRaw bool            `json:"keep_raw,omitempty"` // Record the original payload in an additional column
+}
+
+var metricTransformErrors = metrics.NewCounter("mqttrack_transform_errors_total", "Payloads recorded untransformed because a transform step failed.")
+
+func (me *Transform) Validate() error {
+	if _, err := topicfilter.Compile(me.Pattern); err != nil {
+		return fmt.Errorf("transform for '%s': %s", me.Pattern, err.Error())
+	} else if len(me.Steps) == 0 {
+		return fmt.Errorf("transform for '%s': no steps", me.Pattern)
+	}
+	for i, step := range me.Steps {
+		n := 0
+		for _, set := range []bool{step.Trim, step.Extract != "", step.Map != nil, step.Scale != nil, step.Offset != nil, step.Round != nil} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("transform for '%s': step %d must have exactly one operation", me.Pattern, i+1)
+		} else if _, err := regexp.Compile(step.Extract); err != nil {
+			return fmt.Errorf("transform for '%s': invalid extract expression: %s", me.Pattern, err.Error())
+		} else if step.Round != nil && (*step.Round < 0 || *step.Round > 15) {
+			return fmt.Errorf("transform for '%s': round must be 0 to 15 decimals", me.Pattern)
+		}
+	}
+	return nil
+}
+
+type compiledTransform struct {
+	*Transform
+	pattern *topicfilter.Pattern
+	extract []*regexp.Regexp // Per step, nil if no extract step
+}
+
+// Compiled transforms, invalid ones (reported by Validate()) are skipped.
+func newTransforms(rules []Transform) []compiledTransform {
+	transforms := []compiledTransform{}
+	for i := range rules {
+		if rules[i].Validate() != nil {
+			continue
+		}
+		ct := compiledTransform{Transform: &rules[i]}
+		ct.pattern, _ = topicfilter.Compile(rules[i].Pattern)
+		for _, step := range rules[i].Steps {
+			var re *regexp.Regexp
+			if step.Extract != "" {
+				re = regexp.MustCompile(step.Extract)
+			}
+			ct.extract = append(ct.extract, re)
+		}
+		transforms = append(transforms, ct)
+	}
+	return transforms
+}
+
+func (me *compiledTransform) apply(data []byte) ([]byte, error) {
+	for i, step := range me.Steps {
+		switch {
+		case step.Trim:
+			data = bytes.TrimSpace(data)
+		case step.Extract != "":
+			m := me.extract[i].FindSubmatch(data)
+			if m == nil {
+				return nil, fmt.Errorf("no match of '%s'", step.Extract)
+			} else if len(m) > 1 {
+				data = m[1]
+			} else {
+				data = m[0]
+			}
+		case step.Map != nil:
+			if v, ok := step.Map[string(data)]; ok {
+				data = []byte(v)
+			} else if v, ok := step.Map["*"]; ok {
+				data = []byte(v)
+			}
+		default:
+			v, err := strconv.ParseFloat(string(bytes.TrimSpace(data)), 64)
+			if err != nil {
+				return nil, fmt.Errorf("not a number: '%s'", data)
+			}
+			decimals := -1
+			if step.Scale != nil {
+				v *= *step.Scale
+			} else if step.Offset != nil {
+				v += *step.Offset
+			} else {
+				decimals = *step.Round
+			}
+			data = strconv.AppendFloat(nil, v, 'f', decimals, 64)
+		}
+	}
+	return data, nil
+}
+
+// Applies the first matching transform, returns the transformed record and
+// the original payload if it shall be recorded as well (otherwise nil). On
+// errors the record is returned unchanged.
+func (me *Recorder) transform(topic string, data Record) (Record, []byte) {
+	for i := range me.transforms {
+		ct := &me.transforms[i]
+		if !ct.pattern.Match(topic) {
+			continue
+		}
+		value, err := ct.apply(data.Data())
+		if err != nil {
+			metricTransformErrors.Inc()
+			me.logVerbose("Transform of ", topic, " failed: ", err.Error())
+			return data, nil
+		}
+		var raw []byte
+		if ct.KeepRaw {
+			raw = data.Data()
+		}
+		return NewRecord(data.Time(), data.Topic(), value), raw
+	}
+	return data, nil
+}
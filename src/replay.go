@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"mqttrack/archive"
+	"mqttrack/mqttnode"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Topic prefix rewriting for replays, "old=new" (empty old prepends new).
+type topicRewrite struct {
+	from string
+	to   string
+}
+
+func parseTopicRewrite(text string) (topicRewrite, error) {
+	if text == "" {
+		return topicRewrite{}, nil
+	} else if from, to, ok := strings.Cut(text, "="); ok {
+		return topicRewrite{from: from, to: to}, nil
+	}
+	return topicRewrite{}, fmt.Errorf("invalid prefix rewrite '%s', expected 'old=new'", text)
+}
+
+func (me topicRewrite) apply(topic string) string {
+	if rest, ok := strings.CutPrefix(topic, me.from); ok {
+		return me.to + rest
+	}
+	return topic
+}
+
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFile := flags.String("c", DEFAULT_CONFIG_FILE, "Config file path to use.")
+	root := flags.String("root", "", "Data root directory (default from the config file).")
+	fromArg := flags.String("from", "", "Start time (inclusive), unix timestamp, RFC3339, or relative like -24h.")
+	toArg := flags.String("to", "", "End time (exclusive), unix timestamp, RFC3339, or relative like -1h.")
+	speed := flags.Float64("speed", 1, "Replay speed factor (e.g. 10), 0 publishes as fast as possible.")
+	prefix := flags.String("prefix", "", "Topic prefix rewrite 'old=new', e.g. 'home/=replay/home/'.")
+	retain := flags.Bool("retain", false, "Publish with retain flag.")
+	qos := flags.Uint("qos", 0, "Publish QoS (0, 1, 2).")
+	broker := flags.String("broker", "", "Target broker address (default from the config file).")
+	port := flags.Uint("port", 0, "Target broker port (default from the config file).")
+	clientID := flags.String("client-id", "", "MQTT client ID (default mqttrack-replay-<pid>).")
+	verbose := flags.Bool("v", false, "Log each published message.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [options] [topic patterns ...]\n", PROGRAM_NAME)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var settings AppSettings
+	if err := settings.Load(*configFile); err != nil {
+		return err
+	}
+	if *root != "" {
+		settings.Recorder.RootDirectory = *root
+	}
+	if *broker != "" {
+		settings.MQTT.BrokerIP = *broker
+	}
+	if *port != 0 {
+		settings.MQTT.Port = uint16(*port)
+	}
+	settings.MQTT.ClientID = *clientID
+	if settings.MQTT.ClientID == "" {
+		settings.MQTT.ClientID = fmt.Sprintf("%s-replay-%d", PROGRAM_NAME, os.Getpid())
+	}
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if *speed < 0 {
+		return fmt.Errorf("invalid speed factor: %g", *speed)
+	}
+	if *qos > 2 {
+		return fmt.Errorf("invalid qos: %d", *qos)
+	}
+	rewrite, err := parseTopicRewrite(*prefix)
+	if err != nil {
+		return err
+	}
+	from, err := parseTimeArg(*fromArg)
+	if err != nil {
+		return fmt.Errorf("invalid --from time: %s", err.Error())
+	}
+	to, err := parseTimeArg(*toArg)
+	if err != nil {
+		return fmt.Errorf("invalid --to time: %s", err.Error())
+	}
+
+	readers, err := archive.OpenMatching(settings.Recorder.RootDirectory, flags.Args(), from, to)
+	if err != nil {
+		return err
+	}
+	merger := archive.NewMerger(readers)
+	defer merger.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	node, err := mqttnode.ConnectPublisher(&settings.MQTT)
+	if err != nil {
+		return err
+	}
+	defer node.Disconnect()
+	go func() {
+		for con := range node.Connection {
+			if con.Type == mqttnode.ConnectionLost {
+				log.Print("Connection lost: ", con.Error.Error())
+			}
+		}
+	}()
+
+	publish := func(topic string, data []byte) error {
+		return node.Publish(topic, data, byte(*qos), *retain)
+	}
+	count, err := replay(ctx, merger.Next, publish, *speed, rewrite, *verbose)
+	log.Printf("Replayed %d messages.", count)
+	if err != nil {
+		return err
+	}
+	return merger.Err()
+}
+
+// Publishes the entries returned by `next` (until an error or io.EOF) with
+// the recorded time intervals divided by `speed` (0: without delays).
+// Returns the number of published messages.
+func replay(ctx context.Context, next func() (archive.Entry, error), publish func(topic string, data []byte) error, speed float64, rewrite topicRewrite, verbose bool) (int, error) {
+	count := 0
+	var first time.Time
+	var start time.Time
+	for entry, err := next(); err == nil; entry, err = next() {
+		if count == 0 {
+			first, start = entry.Time, time.Now()
+		} else if speed > 0 {
+			due := start.Add(time.Duration(float64(entry.Time.Sub(first)) / speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			log.Print("Replay interrupted.")
+			break
+		}
+		topic := rewrite.apply(entry.Topic)
+		if verbose {
+			log.Print("Publish: ", entry.Time.Format(time.RFC3339Nano), " ", topic, " = ", string(entry.Value))
+		}
+		if err := publish(topic, entry.Value); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mqttrack/archive"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testPublisher struct {
+	start     time.Time
+	published []string
+	delays    []time.Duration
+	fail      string
+}
+
+func (me *testPublisher) publish(topic string, data []byte) error {
+	if topic == me.fail {
+		return errors.New("publish failed")
+	}
+	me.published = append(me.published, topic+"="+string(data))
+	me.delays = append(me.delays, time.Since(me.start))
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	app, cleaner := mktestapp(t)
+	defer cleaner()
+	root := app.settings.Recorder.RootDirectory
+	for file, text := range map[string]string{
+		"plug1/power": "100.00,1\n100.50,2\n101.00,3\n",
+		"plug2/power": "100.25,7\n104.00,8\n",
+		"plug1/state": "100.00,ON\n",
+	} {
+		os.MkdirAll(path.Dir(path.Join(root, file)), 0755)
+		os.WriteFile(path.Join(root, file), []byte(text), 0644)
+	}
+	open := func(from int64, to int64) func() (archive.Entry, error) {
+		readers, err := archive.OpenMatching(root, []string{"plug?/power"}, time.Unix(from, 0), time.Unix(to, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return archive.NewMerger(readers).Next
+	}
+	rewrite, _ := parseTopicRewrite("plug=replay/plug")
+
+	// Pattern and time range selection, topic rewrite, intervals at speed 50.
+	pub := &testPublisher{start: time.Now()}
+	n, err := replay(context.Background(), open(100, 102), pub.publish, 50, rewrite, false)
+	if err != nil || n != 4 {
+		t.Fatalf("Unexpected replay result: %d, %v", n, err)
+	} else if fmt.Sprint(pub.published) != "[replay/plug1/power=1 replay/plug2/power=7 replay/plug1/power=2 replay/plug1/power=3]" {
+		t.Errorf("Unexpected published messages: %v", pub.published)
+	}
+	for i, expected := range []time.Duration{0, 5, 10, 20} {
+		if d := pub.delays[i]; d < expected*time.Millisecond || d > expected*time.Millisecond+500*time.Millisecond {
+			t.Errorf("Message %d published after %s, expected %dms", i, d, expected)
+		}
+	}
+
+	// Speed 0: without delays (4s recorded).
+	pub = &testPublisher{start: time.Now()}
+	if n, err := replay(context.Background(), open(100, 105), pub.publish, 0, topicRewrite{}, false); err != nil || n != 5 {
+		t.Errorf("Unexpected replay result: %d, %v", n, err)
+	} else if d := time.Since(pub.start); d > 500*time.Millisecond {
+		t.Errorf("Expected replay without delays, took %s", d)
+	}
+
+	// Interrupted, and aborted on publish errors.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pub = &testPublisher{start: time.Now()}
+	if n, _ := replay(ctx, open(100, 105), pub.publish, 1, topicRewrite{}, false); n != 1 {
+		t.Errorf("Expected interrupted replay after the first message, got %d", n)
+	}
+	pub = &testPublisher{fail: "plug1/power"}
+	if n, err := replay(context.Background(), open(100, 105), pub.publish, 0, topicRewrite{}, false); err == nil || n != 0 {
+		t.Errorf("Expected replay aborted on publish error, got %d, %v", n, err)
+	}
+}
+
+func TestTopicRewrite(t *testing.T) {
+	for _, test := range []struct{ rewrite, topic, expected string }{
+		{"", "home/a", "home/a"},
+		{"home/=replay/home/", "home/a", "replay/home/a"},
+		{"home/=replay/home/", "garden/a", "garden/a"},
+		{"=test/", "home/a", "test/home/a"},
+	} {
+		if rw, err := parseTopicRewrite(test.rewrite); err != nil {
+			t.Errorf("Unexpected error for '%s': %v", test.rewrite, err)
+		} else if actual := rw.apply(test.topic); actual != test.expected {
+			t.Errorf("Rewrite '%s' of '%s': got '%s', expected '%s'", test.rewrite, test.topic, actual, test.expected)
+		}
+	}
+	if _, err := parseTopicRewrite("home/"); err == nil {
+		t.Errorf("Expected error for rewrite without '='")
+	}
+}
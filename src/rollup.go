@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mqttrack/archive"
+	"mqttrack/fnmatch"
+	"mqttrack/recorder"
+)
+
+// Rebuilds the rollup files from the record files.
+func runRollup(args []string) error {
+	flags := flag.NewFlagSet("rollup", flag.ExitOnError)
+	configFile := flags.String("c", DEFAULT_CONFIG_FILE, "Config file path to use.")
+	root := flags.String("root", "", "Data root directory (default from the config file).")
+	verbose := flags.Bool("v", false, "Print the written files.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s rollup [options] [topic patterns ...]\n", PROGRAM_NAME)
+		fmt.Fprintf(flags.Output(), "Rebuilds the rollup files of the topics matching the recorder `rollups` rules.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	settings, err := loadRecorderSettings(*configFile, *root)
+	if err != nil {
+		return err
+	} else if len(settings.Rollups) == 0 {
+		return errors.New("no rollup rules configured")
+	}
+	for _, rule := range settings.Rollups {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	topics, err := archive.Topics(settings.RootDirectory)
+	if err != nil {
+		return err
+	}
+	var errs error
+	count := 0
+	for _, topic := range topics {
+		matched := flags.NArg() == 0
+		for _, pattern := range flags.Args() {
+			matched = matched || fnmatch.Match(pattern, topic, fnmatch.FNM_NOESCAPE)
+		}
+		if !matched || recorder.IsRollup(topic) {
+			continue
+		}
+		written, err := recorder.RebuildRollups(settings, topic)
+		errs = errors.Join(errs, err)
+		count += len(written)
+		if *verbose {
+			for _, file := range written {
+				fmt.Println(file)
+			}
+		}
+	}
+	fmt.Printf("%d rollup files written.\n", count)
+	return errs
+}
@@ -0,0 +1,282 @@
+package script
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type builtin struct {
+	min  int
+	max  int
+	call func(e *env, line int, args []any) any
+}
+
+var builtins = map[string]builtin{
+	// emit(topic, value [, time]): Records a value, time in unix seconds, default receive time.
+	"emit": {2, 3, func(e *env, line int, args []any) any {
+		topic := argString(args, 0, "emit", line)
+		t := e.time
+		if len(args) > 2 {
+			t = time.Unix(0, int64(argNumber(args, 2, "emit", line)*1e9))
+		}
+		if len(e.records) >= e.limits.MaxRecords {
+			fail(line, "record limit of %d exceeded", e.limits.MaxRecords)
+		}
+		e.records = append(e.records, Record{Topic: topic, Time: t, Value: []byte(str(args[1]))})
+		return nil
+	}},
+	// json(text): Decoded JSON value, nil if invalid.
+	"json": {1, 1, func(e *env, line int, args []any) any {
+		var v any
+		if json.Unmarshal([]byte(argString(args, 0, "json", line)), &v) != nil {
+			return nil
+		}
+		return v
+	}},
+	"str": {1, 1, func(e *env, line int, args []any) any {
+		return str(args[0])
+	}},
+	// num(value): Number from numbers, numeric strings and booleans, otherwise nil.
+	"num": {1, 1, func(e *env, line int, args []any) any {
+		switch v := args[0].(type) {
+		case float64:
+			return v
+		case bool:
+			if v {
+				return 1.0
+			}
+			return 0.0
+		case string:
+			if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return n
+			}
+		}
+		return nil
+	}},
+	"len": {1, 1, func(e *env, line int, args []any) any {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v))
+		case []any:
+			return float64(len(v))
+		case map[string]any:
+			return float64(len(v))
+		case nil:
+			return 0.0
+		}
+		fail(line, "len() of %s", typeName(args[0]))
+		return nil
+	}},
+	"keys": {1, 1, func(e *env, line int, args []any) any {
+		m, ok := args[0].(map[string]any)
+		if !ok {
+			fail(line, "keys() argument must be a map")
+		}
+		keys := []any{}
+		for _, k := range sortedKeys(m) {
+			keys = append(keys, k)
+		}
+		return keys
+	}},
+	"append": {2, 1 << 16, func(e *env, line int, args []any) any {
+		l, ok := args[0].([]any)
+		if !ok && args[0] != nil {
+			fail(line, "append() first argument must be a list")
+		}
+		return append(append([]any{}, l...), args[1:]...)
+	}},
+	"contains": {2, 2, func(e *env, line int, args []any) any {
+		switch v := args[0].(type) {
+		case string:
+			return strings.Contains(v, argString(args, 1, "contains", line))
+		case []any:
+			for _, item := range v {
+				if equal(item, args[1]) {
+					return true
+				}
+			}
+			return false
+		case map[string]any:
+			_, ok := v[argString(args, 1, "contains", line)]
+			return ok
+		}
+		fail(line, "contains() of %s", typeName(args[0]))
+		return nil
+	}},
+	"split": {2, 2, func(e *env, line int, args []any) any {
+		l := []any{}
+		for _, s := range strings.Split(argString(args, 0, "split", line), argString(args, 1, "split", line)) {
+			l = append(l, s)
+		}
+		return l
+	}},
+	"join": {2, 2, func(e *env, line int, args []any) any {
+		l, ok := args[0].([]any)
+		if !ok {
+			fail(line, "join() first argument must be a list")
+		}
+		parts := []string{}
+		for _, item := range l {
+			parts = append(parts, str(item))
+		}
+		return strings.Join(parts, argString(args, 1, "join", line))
+	}},
+	"trim": {1, 1, func(e *env, line int, args []any) any {
+		return strings.TrimSpace(argString(args, 0, "trim", line))
+	}},
+	"lower": {1, 1, func(e *env, line int, args []any) any {
+		return strings.ToLower(argString(args, 0, "lower", line))
+	}},
+	"upper": {1, 1, func(e *env, line int, args []any) any {
+		return strings.ToUpper(argString(args, 0, "upper", line))
+	}},
+	"startswith": {2, 2, func(e *env, line int, args []any) any {
+		return strings.HasPrefix(argString(args, 0, "startswith", line), argString(args, 1, "startswith", line))
+	}},
+	"endswith": {2, 2, func(e *env, line int, args []any) any {
+		return strings.HasSuffix(argString(args, 0, "endswith", line), argString(args, 1, "endswith", line))
+	}},
+	"replace": {3, 3, func(e *env, line int, args []any) any {
+		s, old := argString(args, 0, "replace", line), argString(args, 1, "replace", line)
+		if n := strings.Count(s, old); old != "" && n > 0 && len(s)+n*len(argString(args, 2, "replace", line)) > maxLength {
+			fail(line, "string length limit exceeded")
+		}
+		return strings.ReplaceAll(s, old, argString(args, 2, "replace", line))
+	}},
+	// substr(s, start [, end]): Byte range, clamped to the string.
+	"substr": {2, 3, func(e *env, line int, args []any) any {
+		s := argString(args, 0, "substr", line)
+		start, end := int(argNumber(args, 1, "substr", line)), len(s)
+		if len(args) > 2 {
+			end = int(argNumber(args, 2, "substr", line))
+		}
+		start, end = min(max(start, 0), len(s)), min(max(end, 0), len(s))
+		if start >= end {
+			return ""
+		}
+		return s[start:end]
+	}},
+	"hex": {1, 1, func(e *env, line int, args []any) any {
+		return hex.EncodeToString([]byte(argString(args, 0, "hex", line)))
+	}},
+	// round(x [, decimals])
+	"round": {1, 2, func(e *env, line int, args []any) any {
+		x, decimals := argNumber(args, 0, "round", line), 0.0
+		if len(args) > 1 {
+			decimals = argNumber(args, 1, "round", line)
+		}
+		scale := math.Pow(10, decimals)
+		return math.Round(x*scale) / scale
+	}},
+	"floor": {1, 1, func(e *env, line int, args []any) any {
+		return math.Floor(argNumber(args, 0, "floor", line))
+	}},
+	"abs": {1, 1, func(e *env, line int, args []any) any {
+		return math.Abs(argNumber(args, 0, "abs", line))
+	}},
+	"min": {1, 1 << 16, func(e *env, line int, args []any) any {
+		m := argNumber(args, 0, "min", line)
+		for i := range args[1:] {
+			m = math.Min(m, argNumber(args, i+1, "min", line))
+		}
+		return m
+	}},
+	"max": {1, 1 << 16, func(e *env, line int, args []any) any {
+		m := argNumber(args, 0, "max", line)
+		for i := range args[1:] {
+			m = math.Max(m, argNumber(args, i+1, "max", line))
+		}
+		return m
+	}},
+	// Binary payloads: byte(s, offset), uint/int(s, offset, size [, "le"]) with
+	// size 1, 2, 4 or 8, float(s, offset, size [, "le"]) with size 4 or 8.
+	"byte": {2, 2, func(e *env, line int, args []any) any {
+		return float64(field(args, "byte", 1, line)[0])
+	}},
+	"uint": {3, 4, func(e *env, line int, args []any) any {
+		return float64(integer(args, "uint", line))
+	}},
+	"int": {3, 4, func(e *env, line int, args []any) any {
+		v := integer(args, "int", line)
+		switch int(args[2].(float64)) {
+		case 1:
+			return float64(int8(v))
+		case 2:
+			return float64(int16(v))
+		case 4:
+			return float64(int32(v))
+		}
+		return float64(int64(v))
+	}},
+	"float": {3, 4, func(e *env, line int, args []any) any {
+		size := int(argNumber(args, 2, "float", line))
+		if size != 4 && size != 8 {
+			fail(line, "float() size must be 4 or 8")
+		}
+		v := integer(args, "float", line)
+		if size == 4 {
+			return float64(math.Float32frombits(uint32(v)))
+		}
+		return math.Float64frombits(v)
+	}},
+}
+
+func argString(args []any, i int, fn string, line int) string {
+	s, ok := args[i].(string)
+	if !ok {
+		fail(line, "%s() argument %d must be a string, got %s", fn, i+1, typeName(args[i]))
+	}
+	return s
+}
+
+func argNumber(args []any, i int, fn string, line int) float64 {
+	n, ok := args[i].(float64)
+	if !ok {
+		fail(line, "%s() argument %d must be a number, got %s", fn, i+1, typeName(args[i]))
+	}
+	return n
+}
+
+// Bytes of a binary payload field at the offset.
+func field(args []any, fn string, size int, line int) []byte {
+	s := argString(args, 0, fn, line)
+	offset := argNumber(args, 1, fn, line)
+	i, ok := toIndex(math.Trunc(offset), len(s)-size+1)
+	if !ok {
+		fail(line, "%s() offset %s out of range", fn, str(offset))
+	}
+	return []byte(s[i : i+size])
+}
+
+// Unsigned integer of size 1, 2, 4 or 8 bytes, big endian unless "le" is given.
+func integer(args []any, fn string, line int) uint64 {
+	size := int(argNumber(args, 2, fn, line))
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		fail(line, "%s() size must be 1, 2, 4 or 8", fn)
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if len(args) > 3 {
+		switch argString(args, 3, fn, line) {
+		case "le":
+			order = binary.LittleEndian
+		case "be":
+		default:
+			fail(line, "%s() byte order must be \"be\" or \"le\"", fn)
+		}
+	}
+	b := field(args, fn, size, line)
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	}
+	return order.Uint64(b)
+}
@@ -0,0 +1,400 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tEOF tokenKind = iota
+	tNewline
+	tIdent
+	tNumber
+	tString
+	tOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	line int
+}
+
+type syntaxError struct {
+	line int
+	msg  string
+}
+
+var keywords = []string{"if", "else", "for", "in", "return", "true", "false", "nil"}
+
+func isLetter(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// Splits the source into tokens. Newlines are statement separators, except
+// within parentheses and brackets.
+func lex(src string) ([]token, *syntaxError) {
+	toks := []token{}
+	line, depth := 1, 0
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			i++
+		case ch == '\n':
+			if depth == 0 && len(toks) > 0 && toks[len(toks)-1].kind != tNewline {
+				toks = append(toks, token{kind: tNewline, text: "\n", line: line})
+			}
+			line++
+			i++
+		case ch == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case isDigit(ch):
+			j := i
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j]) || src[j] == '.' || ((src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E') && !strings.HasPrefix(src[i:], "0x"))) {
+				j++
+			}
+			text := src[i:j]
+			var num float64
+			var err error
+			if hex, ok := strings.CutPrefix(strings.ToLower(text), "0x"); ok {
+				var u uint64
+				u, err = strconv.ParseUint(hex, 16, 64)
+				num = float64(u)
+			} else {
+				num, err = strconv.ParseFloat(text, 64)
+			}
+			if err != nil {
+				return nil, &syntaxError{line, fmt.Sprintf("invalid number '%s'", text)}
+			}
+			toks = append(toks, token{kind: tNumber, text: text, num: num, line: line})
+			i = j
+		case isLetter(ch):
+			j := i
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			toks = append(toks, token{kind: tIdent, text: src[i:j], line: line})
+			i = j
+		case ch == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, &syntaxError{line, "unterminated string"}
+			}
+			text, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, &syntaxError{line, fmt.Sprintf("invalid string %s", src[i:j+1])}
+			}
+			toks = append(toks, token{kind: tString, text: text, line: line})
+			i = j + 1
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "<=", ">=", "&&", "||"} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+				}
+			}
+			if op == "" && strings.IndexByte("+-*/%<>!=()[]{},.;:", ch) >= 0 {
+				op = string(ch)
+			}
+			if op == "" {
+				return nil, &syntaxError{line, fmt.Sprintf("unexpected character '%c'", ch)}
+			}
+			switch op {
+			case "(", "[":
+				depth++
+			case ")", "]":
+				depth = max(depth-1, 0)
+			}
+			toks = append(toks, token{kind: tOp, text: op, line: line})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tEOF, line: line}), nil
+}
+
+//------------------------------------------------------------------------
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (me *parser) peek() token {
+	return me.toks[me.pos]
+}
+
+func (me *parser) next() token {
+	tok := me.toks[me.pos]
+	if tok.kind != tEOF {
+		me.pos++
+	}
+	return tok
+}
+
+func (me *parser) fail(tok token, format string, args ...any) {
+	panic(&syntaxError{tok.line, fmt.Sprintf(format, args...)})
+}
+
+// Operator or keyword check.
+func (me *parser) is(text string) bool {
+	tok := me.peek()
+	return (tok.kind == tOp || tok.kind == tIdent) && tok.text == text
+}
+
+func (me *parser) accept(text string) bool {
+	if me.is(text) {
+		me.next()
+		return true
+	}
+	return false
+}
+
+func (me *parser) expect(text string) token {
+	if !me.is(text) {
+		me.fail(me.peek(), "expected '%s', got %s", text, describe(me.peek()))
+	}
+	return me.next()
+}
+
+func (me *parser) skipNewlines() {
+	for me.peek().kind == tNewline || me.is(";") {
+		me.next()
+	}
+}
+
+func describe(tok token) string {
+	switch tok.kind {
+	case tEOF:
+		return "end of script"
+	case tNewline:
+		return "end of line"
+	case tString:
+		return strconv.Quote(tok.text)
+	default:
+		return "'" + tok.text + "'"
+	}
+}
+
+func (me *parser) parseIdent() token {
+	tok := me.next()
+	if tok.kind != tIdent {
+		me.fail(tok, "expected name, got %s", describe(tok))
+	}
+	for _, kw := range keywords {
+		if tok.text == kw {
+			me.fail(tok, "unexpected keyword '%s'", kw)
+		}
+	}
+	return tok
+}
+
+// Statements until `}` (block) or end of script.
+func (me *parser) parseBlock(block bool) []stmt {
+	stmts := []stmt{}
+	for {
+		me.skipNewlines()
+		if block && me.is("}") {
+			me.next()
+			return stmts
+		} else if me.peek().kind == tEOF {
+			if block {
+				me.fail(me.peek(), "missing '}'")
+			}
+			return stmts
+		}
+		stmts = append(stmts, me.parseStatement())
+		if tok := me.peek(); tok.kind != tNewline && tok.kind != tEOF && !me.is(";") && !me.is("}") {
+			me.fail(tok, "unexpected %s after statement", describe(tok))
+		}
+	}
+}
+
+func (me *parser) parseStatement() stmt {
+	tok := me.peek()
+	switch {
+	case me.accept("if"):
+		return me.parseIf(tok.line)
+	case me.accept("for"):
+		s := &forStmt{line: tok.line}
+		s.val = me.parseIdent().text
+		if me.accept(",") {
+			s.key, s.val = s.val, me.parseIdent().text
+		}
+		me.expect("in")
+		s.x = me.parseExpr()
+		me.expect("{")
+		s.body = me.parseBlock(true)
+		return s
+	case me.accept("return"):
+		return &returnStmt{}
+	}
+	x := me.parseExpr()
+	if eq := me.peek(); me.accept("=") {
+		switch x.(type) {
+		case *ident, *index:
+		default:
+			me.fail(eq, "invalid assignment target")
+		}
+		return &assign{target: x, value: me.parseExpr(), line: eq.line}
+	}
+	if _, ok := x.(*call); !ok {
+		me.fail(tok, "expression result not used")
+	}
+	return &exprStmt{x: x}
+}
+
+func (me *parser) parseIf(line int) stmt {
+	s := &ifStmt{cond: me.parseExpr(), line: line}
+	me.expect("{")
+	s.then = me.parseBlock(true)
+	if me.accept("else") {
+		if tok := me.peek(); me.accept("if") {
+			s.els = []stmt{me.parseIf(tok.line)}
+		} else {
+			me.expect("{")
+			s.els = me.parseBlock(true)
+		}
+	}
+	return s
+}
+
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+func (me *parser) parseExpr() expr {
+	return me.parseBinary(1)
+}
+
+func (me *parser) parseBinary(level int) expr {
+	x := me.parseUnary()
+	for {
+		tok := me.peek()
+		prec, ok := precedence[tok.text]
+		if tok.kind != tOp || !ok || prec < level {
+			return x
+		}
+		me.next()
+		for me.peek().kind == tNewline {
+			me.next()
+		}
+		x = &binaryOp{op: tok.text, l: x, r: me.parseBinary(prec + 1), line: tok.line}
+	}
+}
+
+func (me *parser) parseUnary() expr {
+	if tok := me.peek(); me.accept("-") || me.accept("!") {
+		return &unary{op: tok.text, x: me.parseUnary(), line: tok.line}
+	}
+	return me.parsePostfix(me.parsePrimary())
+}
+
+func (me *parser) parsePostfix(x expr) expr {
+	for {
+		tok := me.peek()
+		switch {
+		case me.accept("."):
+			name := me.next()
+			if name.kind != tIdent {
+				me.fail(name, "expected field name, got %s", describe(name))
+			}
+			x = &index{x: x, i: &literal{v: name.text}, line: tok.line}
+		case me.accept("["):
+			x = &index{x: x, i: me.parseExpr(), line: tok.line}
+			me.expect("]")
+		case me.is("("):
+			id, ok := x.(*ident)
+			if !ok {
+				me.fail(tok, "only built-in functions can be called")
+			} else if _, ok := builtins[id.name]; !ok {
+				me.fail(tok, "unknown function '%s'", id.name)
+			}
+			me.next()
+			c := &call{name: id.name, fn: builtins[id.name], line: tok.line}
+			for !me.accept(")") {
+				c.args = append(c.args, me.parseExpr())
+				if !me.is(")") {
+					me.expect(",")
+				}
+			}
+			x = c
+		default:
+			return x
+		}
+	}
+}
+
+func (me *parser) parsePrimary() expr {
+	tok := me.peek()
+	switch tok.kind {
+	case tNumber:
+		me.next()
+		return &literal{v: tok.num}
+	case tString:
+		me.next()
+		return &literal{v: tok.text}
+	case tIdent:
+		switch tok.text {
+		case "true", "false":
+			me.next()
+			return &literal{v: tok.text == "true"}
+		case "nil":
+			me.next()
+			return &literal{v: nil}
+		}
+		return &ident{name: me.parseIdent().text, line: tok.line}
+	}
+	switch {
+	case me.accept("("):
+		x := me.parseExpr()
+		me.expect(")")
+		return x
+	case me.accept("["):
+		l := &listLit{}
+		for !me.accept("]") {
+			l.items = append(l.items, me.parseExpr())
+			if !me.is("]") {
+				me.expect(",")
+			}
+		}
+		return l
+	case me.accept("{"):
+		m := &mapLit{}
+		for me.skipNewlines(); !me.accept("}"); me.skipNewlines() {
+			key := me.next()
+			if key.kind != tIdent && key.kind != tString {
+				me.fail(key, "expected map key, got %s", describe(key))
+			}
+			me.expect(":")
+			m.keys, m.vals = append(m.keys, key.text), append(m.vals, me.parseExpr())
+			me.skipNewlines()
+			if !me.is("}") {
+				me.expect(",")
+			}
+		}
+		return m
+	}
+	me.fail(tok, "unexpected %s", describe(tok))
+	return nil
+}
@@ -0,0 +1,557 @@
+// Sandboxed script interpreter for custom payload decoding. Scripts have no
+// access to the file system, network or process environment, the only side
+// effect is emitting records. Executions are limited in steps and time.
+//
+//	# Comment
+//	v = json(data)
+//	if v == nil { return }
+//	for name, sensor in v.sensors {
+//	  emit(topic + "/" + name, round(sensor.value * 0.1, 1), sensor.ts / 1000)
+//	}
+//
+// Values are nil, booleans, numbers (float64), strings, lists and maps, the
+// types of decoded JSON. Predefined are `topic`, `data` (payload string),
+// `time` (receive time, unix seconds) and `levels` (topic levels).
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Execution limits, zero values select the defaults.
+type Limits struct {
+	MaxSteps   int           // Executed statements, loop iterations and function calls
+	Timeout    time.Duration // Wall time
+	MaxRecords int           // Emitted records
+}
+
+var DefaultLimits = Limits{MaxSteps: 100000, Timeout: 50 * time.Millisecond, MaxRecords: 1000}
+
+const maxLength = 1 << 20 // Strings (bytes) and lists (items) built by scripts
+
+type Record struct {
+	Topic string
+	Time  time.Time
+	Value []byte
+}
+
+type Program struct {
+	name string
+	body []stmt
+}
+
+// Parses a script, the name is used in error messages.
+func Compile(name string, source string) (prog *Program, err error) {
+	toks, serr := lex(source)
+	if serr != nil {
+		return nil, fmt.Errorf("%s:%d: %s", name, serr.line, serr.msg)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			serr, ok := r.(*syntaxError)
+			if !ok {
+				panic(r)
+			}
+			prog, err = nil, fmt.Errorf("%s:%d: %s", name, serr.line, serr.msg)
+		}
+	}()
+	p := parser{toks: toks}
+	return &Program{name: name, body: p.parseBlock(false)}, nil
+}
+
+// Executes the script for a message, returns the emitted records. On errors
+// no records are returned.
+func (me *Program) Run(topic string, t time.Time, data []byte, limits Limits) (records []Record, err error) {
+	if limits.MaxSteps <= 0 {
+		limits.MaxSteps = DefaultLimits.MaxSteps
+	}
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultLimits.Timeout
+	}
+	if limits.MaxRecords <= 0 {
+		limits.MaxRecords = DefaultLimits.MaxRecords
+	}
+	levels := []any{}
+	for _, level := range strings.Split(topic, "/") {
+		levels = append(levels, level)
+	}
+	e := &env{
+		limits:   limits,
+		deadline: time.Now().Add(limits.Timeout),
+		time:     t,
+		vars: map[string]any{
+			"topic":  topic,
+			"data":   string(data),
+			"time":   float64(t.UnixNano()) / 1e9,
+			"levels": levels,
+		},
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			return
+		} else if rerr, ok := r.(*runtimeError); ok {
+			records, err = nil, fmt.Errorf("%s:%d: %s", me.name, rerr.line, rerr.msg)
+		} else {
+			records, err = nil, fmt.Errorf("%s: internal error: %v", me.name, r) // Sandbox boundary
+		}
+	}()
+	execBlock(e, me.body)
+	return e.records, nil
+}
+
+//------------------------------------------------------------------------
+
+type runtimeError struct {
+	line int
+	msg  string
+}
+
+func fail(line int, format string, args ...any) {
+	panic(&runtimeError{line, fmt.Sprintf(format, args...)})
+}
+
+type env struct {
+	limits   Limits
+	deadline time.Time
+	steps    int
+	time     time.Time
+	vars     map[string]any
+	records  []Record
+	returned bool
+}
+
+func (me *env) step(line int) {
+	me.steps++
+	if me.steps > me.limits.MaxSteps {
+		fail(line, "step limit of %d exceeded", me.limits.MaxSteps)
+	} else if me.steps%256 == 0 && time.Now().After(me.deadline) {
+		fail(line, "time limit of %s exceeded", me.limits.Timeout)
+	}
+}
+
+type stmt interface {
+	exec(e *env)
+}
+
+type expr interface {
+	eval(e *env) any
+}
+
+func execBlock(e *env, stmts []stmt) {
+	for _, s := range stmts {
+		if e.returned {
+			return
+		}
+		s.exec(e)
+	}
+}
+
+type assign struct {
+	target expr
+	value  expr
+	line   int
+}
+
+func (me *assign) exec(e *env) {
+	e.step(me.line)
+	v := me.value.eval(e)
+	switch target := me.target.(type) {
+	case *ident:
+		e.vars[target.name] = v
+	case *index:
+		switch c := target.x.eval(e).(type) {
+		case map[string]any:
+			key, ok := target.i.eval(e).(string)
+			if !ok {
+				fail(me.line, "map keys must be strings")
+			}
+			c[key] = v
+		case []any:
+			c[listIndex(c, target.i.eval(e), me.line)] = v
+		default:
+			fail(me.line, "cannot assign to an element of %s", typeName(c))
+		}
+	}
+}
+
+type exprStmt struct {
+	x expr
+}
+
+func (me *exprStmt) exec(e *env) {
+	me.x.eval(e)
+}
+
+type ifStmt struct {
+	cond expr
+	then []stmt
+	els  []stmt
+	line int
+}
+
+func (me *ifStmt) exec(e *env) {
+	e.step(me.line)
+	if truthy(me.cond.eval(e)) {
+		execBlock(e, me.then)
+	} else {
+		execBlock(e, me.els)
+	}
+}
+
+type forStmt struct {
+	key  string // Optional index or map key variable
+	val  string
+	x    expr
+	body []stmt
+	line int
+}
+
+func (me *forStmt) exec(e *env) {
+	iterate := func(k any, v any) {
+		e.step(me.line)
+		if me.key != "" {
+			e.vars[me.key] = k
+		}
+		e.vars[me.val] = v
+		execBlock(e, me.body)
+	}
+	switch c := me.x.eval(e).(type) {
+	case []any:
+		for i := 0; i < len(c) && !e.returned; i++ {
+			iterate(float64(i), c[i])
+		}
+	case map[string]any:
+		for _, k := range sortedKeys(c) {
+			if e.returned {
+				break
+			}
+			iterate(k, c[k])
+		}
+	case nil:
+	default:
+		fail(me.line, "cannot iterate over %s", typeName(c))
+	}
+}
+
+type returnStmt struct{}
+
+func (me *returnStmt) exec(e *env) {
+	e.returned = true
+}
+
+type literal struct {
+	v any
+}
+
+func (me *literal) eval(e *env) any {
+	return me.v
+}
+
+type ident struct {
+	name string
+	line int
+}
+
+func (me *ident) eval(e *env) any {
+	v, ok := e.vars[me.name]
+	if !ok {
+		fail(me.line, "undefined variable '%s'", me.name)
+	}
+	return v
+}
+
+type listLit struct {
+	items []expr
+}
+
+func (me *listLit) eval(e *env) any {
+	l := make([]any, 0, len(me.items))
+	for _, item := range me.items {
+		l = append(l, item.eval(e))
+	}
+	return l
+}
+
+type mapLit struct {
+	keys []string
+	vals []expr
+}
+
+func (me *mapLit) eval(e *env) any {
+	m := make(map[string]any, len(me.keys))
+	for i, key := range me.keys {
+		m[key] = me.vals[i].eval(e)
+	}
+	return m
+}
+
+// Element access, missing map keys yield nil.
+type index struct {
+	x    expr
+	i    expr
+	line int
+}
+
+func (me *index) eval(e *env) any {
+	switch c := me.x.eval(e).(type) {
+	case map[string]any:
+		key, ok := me.i.eval(e).(string)
+		if !ok {
+			fail(me.line, "map keys must be strings")
+		}
+		return c[key]
+	case []any:
+		return c[listIndex(c, me.i.eval(e), me.line)]
+	case string:
+		n, ok := me.i.eval(e).(float64)
+		if !ok {
+			fail(me.line, "string index must be a number")
+		}
+		i, ok := toIndex(n, len(c))
+		if !ok {
+			fail(me.line, "string index %s out of range", str(n))
+		}
+		return c[i : i+1]
+	case nil:
+		fail(me.line, "element access on nil")
+	default:
+		fail(me.line, "element access on %s", typeName(c))
+	}
+	return nil
+}
+
+func listIndex(l []any, i any, line int) int {
+	n, ok := i.(float64)
+	index, valid := toIndex(n, len(l))
+	if !ok || !valid {
+		fail(line, "list index %s out of range", str(i))
+	}
+	return index
+}
+
+// Integer index 0 <= n < length, false for fractions, NaN and out of range
+// values (checked before the conversion, which is undefined for large floats).
+func toIndex(n float64, length int) (int, bool) {
+	if !(n >= 0 && n < float64(length)) || n != math.Trunc(n) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+type unary struct {
+	op   string
+	x    expr
+	line int
+}
+
+func (me *unary) eval(e *env) any {
+	v := me.x.eval(e)
+	if me.op == "!" {
+		return !truthy(v)
+	} else if n, ok := v.(float64); ok {
+		return -n
+	}
+	fail(me.line, "cannot negate %s", typeName(v))
+	return nil
+}
+
+type binaryOp struct {
+	op   string
+	l    expr
+	r    expr
+	line int
+}
+
+func (me *binaryOp) eval(e *env) any {
+	a := me.l.eval(e)
+	switch me.op {
+	case "&&":
+		return truthy(a) && truthy(me.r.eval(e))
+	case "||":
+		return truthy(a) || truthy(me.r.eval(e))
+	}
+	b := me.r.eval(e)
+	switch me.op {
+	case "==":
+		return equal(a, b)
+	case "!=":
+		return !equal(a, b)
+	case "+":
+		sa, aok := a.(string)
+		sb, bok := b.(string)
+		la, alist := a.([]any)
+		lb, blist := b.([]any)
+		if aok || bok {
+			if !aok {
+				sa = str(a)
+			} else if !bok {
+				sb = str(b)
+			}
+			return checkLength(sa+sb, me.line)
+		} else if alist && blist {
+			return checkLength(append(append([]any{}, la...), lb...), me.line)
+		}
+	}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			switch me.op {
+			case "<":
+				return sa < sb
+			case "<=":
+				return sa <= sb
+			case ">":
+				return sa > sb
+			case ">=":
+				return sa >= sb
+			}
+		}
+	}
+	na, aok := a.(float64)
+	nb, bok := b.(float64)
+	if !aok || !bok {
+		fail(me.line, "invalid operation: %s %s %s", typeName(a), me.op, typeName(b))
+	}
+	switch me.op {
+	case "+":
+		return na + nb
+	case "-":
+		return na - nb
+	case "*":
+		return na * nb
+	case "/", "%":
+		if nb == 0 {
+			fail(me.line, "division by zero")
+		} else if me.op == "%" {
+			return math.Mod(na, nb)
+		}
+		return na / nb
+	case "<":
+		return na < nb
+	case "<=":
+		return na <= nb
+	case ">":
+		return na > nb
+	case ">=":
+		return na >= nb
+	}
+	fail(me.line, "invalid operation: %s %s %s", typeName(a), me.op, typeName(b))
+	return nil
+}
+
+type call struct {
+	name string
+	fn   builtin
+	args []expr
+	line int
+}
+
+func (me *call) eval(e *env) any {
+	e.step(me.line)
+	args := make([]any, 0, len(me.args))
+	for _, arg := range me.args {
+		args = append(args, arg.eval(e))
+	}
+	if len(args) < me.fn.min || len(args) > me.fn.max {
+		if me.fn.min == me.fn.max {
+			fail(me.line, "%s() takes %d arguments, got %d", me.name, me.fn.min, len(args))
+		}
+		fail(me.line, "%s() takes %d to %d arguments, got %d", me.name, me.fn.min, me.fn.max, len(args))
+	}
+	return checkLength(me.fn.call(e, me.line, args), me.line)
+}
+
+//------------------------------------------------------------------------
+
+func checkLength(v any, line int) any {
+	switch v := v.(type) {
+	case string:
+		if len(v) > maxLength {
+			fail(line, "string length limit exceeded")
+		}
+	case []any:
+		if len(v) > maxLength {
+			fail(line, "list length limit exceeded")
+		}
+	}
+	return v
+}
+
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case map[string]any:
+		return len(v) > 0
+	}
+	return true
+}
+
+func equal(a any, b any) bool {
+	switch a.(type) {
+	case []any, map[string]any:
+		return reflect.DeepEqual(a, b)
+	}
+	switch b.(type) {
+	case []any, map[string]any:
+		return false
+	}
+	return a == b
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Text representation, lists and maps as JSON.
+func str(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+	text, _ := json.Marshal(v)
+	return string(text)
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
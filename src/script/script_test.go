@@ -0,0 +1,115 @@
+package script
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScript(t *testing.T) {
+	t0 := time.Unix(1750284220, 0)
+	tests := []struct {
+		source   string
+		topic    string
+		data     string
+		expected string // topic=value@unixtime;...
+	}{
+		{`emit(topic, data)`, "a/b", "x", "a/b=x@1750284220"},
+		{`emit(levels[0] + "/n", len(levels), time + 1.5)`, "a/b", "", "a/n=2@1750284221.5"},
+		{`
+			v = json(data)
+			if v == nil { return }
+			for name, s in v.sensors {
+			  emit(topic + "/" + name, round(s.value * 0.1, 1), s.ts / 1000)
+			}
+			emit(topic + "/count", len(v.sensors))
+		`, "dev", `{"sensors":{"t":{"value":215,"ts":1750284221000},"h":{"value":477.4,"ts":1750284222000}}}`,
+			"dev/h=47.7@1750284222;dev/t=21.5@1750284221;dev/count=2@1750284220"},
+		{`v = json(data); if v == nil { return }; emit(topic, 1)`, "a", "no json", ""},
+		{`
+			# Binary: int16 be, uint16 le, float32 be
+			emit("t", int(data, 0, 2) / 10)
+			emit("c", uint(data, 2, 2, "le"))
+			emit("f", float(data, 4, 4))
+			emit("h", hex(substr(data, 0, 2)))
+		`, "x", "\xff\x38\x10\x00\x3f\xc0\x00\x00", "t=-20@1750284220;c=16@1750284220;f=1.5@1750284220;h=ff38@1750284220"},
+		{`
+			s = {"ON": 1, "OFF": 0}
+			state = upper(trim(data))
+			if contains(s, state) { emit(topic, s[state]) } else if num(data) != nil {
+			  emit(topic, num(data) > 0)
+			} else { emit(topic, nil) }
+		`, "sw", " on ", "sw=1@1750284220"},
+		{`l = split(data, ","); l[1] = "B"; m = {a: l}; m.b = append(l, 4); emit("x", join(l, "|") + str(m)); emit("y", -2 % 3 + 7 / 2)`,
+			"t", "a,b,c", `x=a|B|c{"a":["a","B","c"],"b":["a","B","c",4]}@1750284220;y=1.5@1750284220`},
+		{`emit("x", 1 < 2 && "a" < "b" || x)`, "t", "", "x=true@1750284220"},
+	}
+	for _, test := range tests {
+		prog, err := Compile("test", test.source)
+		if err != nil {
+			t.Errorf("Unexpected compile error: %v", err)
+			continue
+		}
+		records, err := prog.Run(test.topic, t0, []byte(test.data), Limits{})
+		if err != nil {
+			t.Errorf("Unexpected run error: %v", err)
+			continue
+		}
+		out := []string{}
+		for _, r := range records {
+			out = append(out, r.Topic+"="+string(r.Value)+"@"+strconv.FormatFloat(float64(r.Time.UnixNano())/1e9, 'f', -1, 64))
+		}
+		if actual := strings.Join(out, ";"); actual != test.expected {
+			t.Errorf("Script %q: got '%s', expected '%s'", test.source, actual, test.expected)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	builtins["crash"] = builtin{0, 0, func(e *env, line int, args []any) any { panic("crashed") }}
+	defer delete(builtins, "crash")
+	for _, source := range []string{`emit(topic`, `x = `, `1 + 2`, `open("/etc/passwd")`, `if x { `, `a = "x`, `x = 1 $ 2`, `for in x {}`, `f(1) = 2`} {
+		if _, err := Compile("test", source); err == nil {
+			t.Errorf("Expected compile error for %q", source)
+		}
+	}
+	if _, err := Compile("test.script", "x = 1\ny = (2 +\n 3)\nz = ]"); err == nil || !strings.HasPrefix(err.Error(), "test.script:4:") {
+		t.Errorf("Expected error in line 4, got %v", err)
+	}
+	for _, test := range []struct {
+		source string
+		limits Limits
+		err    string
+	}{
+		{`emit(topic, undefined)`, Limits{}, "undefined variable"},
+		{`emit(topic, 1 / 0)`, Limits{}, "division by zero"},
+		{`emit(topic, data.x)`, Limits{}, "string index must be a number"},
+		{`emit(topic, "a" - 1)`, Limits{}, "invalid operation"},
+		{`emit(1, 1)`, Limits{}, "must be a string"},
+		{`l = [1,2,3]; for a in l { for b in l { for c in l { x = a } } }`, Limits{MaxSteps: 20}, "step limit"},
+		{`l = split(substr(hex(data), 0, 100000), ""); for a in l { for b in l { x = b } }`, Limits{MaxSteps: 1 << 40, Timeout: 20 * time.Millisecond}, "time limit"},
+		{`for i, c in split(data, "") { emit(topic, i) }`, Limits{MaxRecords: 3}, "record limit"},
+		{`s = data; for i in split(data, "") { s = s + s }`, Limits{}, "length limit"},
+		{`l = [1]; x = l[1e20]`, Limits{}, "list index 100000000000000000000 out of range"},
+		{`l = [1]; l[-1e20] = 2`, Limits{}, "list index -100000000000000000000 out of range"},
+		{`l = [1]; x = l[num("NaN")]`, Limits{}, "list index NaN out of range"},
+		{`x = data[1e20]`, Limits{}, "string index 100000000000000000000 out of range"},
+		{`x = data[num("-Inf")]`, Limits{}, "string index -Inf out of range"},
+		{`x = data[1.5]`, Limits{}, "string index 1.5 out of range"},
+		{`x = uint(data, 1e20, 2)`, Limits{}, "offset 100000000000000000000 out of range"},
+		{`x = byte(data, num("NaN"))`, Limits{}, "offset NaN out of range"},
+		{`x = byte(data, 1000)`, Limits{}, "offset 1000 out of range"},
+		{`crash()`, Limits{}, "test: internal error: crashed"},
+	} {
+		prog, err := Compile("test", test.source)
+		if err != nil {
+			t.Errorf("Unexpected compile error: %v", err)
+			continue
+		}
+		data := []byte(strings.Repeat("x", 1000))
+		if out, err := prog.Run("t", time.Now(), data, test.limits); err == nil || !strings.Contains(err.Error(), test.err) || out != nil {
+			t.Errorf("Script %q: expected error '%s', got %v", test.source, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Minimal Sparkplug B (spBv1.0) payload decoding, without generated protobuf
+// code. Decodes the metrics of NBIRTH/DBIRTH/NDATA/DDATA messages and resolves
+// metric aliases from the birth certificates.
+// @ref: https://sparkplug.eclipse.org/specification/version/3.0/documents/sparkplug-specification-3.0.0.pdf
+package sparkplug
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const Namespace = "spBv1.0"
+
+// Metric data types (subset relevant for value conversion).
+const (
+	TypeUnknown  uint32 = 0
+	TypeInt8     uint32 = 1
+	TypeInt16    uint32 = 2
+	TypeInt32    uint32 = 3
+	TypeInt64    uint32 = 4
+	TypeUInt8    uint32 = 5
+	TypeUInt16   uint32 = 6
+	TypeUInt32   uint32 = 7
+	TypeUInt64   uint32 = 8
+	TypeFloat    uint32 = 9
+	TypeDouble   uint32 = 10
+	TypeBoolean  uint32 = 11
+	TypeString   uint32 = 12
+	TypeDateTime uint32 = 13
+	TypeText     uint32 = 14
+	TypeUUID     uint32 = 15
+	TypeDataSet  uint32 = 16
+	TypeBytes    uint32 = 17
+	TypeFile     uint32 = 18
+	TypeTemplate uint32 = 19
+)
+
+type Topic struct {
+	Group       string
+	MessageType string // NBIRTH, NDATA, DBIRTH, DDATA, ...
+	EdgeNode    string
+	Device      string // Empty for node messages
+}
+
+type Metric struct {
+	Name      string
+	Alias     uint64
+	HasAlias  bool
+	Timestamp uint64 // ms since epoch, 0 if not set
+	DataType  uint32
+	IsNull    bool
+	value     any // uint32|uint64|float32|float64|bool|string|[]byte, nil if not set or unsupported
+}
+
+type Payload struct {
+	Timestamp uint64 // ms since epoch, 0 if not set
+	Seq       uint64
+	Metrics   []Metric
+}
+
+type Sample struct {
+	Topic string
+	Time  time.Time
+	Value []byte
+}
+
+type scope struct {
+	names map[uint64]string // alias -> metric name
+	types map[string]uint32 // metric name -> data type from the birth certificate
+}
+
+type Decoder struct {
+	scopes map[string]*scope // group/edge[/device] -> aliases
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		scopes: make(map[string]*scope),
+	}
+}
+
+// Returns the parsed Sparkplug topic and true if the topic is in the
+// Sparkplug B namespace.
+func ParseTopic(topic string) (Topic, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != Namespace {
+		return Topic{}, false
+	}
+	tp := Topic{
+		Group:       parts[1],
+		MessageType: parts[2],
+		EdgeNode:    parts[3],
+	}
+	if len(parts) == 5 {
+		tp.Device = parts[4]
+	}
+	switch tp.MessageType {
+	case "NBIRTH", "NDEATH", "NDATA", "NCMD":
+		return tp, tp.Device == ""
+	case "DBIRTH", "DDEATH", "DDATA", "DCMD":
+		return tp, tp.Device != ""
+	default:
+		return Topic{}, false
+	}
+}
+
+func IsTopic(topic string) bool {
+	_, ok := ParseTopic(topic)
+	return ok
+}
+
+// Path of the device or node, without message type: `spBv1.0/group/edge[/device]`.
+func (me Topic) Path() string {
+	p := Namespace + "/" + me.Group + "/" + me.EdgeNode
+	if me.Device != "" {
+		p += "/" + me.Device
+	}
+	return p
+}
+
+// Decodes a Sparkplug message into one sample per metric. The sample topic is
+// the device path with the metric name appended, the time is the metric
+// timestamp, falling back to the payload timestamp and finally the given
+// receive time. Messages other than births and data yield no samples.
+// Metrics with unresolved aliases are skipped, the returned error lists them
+// along with the samples of the remaining metrics.
+func (me *Decoder) Decode(topic string, data []byte, received time.Time) ([]Sample, error) {
+	tp, ok := ParseTopic(topic)
+	if !ok {
+		return nil, fmt.Errorf("not a sparkplug topic: '%s'", topic)
+	}
+	switch tp.MessageType {
+	case "NBIRTH", "DBIRTH", "NDATA", "DDATA":
+	default:
+		return nil, nil
+	}
+	payload, err := Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sparkplug payload of '%s': %s", topic, err.Error())
+	}
+
+	key := tp.Path()
+	switch tp.MessageType {
+	case "NBIRTH":
+		// New session of the edge node, all aliases of the node and its devices are invalid.
+		for k := range me.scopes {
+			if k == key || strings.HasPrefix(k, key+"/") {
+				delete(me.scopes, k)
+			}
+		}
+		me.scopes[key] = me.birth(payload)
+	case "DBIRTH":
+		me.scopes[key] = me.birth(payload)
+	}
+	sc := me.scopes[key]
+
+	samples := make([]Sample, 0, len(payload.Metrics))
+	unresolved := []string{}
+	for _, m := range payload.Metrics {
+		name := m.Name
+		if name == "" && m.HasAlias && sc != nil {
+			name = sc.names[m.Alias]
+		}
+		if name == "" {
+			unresolved = append(unresolved, strconv.FormatUint(m.Alias, 10))
+			continue
+		}
+		dtype := m.DataType
+		if dtype == TypeUnknown && sc != nil {
+			dtype = sc.types[name]
+		}
+		value, ok := m.Text(dtype)
+		if !ok {
+			continue
+		}
+		ts := received
+		if m.Timestamp != 0 {
+			ts = time.UnixMilli(int64(m.Timestamp))
+		} else if payload.Timestamp != 0 {
+			ts = time.UnixMilli(int64(payload.Timestamp))
+		}
+		samples = append(samples, Sample{
+			Topic: key + "/" + strings.Trim(name, "/"),
+			Time:  ts,
+			Value: value,
+		})
+	}
+	if len(unresolved) > 0 {
+		return samples, fmt.Errorf("unresolved metric alias %s in '%s' (no birth certificate received yet)", strings.Join(unresolved, ", "), topic)
+	}
+	return samples, nil
+}
+
+func (me *Decoder) birth(payload Payload) *scope {
+	sc := &scope{
+		names: make(map[uint64]string),
+		types: make(map[string]uint32),
+	}
+	for _, m := range payload.Metrics {
+		if m.Name == "" {
+			continue
+		}
+		if m.HasAlias {
+			sc.names[m.Alias] = m.Name
+		}
+		if m.DataType != TypeUnknown {
+			sc.types[m.Name] = m.DataType
+		}
+	}
+	return sc
+}
+
+// Text representation of the metric value for the given data type. Returns
+// false for unsupported types (DataSet, Template) or missing values.
+func (me Metric) Text(dtype uint32) ([]byte, bool) {
+	if me.IsNull {
+		return []byte("null"), true
+	}
+	switch v := me.value.(type) {
+	case uint32:
+		switch dtype {
+		case TypeInt8:
+			return []byte(strconv.FormatInt(int64(int8(v)), 10)), true
+		case TypeInt16:
+			return []byte(strconv.FormatInt(int64(int16(v)), 10)), true
+		case TypeInt32:
+			return []byte(strconv.FormatInt(int64(int32(v)), 10)), true
+		default:
+			return []byte(strconv.FormatUint(uint64(v), 10)), true
+		}
+	case uint64:
+		if dtype == TypeInt64 {
+			return []byte(strconv.FormatInt(int64(v), 10)), true
+		}
+		return []byte(strconv.FormatUint(v, 10)), true
+	case float32:
+		return []byte(strconv.FormatFloat(float64(v), 'g', -1, 32)), true
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'g', -1, 64)), true
+	case bool:
+		return []byte(strconv.FormatBool(v)), true
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+//------------------------------------------------------------------------
+
+var errTruncated = errors.New("truncated protobuf message")
+
+type pbReader struct {
+	data []byte
+}
+
+func (me *pbReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(me.data)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	me.data = me.data[n:]
+	return v, nil
+}
+
+func (me *pbReader) fixed32() (uint32, error) {
+	if len(me.data) < 4 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint32(me.data)
+	me.data = me.data[4:]
+	return v, nil
+}
+
+func (me *pbReader) fixed64() (uint64, error) {
+	if len(me.data) < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(me.data)
+	me.data = me.data[8:]
+	return v, nil
+}
+
+func (me *pbReader) bytes() ([]byte, error) {
+	n, err := me.varint()
+	if err != nil {
+		return nil, err
+	} else if n > uint64(len(me.data)) {
+		return nil, errTruncated
+	}
+	v := me.data[:n]
+	me.data = me.data[n:]
+	return v, nil
+}
+
+// Reads the next field key, returns field number and wire type.
+func (me *pbReader) next() (uint64, uint64, error) {
+	key, err := me.varint()
+	return key >> 3, key & 7, err
+}
+
+func (me *pbReader) skip(wiretype uint64) error {
+	var err error
+	switch wiretype {
+	case 0:
+		_, err = me.varint()
+	case 1:
+		_, err = me.fixed64()
+	case 2:
+		_, err = me.bytes()
+	case 5:
+		_, err = me.fixed32()
+	default:
+		err = fmt.Errorf("unsupported protobuf wire type %d", wiretype)
+	}
+	return err
+}
+
+// Decodes a Sparkplug B payload.
+func Unmarshal(data []byte) (Payload, error) {
+	payload := Payload{}
+	rd := pbReader{data: data}
+	for len(rd.data) > 0 {
+		field, wt, err := rd.next()
+		if err != nil {
+			return payload, err
+		}
+		switch {
+		case field == 1 && wt == 0:
+			payload.Timestamp, err = rd.varint()
+		case field == 2 && wt == 2:
+			var msg []byte
+			if msg, err = rd.bytes(); err == nil {
+				var m Metric
+				if m, err = unmarshalMetric(msg); err == nil {
+					payload.Metrics = append(payload.Metrics, m)
+				}
+			}
+		case field == 3 && wt == 0:
+			payload.Seq, err = rd.varint()
+		default:
+			err = rd.skip(wt)
+		}
+		if err != nil {
+			return payload, err
+		}
+	}
+	return payload, nil
+}
+
+func unmarshalMetric(data []byte) (Metric, error) {
+	m := Metric{}
+	rd := pbReader{data: data}
+	for len(rd.data) > 0 {
+		field, wt, err := rd.next()
+		if err != nil {
+			return m, err
+		}
+		var v uint64
+		var b []byte
+		switch {
+		case field == 1 && wt == 2:
+			b, err = rd.bytes()
+			m.Name = string(b)
+		case field == 2 && wt == 0:
+			m.Alias, err = rd.varint()
+			m.HasAlias = true
+		case field == 3 && wt == 0:
+			m.Timestamp, err = rd.varint()
+		case field == 4 && wt == 0:
+			v, err = rd.varint()
+			m.DataType = uint32(v)
+		case field == 7 && wt == 0:
+			v, err = rd.varint()
+			m.IsNull = v != 0
+		case field == 10 && wt == 0:
+			v, err = rd.varint()
+			m.value = uint32(v)
+		case field == 11 && wt == 0:
+			m.value, err = rd.varint()
+		case field == 12 && wt == 5:
+			var f uint32
+			f, err = rd.fixed32()
+			m.value = math.Float32frombits(f)
+		case field == 13 && wt == 1:
+			v, err = rd.fixed64()
+			m.value = math.Float64frombits(v)
+		case field == 14 && wt == 0:
+			v, err = rd.varint()
+			m.value = v != 0
+		case field == 15 && wt == 2:
+			b, err = rd.bytes()
+			m.value = string(b)
+		case field == 16 && wt == 2:
+			b, err = rd.bytes()
+			m.value = append([]byte(nil), b...)
+		default:
+			err = rd.skip(wt) // metadata, properties, dataset, template, extension
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
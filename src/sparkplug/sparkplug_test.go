@@ -0,0 +1,112 @@
+package sparkplug
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pbvarint(field uint64, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, field<<3), v)
+}
+
+func pbbytes(field uint64, v []byte) []byte {
+	b := binary.AppendUvarint(nil, field<<3|2)
+	return append(binary.AppendUvarint(b, uint64(len(v))), v...)
+}
+
+func pbdouble(field uint64, v float64) []byte {
+	return binary.LittleEndian.AppendUint64(binary.AppendUvarint(nil, field<<3|1), math.Float64bits(v))
+}
+
+func pbpayload(ts uint64, metrics ...[]byte) []byte {
+	b := pbvarint(1, ts)
+	for _, m := range metrics {
+		b = append(b, pbbytes(2, m)...)
+	}
+	return b
+}
+
+func pbmetric(fields ...[]byte) []byte {
+	b := []byte{}
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return b
+}
+
+func samplesText(samples []Sample) string {
+	out := []string{}
+	for _, s := range samples {
+		out = append(out, s.Topic+"="+string(s.Value)+"@"+s.Time.UTC().Format(time.RFC3339Nano))
+	}
+	return strings.Join(out, ";")
+}
+
+func TestParseTopic(t *testing.T) {
+	for topic, expected := range map[string]string{
+		"spBv1.0/plant/NBIRTH/plc1":       "spBv1.0/plant/plc1",
+		"spBv1.0/plant/DDATA/plc1/valve":  "spBv1.0/plant/plc1/valve",
+		"spBv1.0/plant/NDATA/plc1/valve":  "",
+		"spBv1.0/plant/DDATA/plc1":        "",
+		"spBv1.0/plant/STATE/plc1":        "",
+		"spBv1.0/plant/other":             "",
+		"spAv1.0/plant/NDATA/plc1":        "",
+		"spBv1.0/plant/NDATA/plc1/dev/xx": "",
+	} {
+		tp, ok := ParseTopic(topic)
+		if ok != (expected != "") || (ok && tp.Path() != expected) {
+			t.Errorf("Topic '%s': got %v '%s', expected '%s'", topic, ok, tp.Path(), expected)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tbirth := uint64(1577840400000)
+	trecv := time.UnixMilli(int64(tbirth + 60000))
+	dec := NewDecoder()
+	decode := func(topic string, payload []byte, expected string, experr string) {
+		t.Helper()
+		samples, err := dec.Decode(topic, payload, trecv)
+		if actual := samplesText(samples); actual != expected {
+			t.Errorf("Decode '%s': got '%s', expected '%s'", topic, actual, expected)
+		}
+		if (err == nil) != (experr == "") || (err != nil && !strings.Contains(err.Error(), experr)) {
+			t.Errorf("Decode '%s': got error %v, expected '%s'", topic, err, experr)
+		}
+	}
+
+	// Data before birth: aliases cannot be resolved, named metrics are decoded.
+	decode("spBv1.0/plant/NDATA/plc1", pbpayload(tbirth,
+		pbmetric(pbvarint(2, 1), pbdouble(13, 1)),
+		pbmetric(pbbytes(1, []byte("status")), pbbytes(15, []byte("ok"))),
+		pbmetric(pbvarint(2, 2), pbvarint(10, 1)),
+	), "spBv1.0/plant/plc1/status=ok@2020-01-01T01:00:00Z", "unresolved metric alias 1, 2")
+
+	// NBIRTH binds the aliases, types are taken from the birth certificate.
+	decode("spBv1.0/plant/NBIRTH/plc1", pbpayload(tbirth,
+		pbmetric(pbbytes(1, []byte("temperature")), pbvarint(2, 1), pbvarint(4, uint64(TypeDouble)), pbdouble(13, 21.5)),
+		pbmetric(pbbytes(1, []byte("count")), pbvarint(2, 2), pbvarint(4, uint64(TypeInt32)), pbvarint(10, uint64(uint32(0xfffffffb)))),
+	), "spBv1.0/plant/plc1/temperature=21.5@2020-01-01T01:00:00Z;spBv1.0/plant/plc1/count=-5@2020-01-01T01:00:00Z", "")
+	decode("spBv1.0/plant/NDATA/plc1", pbpayload(0,
+		pbmetric(pbvarint(2, 2), pbvarint(10, uint64(uint32(0xfffffffe)))),
+		pbmetric(pbvarint(2, 3), pbvarint(10, 1)),
+		pbmetric(pbvarint(2, 1), pbvarint(3, tbirth+1500), pbdouble(13, 22.25)),
+	), "spBv1.0/plant/plc1/count=-2@2020-01-01T01:01:00Z;spBv1.0/plant/plc1/temperature=22.25@2020-01-01T01:00:01.5Z", "unresolved metric alias 3")
+
+	// Device aliases are scoped, a new NBIRTH invalidates the device births.
+	decode("spBv1.0/plant/DBIRTH/plc1/valve", pbpayload(tbirth,
+		pbmetric(pbbytes(1, []byte("open")), pbvarint(2, 1), pbvarint(4, uint64(TypeBoolean)), pbvarint(14, 0)),
+	), "spBv1.0/plant/plc1/valve/open=false@2020-01-01T01:00:00Z", "")
+	decode("spBv1.0/plant/DDATA/plc1/valve", pbpayload(tbirth, pbmetric(pbvarint(2, 1), pbvarint(14, 1))),
+		"spBv1.0/plant/plc1/valve/open=true@2020-01-01T01:00:00Z", "")
+	decode("spBv1.0/plant/NBIRTH/plc1", pbpayload(tbirth), "", "")
+	decode("spBv1.0/plant/DDATA/plc1/valve", pbpayload(tbirth, pbmetric(pbvarint(2, 1), pbvarint(14, 1))), "", "unresolved metric alias 1")
+
+	// Other message types and invalid payloads.
+	decode("spBv1.0/plant/NDEATH/plc1", pbpayload(tbirth), "", "")
+	decode("spBv1.0/plant/NDATA/plc1", []byte{0x12, 0x10, 0x01}, "", "invalid sparkplug payload")
+	decode("plant/NDATA/plc1", nil, "", "not a sparkplug topic")
+}
@@ -0,0 +1,66 @@
+package timefmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var dayUnits = regexp.MustCompile(`([0-9]*\.?[0-9]+)([dw])`)
+
+// Parses a duration like time.ParseDuration, additionally with the units
+// `d` (24h) and `w` (7d), e.g. "1d12h" or "2w".
+func ParseDuration(text string) (time.Duration, error) {
+	var err error
+	expanded := dayUnits.ReplaceAllStringFunc(text, func(m string) string {
+		sub := dayUnits.FindStringSubmatch(m)
+		n, perr := strconv.ParseFloat(sub[1], 64)
+		if perr != nil {
+			err = perr
+		} else if sub[2] == "w" {
+			n *= 7
+		}
+		return strconv.FormatFloat(n*24, 'f', -1, 64) + "h"
+	})
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: '%s'", text)
+	}
+	d, err := time.ParseDuration(expanded)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: '%s'", text)
+	}
+	return d, nil
+}
+
+// Duration for JSON settings, as string ("5m", "1d") or number of seconds.
+type Duration time.Duration
+
+func (me Duration) D() time.Duration {
+	return time.Duration(me)
+}
+
+func (me Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(me).String())
+}
+
+func (me *Duration) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*me = Duration(v * float64(time.Second))
+	case string:
+		d, err := ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*me = Duration(d)
+	default:
+		return fmt.Errorf("invalid duration: %s", string(data))
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Timestamp formatting and parsing for record files.
+package timefmt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Unix        = "unix"        // Seconds since epoch, with decimals (default 2).
+	UnixMilli   = "unix_ms"     // Milliseconds since epoch.
+	UnixMicro   = "unix_us"     // Microseconds since epoch.
+	RFC3339     = "rfc3339"     // UTC date/time, with decimals for the seconds.
+	RFC3339Nano = "rfc3339nano" // UTC date/time, up to the decimals (default 9), trailing zeros removed.
+	Local       = "local"       // Local date/time with zone offset, with decimals for the seconds.
+	Auto        = "auto"        // Parsing only: detect the format from the text.
+)
+
+const DefaultFormat = Unix
+
+// Maximum number of decimals per format (nanosecond resolution).
+var maxDecimals = map[string]int{
+	Unix:        9,
+	UnixMilli:   6,
+	UnixMicro:   3,
+	RFC3339:     9,
+	RFC3339Nano: 9,
+	Local:       9,
+}
+
+func Valid(format string) bool {
+	_, ok := maxDecimals[normalize(format)]
+	return ok
+}
+
+// Returns true if the format is a plain number (no quoting needed e.g. in JSON).
+func IsNumeric(format string) bool {
+	switch normalize(format) {
+	case Unix, UnixMilli, UnixMicro:
+		return true
+	default:
+		return false
+	}
+}
+
+func DefaultDecimals(format string) int {
+	switch normalize(format) {
+	case Unix:
+		return 2
+	case RFC3339Nano:
+		return 9
+	default:
+		return 0
+	}
+}
+
+// Composes the timestamp text for the given format. Decimals < 0 selects the
+// default precision of the format, values exceeding nanosecond resolution
+// are clipped.
+func Format(t time.Time, format string, decimals int) string {
+	if format = normalize(format); format == Auto {
+		format = DefaultFormat
+	}
+	if decimals < 0 {
+		decimals = DefaultDecimals(format)
+	}
+	if md, ok := maxDecimals[format]; ok && decimals > md {
+		decimals = md
+	}
+	switch format {
+	case UnixMilli:
+		return formatUnits(t, time.Millisecond, decimals)
+	case UnixMicro:
+		return formatUnits(t, time.Microsecond, decimals)
+	case RFC3339:
+		return t.UTC().Round(resolution(decimals)).Format(layout(decimals))
+	case RFC3339Nano:
+		return t.UTC().Round(resolution(decimals)).Format(time.RFC3339Nano)
+	case Local:
+		return t.Local().Round(resolution(decimals)).Format(layout(decimals))
+	default:
+		return formatUnits(t, time.Second, decimals)
+	}
+}
+
+// Parses a timestamp text of the given format. An empty format or `auto`
+// detects numeric epoch units by magnitude (s, ms, us, ns), and date/time
+// texts as RFC3339 (which includes the `local` output). The aliases `s`,
+// `ms`, `us`, `iso` and `iso8601` are accepted as well.
+func Parse(text string, format string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return time.Time{}, fmt.Errorf("empty timestamp")
+	}
+	switch normalize(format) {
+	case Unix:
+		return parseUnits(text, time.Second)
+	case UnixMilli:
+		return parseUnits(text, time.Millisecond)
+	case UnixMicro:
+		return parseUnits(text, time.Microsecond)
+	case RFC3339, RFC3339Nano, Local:
+		return parseDate(text)
+	case Auto:
+		if isNumber(text) {
+			return parseUnits(text, detectUnit(text))
+		}
+		return parseDate(text)
+	default:
+		return time.Time{}, fmt.Errorf("unknown timestamp format '%s'", format)
+	}
+}
+
+//------------------------------------------------------------------------
+
+// Alternative names, e.g. used for timestamps in device payloads.
+var aliases = map[string]string{
+	"":        Auto,
+	"s":       Unix,
+	"ms":      UnixMilli,
+	"us":      UnixMicro,
+	"iso":     RFC3339,
+	"iso8601": RFC3339,
+}
+
+func normalize(format string) string {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if alias, ok := aliases[format]; ok {
+		return alias
+	}
+	return format
+}
+
+func pow10(n int) int64 {
+	v := int64(1)
+	for ; n > 0; n-- {
+		v *= 10
+	}
+	return v
+}
+
+func resolution(decimals int) time.Duration {
+	return time.Duration(pow10(9 - decimals))
+}
+
+func layout(decimals int) string {
+	if decimals <= 0 {
+		return "2006-01-02T15:04:05Z07:00"
+	}
+	return "2006-01-02T15:04:05." + strings.Repeat("0", decimals) + "Z07:00"
+}
+
+func formatUnits(t time.Time, unit time.Duration, decimals int) string {
+	res := int64(unit) / pow10(decimals) // Nanoseconds per last digit
+	ns := t.UnixNano()
+	neg := ns < 0
+	if neg {
+		ns = -ns
+	}
+	v := (ns + res/2) / res
+	sign := ""
+	if neg && v != 0 {
+		sign = "-"
+	}
+	if decimals <= 0 {
+		return sign + strconv.FormatInt(v, 10)
+	}
+	scale := pow10(decimals)
+	return fmt.Sprintf("%s%d.%0*d", sign, v/scale, decimals, v%scale)
+}
+
+func isNumber(text string) bool {
+	if text[0] == '-' || text[0] == '+' {
+		text = text[1:]
+	}
+	digits := 0
+	dots := 0
+	for _, c := range text {
+		if c == '.' {
+			dots++
+		} else if c >= '0' && c <= '9' {
+			digits++
+		} else {
+			return false
+		}
+	}
+	return digits > 0 && dots <= 1
+}
+
+func detectUnit(text string) time.Duration {
+	integral := strings.TrimLeft(strings.SplitN(text, ".", 2)[0], "+-0")
+	switch {
+	case len(integral) <= 11:
+		return time.Second
+	case len(integral) <= 14:
+		return time.Millisecond
+	case len(integral) <= 17:
+		return time.Microsecond
+	default:
+		return time.Nanosecond
+	}
+}
+
+func parseUnits(text string, unit time.Duration) (time.Time, error) {
+	if !isNumber(text) {
+		return time.Time{}, fmt.Errorf("invalid numeric timestamp '%s'", text)
+	}
+	neg := text[0] == '-'
+	text = strings.TrimLeft(text, "+-")
+	parts := strings.SplitN(text, ".", 2)
+	integral := int64(0)
+	if parts[0] != "" {
+		v, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid numeric timestamp '%s': %s", text, err.Error())
+		}
+		integral = v
+	}
+	ns := integral * int64(unit)
+	if len(parts) > 1 && parts[1] != "" {
+		frac := parts[1]
+		digits := len(strconv.FormatInt(int64(unit), 10)) - 1 // Significant fraction digits for ns
+		if len(frac) > digits {
+			frac = frac[:digits]
+		}
+		v, _ := strconv.ParseInt(frac, 10, 64) // String guaranteed digits
+		ns += v * pow10(digits-len(frac))
+	}
+	if neg {
+		ns = -ns
+	}
+	return time.Unix(0, ns), nil
+}
+
+func parseDate(text string) (time.Time, error) {
+	for _, layout := range []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.999999999Z0700",
+		"2006-01-02 15:04:05.999999999Z07:00",
+		"2006-01-02T15:04:05.999999999", // UTC
+	} {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date/time timestamp '%s'", text)
+}
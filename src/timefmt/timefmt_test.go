@@ -0,0 +1,74 @@
+package timefmt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	trec := time.Date(2020, time.January, 1, 1, 0, 0, 123456789, time.UTC)
+	for _, test := range []struct {
+		format   string
+		decimals int
+		expected string
+	}{
+		{"", -1, "1577840400.12"},
+		{"unix", 3, "1577840400.123"},
+		{"unix", 0, "1577840400"},
+		{"unix", 12, "1577840400.123456789"},
+		{"unix_ms", -1, "1577840400123"},
+		{"unix_ms", 3, "1577840400123.457"},
+		{"unix_us", -1, "1577840400123457"},
+		{"rfc3339", -1, "2020-01-01T01:00:00Z"},
+		{"rfc3339", 3, "2020-01-01T01:00:00.123Z"},
+		{"rfc3339nano", -1, "2020-01-01T01:00:00.123456789Z"},
+		{"rfc3339nano", 3, "2020-01-01T01:00:00.123Z"},
+		{"rfc3339nano", 0, "2020-01-01T01:00:00Z"},
+	} {
+		ts := Format(trec, test.format, test.decimals)
+		if ts != test.expected {
+			t.Errorf("Timestamp format '%s' (%d) mismatch: '%s', expected '%s'", test.format, test.decimals, ts, test.expected)
+		}
+		if tp, err := Parse(ts, test.format); err != nil {
+			t.Errorf("Failed to parse timestamp '%s': %s", ts, err.Error())
+		} else if dt := tp.Sub(trec); dt > time.Second || dt < -time.Second {
+			t.Errorf("Parsed timestamp '%s' deviates by %s", ts, dt)
+		}
+	}
+	if ts := Format(time.Unix(0, -1500000000), Unix, 1); ts != "-1.5" {
+		t.Errorf("Negative timestamp mismatch: '%s'", ts)
+	}
+}
+
+func TestParse(t *testing.T) {
+	trec := time.Date(2020, time.January, 1, 1, 0, 0, 123456789, time.UTC)
+
+	// Local time is parsed back as RFC3339 with zone offset.
+	ts := Format(trec, Local, 3)
+	if tp, err := Parse(ts, Auto); err != nil || !tp.Equal(trec.Truncate(time.Millisecond)) {
+		t.Errorf("Failed to parse local timestamp '%s' (%v)", ts, err)
+	}
+
+	// Auto detection of epoch units.
+	for _, ts := range []string{"1577840400.123", "1577840400123", "1577840400123000", "2020-01-01T01:00:00.123Z"} {
+		if tp, err := Parse(ts, Auto); err != nil {
+			t.Errorf("Failed to auto-parse '%s': %s", ts, err.Error())
+		} else if !tp.Equal(trec.Truncate(time.Millisecond)) {
+			t.Errorf("Auto-parse of '%s' mismatch: %s", ts, tp.UTC())
+		}
+	}
+
+	// Aliases
+	if tp, err := Parse("1577840400123", "ms"); err != nil || !tp.Equal(trec.Truncate(time.Millisecond)) {
+		t.Errorf("Failed to parse with alias 'ms' (%v)", err)
+	}
+
+	for _, test := range []struct{ text, format string }{{"", Auto}, {"12x", Unix}, {"yesterday", RFC3339}, {"1", "fortnights"}} {
+		if _, err := Parse(test.text, test.format); err == nil {
+			t.Errorf("Expected parse error for '%s' (%s)", test.text, test.format)
+		}
+	}
+	if Valid("fortnights") || !Valid("ISO") || !IsNumeric("unix_ms") || IsNumeric("local") {
+		t.Errorf("Unexpected format validity")
+	}
+}
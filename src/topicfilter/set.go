@@ -0,0 +1,126 @@
+package topicfilter
+
+import (
+	"slices"
+	"strings"
+)
+
+// Matches topics against many patterns at once: MQTT and literal patterns
+// are looked up in a topic level trie, globs are tested with fnmatch only
+// for topics having their literal level prefix, regular expressions always.
+type Set struct {
+	patterns []*Pattern
+	root     *node
+	regexps  []int
+}
+
+type node struct {
+	children map[string]*node // Literal levels
+	plus     *node            // MQTT `+` level
+	exact    []int            // Patterns ending at this level
+	hash     []int            // MQTT patterns ending with `#` after this level
+	globs    []int            // Globs with this literal level prefix
+}
+
+func (me *node) child(level string) *node {
+	if me.children == nil {
+		me.children = make(map[string]*node)
+	}
+	c, ok := me.children[level]
+	if !ok {
+		c = &node{}
+		me.children[level] = c
+	}
+	return c
+}
+
+// Compiles the set, nil patterns are skipped (never match). The indices
+// returned by Matches refer to the given slice.
+func NewSet(patterns []*Pattern) *Set {
+	me := &Set{patterns: patterns, root: &node{}}
+	for i, p := range patterns {
+		if p == nil {
+			continue
+		}
+		n := me.root
+		switch {
+		case p.kind == Regexp:
+			me.regexps = append(me.regexps, i)
+		case p.kind == MQTT:
+			for _, level := range p.levels {
+				if level == "#" {
+					n.hash = append(n.hash, i)
+					n = nil
+					break
+				} else if level == "+" {
+					if n.plus == nil {
+						n.plus = &node{}
+					}
+					n = n.plus
+				} else {
+					n = n.child(level)
+				}
+			}
+			if n != nil {
+				n.exact = append(n.exact, i)
+			}
+		case p.literal:
+			for _, level := range strings.Split(p.expr, "/") {
+				n = n.child(level)
+			}
+			n.exact = append(n.exact, i)
+		default:
+			prefix := p.expr[:strings.IndexAny(p.expr, "*?[")]
+			if k := strings.LastIndex(prefix, "/"); k >= 0 {
+				for _, level := range strings.Split(prefix[:k], "/") {
+					n = n.child(level)
+				}
+			}
+			n.globs = append(n.globs, i)
+		}
+	}
+	return me
+}
+
+// Appends the indices of all patterns matching the topic to `out`, sorted.
+func (me *Set) Matches(topic string, out []int) []int {
+	start := len(out)
+	out = me.walk(me.root, topic, topic, !strings.HasPrefix(topic, "$"), out)
+	for _, i := range me.regexps {
+		if me.patterns[i].re.MatchString(topic) {
+			out = append(out, i)
+		}
+	}
+	slices.Sort(out[start:])
+	return slices.Compact(out)
+}
+
+// Collects the matches of a node and its children for the remaining levels
+// of the topic. MQTT wildcards do not match the first level of `$` topics.
+func (me *Set) walk(n *node, topic string, rest string, wildcards bool, out []int) []int {
+	for _, i := range n.globs {
+		if me.patterns[i].Match(topic) {
+			out = append(out, i)
+		}
+	}
+	if wildcards {
+		out = append(out, n.hash...)
+	}
+	level, next, more := strings.Cut(rest, "/")
+	for _, c := range []*node{n.children[level], n.plus} {
+		if c == nil || (c == n.plus && !wildcards) {
+			continue
+		} else if more {
+			out = me.walk(c, topic, next, true, out)
+			continue
+		}
+		out = append(out, c.exact...)
+		out = append(out, c.hash...) // `a/#` also matches `a`
+		for _, i := range c.globs {
+			if me.patterns[i].Match(topic) {
+				out = append(out, i)
+			}
+		}
+	}
+	return out
+}
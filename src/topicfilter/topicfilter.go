@@ -0,0 +1,117 @@
+// Compiled topic patterns: fnmatch globs, MQTT wildcards and regular
+// expressions, selected by prefix (`glob:`, `mqtt:`, `re:`) or detected.
+package topicfilter
+
+import (
+	"fmt"
+	"mqttrack/fnmatch"
+	"regexp"
+	"strings"
+)
+
+const (
+	Glob   = "glob" // fnmatch without FNM_PATHNAME, `*` also matches `/`
+	MQTT   = "mqtt" // `+` matches one level, a trailing `#` all remaining levels
+	Regexp = "re"   // Go regular expression, unanchored
+)
+
+type Pattern struct {
+	text    string
+	kind    string
+	expr    string         // Pattern without kind prefix
+	levels  []string       // MQTT topic levels
+	re      *regexp.Regexp // Regexp
+	literal bool           // Glob without wildcards
+}
+
+// Detects MQTT wildcard patterns without explicit prefix, e.g. `home/+/power`
+// or `home/#`, as long as no fnmatch wildcards are used.
+func isMQTT(expr string) bool {
+	if strings.ContainsAny(expr, "*?[") {
+		return false
+	}
+	levels := strings.Split(expr, "/")
+	return expr == "#" || strings.HasSuffix(expr, "/#") || (len(levels) > 1 && strings.Contains("/"+expr+"/", "/+/"))
+}
+
+func Compile(pattern string) (*Pattern, error) {
+	me := &Pattern{text: pattern}
+	if expr, ok := strings.CutPrefix(pattern, Regexp+":"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression '%s': %s", expr, err.Error())
+		}
+		me.kind, me.expr, me.re = Regexp, expr, re
+	} else if expr, ok := strings.CutPrefix(pattern, MQTT+":"); ok {
+		me.kind, me.expr = MQTT, expr
+	} else if expr, ok := strings.CutPrefix(pattern, Glob+":"); ok {
+		me.kind, me.expr = Glob, expr
+	} else if isMQTT(pattern) {
+		me.kind, me.expr = MQTT, pattern
+	} else {
+		me.kind, me.expr = Glob, pattern
+	}
+	if me.expr == "" {
+		return nil, fmt.Errorf("empty topic pattern: '%s'", pattern)
+	}
+	switch me.kind {
+	case MQTT:
+		me.levels = strings.Split(me.expr, "/")
+		for i, level := range me.levels {
+			if (level == "#" && i != len(me.levels)-1) || (len(level) > 1 && strings.ContainsAny(level, "+#")) {
+				return nil, fmt.Errorf("invalid MQTT topic filter: '%s'", me.expr)
+			}
+		}
+	case Glob:
+		me.literal = !strings.ContainsAny(me.expr, "*?[") // No escapes (FNM_NOESCAPE)
+	}
+	return me, nil
+}
+
+func (me *Pattern) String() string {
+	return me.text
+}
+
+func (me *Pattern) Kind() string {
+	return me.kind
+}
+
+// Pattern without kind prefix.
+func (me *Pattern) Expr() string {
+	return me.expr
+}
+
+func (me *Pattern) Match(topic string) bool {
+	switch me.kind {
+	case Regexp:
+		return me.re.MatchString(topic)
+	case MQTT:
+		return matchMQTT(me.levels, topic)
+	default:
+		if me.literal {
+			return me.expr == topic
+		}
+		return fnmatch.Match(me.expr, topic, fnmatch.FNM_NOESCAPE)
+	}
+}
+
+// MQTT topic filter matching, wildcards in the first level do not match
+// topics starting with `$` (e.g. `$SYS/...`).
+func matchMQTT(levels []string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (levels[0] == "+" || levels[0] == "#") {
+		return false
+	}
+	for i, level := range levels {
+		if level == "#" {
+			return true
+		}
+		part, rest, found := strings.Cut(topic, "/")
+		if level != "+" && level != part {
+			return false
+		} else if !found {
+			return i == len(levels)-1 || (i == len(levels)-2 && levels[i+1] == "#")
+		}
+		topic = rest
+	}
+	return false
+}
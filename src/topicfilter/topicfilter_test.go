@@ -0,0 +1,85 @@
+package topicfilter
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		kind    string
+		match   []string
+		nomatch []string
+	}{
+		{"home/+/power", MQTT, []string{"home/a/power", "home//power"}, []string{"home/a/b/power", "home/power", "home/a/power/x"}},
+		{"home/#", MQTT, []string{"home", "home/a", "home/a/b/c"}, []string{"homes", "garden/home/a"}},
+		{"#", MQTT, []string{"a", "a/b"}, []string{"$SYS/broker"}},
+		{"mqtt:home/a", MQTT, []string{"home/a"}, []string{"home/a/b", "home"}},
+		{"home/*/power", Glob, []string{"home/a/power", "home/a/b/power"}, []string{"home/a/energy"}},
+		{"glob:home/#", Glob, []string{"home/#"}, []string{"home/a"}},
+		{"plug?/energy", Glob, []string{"plug1/energy"}, []string{"plug10/energy"}},
+		{"home/a", Glob, []string{"home/a"}, []string{"home/ab", "home/a/b"}},
+		{`home\a/*`, Glob, []string{`home\a/b`}, []string{"homea/b", "home/a/b"}},
+		{"re:^home/(kitchen|bath)/temp$", Regexp, []string{"home/kitchen/temp", "home/bath/temp"}, []string{"home/hall/temp", "x/home/bath/temp"}},
+		{"re:rssi", Regexp, []string{"home/a/rssi", "rssi"}, []string{"home/a/power"}},
+	} {
+		p, err := Compile(c.pattern)
+		if err != nil {
+			t.Errorf("Unexpected compile error for '%s': %v", c.pattern, err)
+			continue
+		} else if p.Kind() != c.kind {
+			t.Errorf("Pattern '%s': expected kind %s, got %s", c.pattern, c.kind, p.Kind())
+		}
+		for _, topic := range c.match {
+			if !p.Match(topic) {
+				t.Errorf("Pattern '%s' should match '%s'", c.pattern, topic)
+			}
+		}
+		for _, topic := range c.nomatch {
+			if p.Match(topic) {
+				t.Errorf("Pattern '%s' should not match '%s'", c.pattern, topic)
+			}
+		}
+	}
+	for _, pattern := range []string{"", "re:(", "mqtt:home/#/a", "mqtt:home/a+", "mqtt:"} {
+		if _, err := Compile(pattern); err == nil {
+			t.Errorf("Expected compile error for '%s'", pattern)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	texts := []string{
+		"home/+/power", "home/#", "#", "+", "+/+", "$SYS/#", "home/a", "home/a/power",
+		"home/*/power", "home/**", "*", "plug?/energy", "home/a*", "h*e/a", "[hg]*/a/+x",
+		"re:^home/(a|b)/", "re:power$", "mqtt:home/+", "mqtt:+/a/#", "glob:home/+/power", "home/+/+/#",
+		`dev\ices/x`, `a\*b/*`, `x/\[a]`,
+	}
+	topics := []string{
+		"home", "home/a", "home/b", "home/a/power", "home/b/power", "home/a/b/power", "home/+/power",
+		"plug1/energy", "plug12/energy", "$SYS/broker/load", "$SYS", "garden/a/x", "garden/a/+x", "h/a", "",
+		"home/", "/home", "home/ab", "x/a/y/z", `dev\ices/x`, "devices/x", `a\xb/c`, `x/\a`, "x/a",
+	}
+	patterns := []*Pattern{nil}
+	for _, text := range texts {
+		p, err := Compile(text)
+		if err != nil {
+			t.Fatalf("Unexpected compile error for '%s': %v", text, err)
+		}
+		patterns = append(patterns, p)
+	}
+	set := NewSet(patterns)
+	for _, topic := range topics {
+		expect := []int{}
+		for i, p := range patterns {
+			if p != nil && p.Match(topic) {
+				expect = append(expect, i)
+			}
+		}
+		got := set.Matches(topic, nil)
+		if fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Errorf("Topic '%s': expected matches %v, got %v", topic, expect, got)
+		}
+	}
+}
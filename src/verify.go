@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mqttrack/archive"
+)
+
+// Checks the integrity of the recorded files, optionally repairs them.
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	configFile := flags.String("c", DEFAULT_CONFIG_FILE, "Config file path to use.")
+	root := flags.String("root", "", "Data root directory (default from the config file).")
+	repair := flags.Bool("repair", false, "Truncate partial lines, renumber rotations, quarantine corrupt and stray files.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify [options]\n", PROGRAM_NAME)
+		fmt.Fprintf(flags.Output(), "Checks the record files for truncated lines, timestamp order, corrupt archives and stray files.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	settings, err := loadRecorderSettings(*configFile, *root)
+	if err != nil {
+		return err
+	}
+	report, err := archive.Verify(settings.RootDirectory, *repair)
+	for _, issue := range report.Issues {
+		fmt.Println(issue.String())
+	}
+	fmt.Printf("%d files, %d lines checked, %d issues, %d repaired.\n", report.Files, report.Lines, len(report.Issues), len(report.Issues)-report.Unrepaired())
+	if err != nil {
+		return err
+	} else if n := report.Unrepaired(); n > 0 {
+		return fmt.Errorf("%d issues not repaired", n)
+	}
+	return nil
+}